@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/traffic-forwarder/forwarder"
+)
+
+// startAdminServer 启动管理接口，提供 Prometheus 文本格式的 /metrics
+// 启用 toxics 时还提供 /toxics 用于在运行时注入故障
+func startAdminServer(addr string, fwd *forwarder.Forwarder, toxics bool) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, fwd.Stats())
+	})
+	if toxics {
+		handleToxics(mux, fwd)
+	}
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logrus.WithError(err).Error("Admin server stopped unexpectedly.")
+		}
+	}()
+	logrus.Infof("Admin server listening on %s.", ln.Addr())
+	return srv, nil
+}
+
+// handleToxics 注册故障注入接口：
+//
+//	GET    /toxics                      列出所有规则的故障
+//	POST   /toxics?rule=NAME            以 JSON 添加或替换故障
+//	DELETE /toxics?rule=NAME[&name=X]   删除指定故障，不指定 name 时删除该规则的全部故障
+func handleToxics(mux *http.ServeMux, fwd *forwarder.Forwarder) {
+	mux.HandleFunc("GET /toxics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fwd.Toxics())
+	})
+	mux.HandleFunc("POST /toxics", func(w http.ResponseWriter, r *http.Request) {
+		var toxic forwarder.Toxic
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&toxic); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := fwd.AddToxic(r.URL.Query().Get("rule"), toxic); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("DELETE /toxics", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if err := fwd.RemoveToxic(query.Get("rule"), query.Get("name")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// breakerStates 熔断器状态在指标中的取值
+var breakerStates = map[string]int{"closed": 0, "open": 1, "half-open": 2}
+
+// writeMetrics 输出隧道、压缩、出站地址和后端熔断相关指标
+func writeMetrics(w io.Writer, stats forwarder.Stats) {
+	fmt.Fprintln(w, "# TYPE traffic_forwarder_tunnels_active gauge")
+	for _, rule := range stats.Rules {
+		fmt.Fprintf(w, "traffic_forwarder_tunnels_active{rule=%q} %d\n", rule.Name, rule.Tunnels)
+	}
+
+	fmt.Fprintln(w, "# TYPE traffic_forwarder_compression_bytes_total counter")
+	for _, rule := range stats.Rules {
+		if rule.CompressedBytes > 0 {
+			fmt.Fprintf(w, "traffic_forwarder_compression_bytes_total{rule=%q,kind=\"uncompressed\"} %d\n", rule.Name, rule.UncompressedBytes)
+			fmt.Fprintf(w, "traffic_forwarder_compression_bytes_total{rule=%q,kind=\"compressed\"} %d\n", rule.Name, rule.CompressedBytes)
+		}
+	}
+	fmt.Fprintln(w, "# HELP traffic_forwarder_compression_ratio Uncompressed bytes per byte sent or received on the link.")
+	fmt.Fprintln(w, "# TYPE traffic_forwarder_compression_ratio gauge")
+	for _, rule := range stats.Rules {
+		if rule.CompressedBytes > 0 {
+			fmt.Fprintf(w, "traffic_forwarder_compression_ratio{rule=%q} %.3f\n", rule.Name, rule.CompressionRatio)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP traffic_forwarder_source_exhausted_total Outbound connections that failed because no local address or port was available.")
+	fmt.Fprintln(w, "# TYPE traffic_forwarder_source_exhausted_total counter")
+	for _, rule := range stats.Rules {
+		fmt.Fprintf(w, "traffic_forwarder_source_exhausted_total{rule=%q} %d\n", rule.Name, rule.SourceExhaustions)
+	}
+
+	metrics := []struct {
+		name, typ string
+		value     func(b forwarder.BackendStats) string
+	}{
+		{"traffic_forwarder_backend_state", "gauge", func(b forwarder.BackendStats) string {
+			return fmt.Sprint(breakerStates[b.State])
+		}},
+		{"traffic_forwarder_backend_consecutive_failures", "gauge", func(b forwarder.BackendStats) string {
+			return fmt.Sprint(b.ConsecutiveFailures)
+		}},
+		{"traffic_forwarder_backend_ejections_total", "counter", func(b forwarder.BackendStats) string {
+			return fmt.Sprint(b.Ejections)
+		}},
+		{"traffic_forwarder_backend_tunnels_active", "gauge", func(b forwarder.BackendStats) string {
+			return fmt.Sprint(b.Tunnels)
+		}},
+		{"traffic_forwarder_backend_dials_active", "gauge", func(b forwarder.BackendStats) string {
+			return fmt.Sprint(b.Dials)
+		}},
+		{"traffic_forwarder_backend_dials_pending", "gauge", func(b forwarder.BackendStats) string {
+			return fmt.Sprint(b.PendingDials)
+		}},
+		{"traffic_forwarder_backend_overflow_total", "counter", func(b forwarder.BackendStats) string {
+			return fmt.Sprint(b.Overflows)
+		}},
+	}
+	for _, m := range metrics {
+		if m.name == "traffic_forwarder_backend_state" {
+			fmt.Fprintln(w, "# HELP traffic_forwarder_backend_state Circuit breaker state: 0 closed, 1 open, 2 half-open.")
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+		for _, rule := range stats.Rules {
+			for _, b := range rule.Backends {
+				fmt.Fprintf(w, "%s{%s} %s\n", m.name, backendLabels(rule, b), m.value(b))
+			}
+		}
+	}
+}
+
+// backendLabels 返回后端指标的标签
+func backendLabels(rule forwarder.RuleStats, b forwarder.BackendStats) string {
+	labels := []string{
+		fmt.Sprintf("rule=%q", rule.Name),
+		fmt.Sprintf("backend=%q", b.Backend),
+	}
+	if b.Backup {
+		labels = append(labels, `role="backup"`)
+	} else {
+		labels = append(labels, `role="primary"`)
+	}
+	return strings.Join(labels, ",")
+}
@@ -3,113 +3,72 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"net"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
+
+	"github.com/amazingchow/traffic-forwarder/forwarder"
 )
 
 var (
 	_ConfigFile = flag.String("conf", "./etc/traffic-forwarder.conf", "The path of the configuration file.")
-	_Timeout    = flag.Duration("timeout", 30*time.Second, "Connection timeout")
+	_Timeout    = flag.Duration("timeout", forwarder.DefaultTimeout, "Connection timeout")
 	_MaxConns   = flag.Int("max-conns", 1000, "Maximum concurrent connections per port")
-)
 
-// ConnectionManager 管理连接的生命周期
-type ConnectionManager struct {
-	mu       sync.RWMutex
-	conns    map[net.Conn]struct{}
-	ctx      context.Context
-	cancel   context.CancelFunc
-	wg       sync.WaitGroup
-	maxConns int
-}
+	_DrainTimeout       = flag.Duration("drain-timeout", 10*time.Second, "Maximum time to let in-flight tunnels finish on shutdown")
+	_DrainHalfCloseIdle = flag.Duration("drain-half-close-idle", 0, "Half-close tunnels idle longer than this while draining (0 disables)")
+	_DrainLogInterval   = flag.Duration("drain-log-interval", 2*time.Second, "Interval between drain progress logs")
 
-// NewConnectionManager 创建新的连接管理器
-func NewConnectionManager(maxConns int) *ConnectionManager {
-	ctx, cancel := context.WithCancel(context.Background())
-	return &ConnectionManager{
-		conns:    make(map[net.Conn]struct{}),
-		ctx:      ctx,
-		cancel:   cancel,
-		maxConns: maxConns,
-	}
-}
+	_HalfCloseLinger = flag.Duration("half-close-linger", 10*time.Second, "How long a tunnel stays open after one side finished sending")
 
-// AddConnection 添加连接
-func (cm *ConnectionManager) AddConnection(conn net.Conn) bool {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
+	_LogFormat = flag.String("log-format", "text", "Log format, text or json")
+	_LogLevel  = flag.String("log-level", "info", "Log level, one of trace, debug, info, warn, error")
 
-	if len(cm.conns) >= cm.maxConns {
-		return false
-	}
+	_AdminAddr   = flag.String("admin", "", "Listen address of the admin HTTP server serving /metrics, empty to disable")
+	_AdminToxics = flag.Bool("admin-toxics", false, "Serve /toxics on the admin server to inject faults at runtime, for testing only")
 
-	cm.conns[conn] = struct{}{}
-	cm.wg.Add(1)
-	return true
-}
-
-// RemoveConnection 移除连接
-func (cm *ConnectionManager) RemoveConnection(conn net.Conn) {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
+	_AccessLog            = flag.String("access-log", "", "The path of the access log file, empty to disable")
+	_AccessLogFormat      = flag.String("access-log-format", "json", "Access log format, json or a text/template over AccessRecord")
+	_AccessLogMaxSize     = flag.Int64("access-log-max-size", 100, "Rotate the access log when it exceeds this many megabytes (0 disables)")
+	_AccessLogRotateEvery = flag.Duration("access-log-rotate-every", 0, "Rotate the access log at this interval (0 disables)")
+)
 
-	if _, exists := cm.conns[conn]; exists {
-		delete(cm.conns, conn)
-		conn.Close()
-		cm.wg.Done()
+// setupLogging 设置日志格式和级别
+func setupLogging(format, level string) error {
+	switch format {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", format)
 	}
-}
-
-// CloseAll 关闭所有连接
-func (cm *ConnectionManager) CloseAll() {
-	cm.cancel()
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
 
-	for conn := range cm.conns {
-		conn.Close()
-		cm.wg.Done()
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
 	}
-	cm.conns = make(map[net.Conn]struct{})
+	logrus.SetLevel(lvl)
+	return nil
 }
 
-// Wait 等待所有连接关闭
-func (cm *ConnectionManager) Wait() {
-	cm.wg.Wait()
-}
-
-// 全局连接管理器
-var globalConnManager *ConnectionManager
-
-// ForwardingRule 转发规则
-type ForwardingRule struct {
-	LocalPort  int
-	RemoteHost string
-	RemotePort int
-}
-
-// RunTrafficForwarder 运行流量转发器
-func RunTrafficForwarder(configFile string) bool {
+// loadRules 读取配置文件，跳过空行、注释和无效的配置行
+func loadRules(configFile string) ([]forwarder.Rule, error) {
 	logrus.Infof("Loading setting file:%s.", configFile)
 	fin, err := os.Open(configFile)
 	if err != nil {
-		logrus.WithError(err).Errorf("Failed to load setting file:%s.", configFile)
-		return false
+		return nil, err
 	}
 	defer fin.Close()
 
-	var rules []ForwardingRule
+	var rules []forwarder.Rule
 	scanner := bufio.NewScanner(fin)
 	scanner.Split(bufio.ScanLines)
 	for scanner.Scan() {
@@ -120,241 +79,146 @@ func RunTrafficForwarder(configFile string) bool {
 		if ok := strings.HasPrefix(line, "#"); ok {
 			continue
 		}
-		setting := strings.Split(line, "|")
-		if len(setting) != 3 {
-			logrus.Warnf("Skip invalid setting:%s.", line)
+		lineRules, err := forwarder.ParseRules(line)
+		if err != nil {
+			logrus.WithError(err).Warnf("Skip invalid setting:%s.", line)
 			continue
 		}
 
-		localPort, _ := strconv.Atoi(strings.TrimSpace(setting[0]))
-		remoteHost := strings.TrimSpace(setting[1])
-		remotePort, _ := strconv.Atoi(strings.TrimSpace(setting[2]))
-		if localPort <= 0 || remotePort <= 0 {
-			logrus.Warnf("Skip invalid setting:%s.", line)
-			continue
+		// 端口范围展开为多条规则，每行只记录一次
+		log := logrus.WithField("rule", lineRules[0].RuleName())
+		if len(lineRules) > 1 {
+			log = logrus.WithField("rules", len(lineRules))
 		}
-
-		logrus.Infof("Use line:'%s' to setup forwarding tunnel.", line)
-		rules = append(rules, ForwardingRule{
-			LocalPort:  localPort,
-			RemoteHost: remoteHost,
-			RemotePort: remotePort,
-		})
+		log.Infof("Use line:'%s' to setup forwarding tunnel.", line)
+		rules = append(rules, lineRules...)
 	}
 	if err = scanner.Err(); err != nil {
-		logrus.WithError(err).Errorf("Failed to continue to load setting file:%s.", *_ConfigFile)
-		return false
-	}
-
-	// 启动所有转发规则
-	var wg sync.WaitGroup
-	started := make(chan struct{}, len(rules))
-
-	for _, rule := range rules {
-		wg.Add(1)
-		go func(r ForwardingRule) {
-			defer wg.Done()
-			startForwarding(r, started)
-		}(rule)
+		return nil, err
 	}
-
-	// 等待所有转发服务启动完成
-	wg.Wait()
-	close(started)
-
-	// 等待上下文取消，确保所有goroutine都能正确退出
-	go func() {
-		<-globalConnManager.ctx.Done()
-		logrus.Info("Shutdown signal received, stopping all forwarding services.")
-	}()
-
-	return true
+	return rules, nil
 }
 
-// startForwarding 启动单个转发服务
-func startForwarding(rule ForwardingRule, started chan struct{}) {
-	ln, err := net.Listen("tcp", fmt.Sprintf("[::]:%d", rule.LocalPort))
-	if err != nil {
-		logrus.WithError(err).Errorf("Failed to listen on [::]:%d.", rule.LocalPort)
-		return
-	}
-	defer ln.Close()
-	logrus.Infof("Listening on [::]:%d.", rule.LocalPort)
-
-	// 发送启动完成信号
-	started <- struct{}{}
-
-	// 创建一个goroutine来监听上下文取消，用于优雅关闭监听器
-	go func() {
-		<-globalConnManager.ctx.Done()
-		ln.Close()
-	}()
-
-	for {
-		upstream, err := ln.Accept()
-		if err != nil {
-			if globalConnManager.ctx.Err() != nil {
-				// 服务正在关闭
-				return
-			}
-			logrus.WithError(err).Errorf("Failed to accept new connection on [::]:%d.", rule.LocalPort)
-			continue
+// reloadOnSignal 每收到一次信号重新读取配置文件并重新加载规则，读取失败时保留当前规则，ch 关闭后返回
+func reloadOnSignal(ch <-chan os.Signal, configFile string, fwd *forwarder.Forwarder) {
+	for range ch {
+		rules, err := loadRules(configFile)
+		if err == nil {
+			err = fwd.Reload(rules)
 		}
-
-		// 检查连接数量限制
-		if !globalConnManager.AddConnection(upstream) {
-			logrus.Warnf("Connection limit reached for port %d, rejecting connection from %s",
-				rule.LocalPort, upstream.RemoteAddr().String())
-			upstream.Close()
-			continue
+		if err != nil {
+			logrus.WithError(err).Error("Failed to reload setting file.")
+		} else {
+			logrus.Info("Setting file reloaded.")
 		}
-
-		remote := upstream.RemoteAddr().String()
-		logrus.Infof("Client<ip:%s> connected on [::]:%d.", remote, rule.LocalPort)
-
-		go handleConnection(upstream, rule)
 	}
 }
 
-// handleConnection 处理单个连接
-func handleConnection(upstream net.Conn, rule ForwardingRule) {
-	defer globalConnManager.RemoveConnection(upstream)
-
-	remote := upstream.RemoteAddr().String()
+// notify 注册信号，signals 为空时不注册，避免接收所有信号
+func notify(ch chan<- os.Signal, signals []os.Signal) {
+	if len(signals) > 0 {
+		signal.Notify(ch, signals...)
+	}
+}
 
-	// 设置连接超时
-	upstream.SetDeadline(time.Now().Add(*_Timeout))
+func main() {
+	flag.Parse()
 
-	// 连接到远程服务器
-	downstream, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", rule.RemoteHost, rule.RemotePort), *_Timeout)
-	if err != nil {
-		logrus.WithError(err).Errorf("Failed to connect to %s:%d for client<ip:%s>.",
-			rule.RemoteHost, rule.RemotePort, remote)
+	if err := setupLogging(*_LogFormat, *_LogLevel); err != nil {
+		logrus.WithError(err).Error("Invalid logging settings.")
 		return
 	}
-	defer downstream.Close()
 
-	// 设置下游连接超时
-	downstream.SetDeadline(time.Now().Add(*_Timeout))
-
-	// 添加到连接管理器 - 修复：只有在连接成功后才添加
-	globalConnManager.AddConnection(downstream)
-	defer globalConnManager.RemoveConnection(downstream)
-
-	logrus.Infof("Forwarding traffic from 0.0.0.0:%d to %s:%d for client<ip:%s>.",
-		rule.LocalPort, rule.RemoteHost, rule.RemotePort, remote)
-
-	// 创建上下文用于控制传输
-	ctx, cancel := context.WithCancel(globalConnManager.ctx)
-	defer cancel()
-
-	// 使用改进的传输函数 - 修复：使用sync.WaitGroup确保两个goroutine都完成
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		defer wg.Done()
-		defer cancel()
-		TransferWithContext(ctx, downstream, upstream)
-	}()
-
-	go func() {
-		defer wg.Done()
-		defer cancel()
-		TransferWithContext(ctx, upstream, downstream)
-	}()
-
-	// 等待传输完成或上下文取消
-	select {
-	case <-ctx.Done():
-		// 上下文被取消，等待goroutine完成
-		wg.Wait()
-	case <-time.After(*_Timeout):
-		// 超时保护，避免goroutine泄漏
-		cancel()
-		wg.Wait()
+	if *_ConfigFile == "" {
+		logrus.Error("No configuration file provided.")
+		return
+	}
+	if *_MaxConns > 4096 {
+		logrus.Error("Maximum concurrent connections is too large.")
+		return
 	}
-}
 
-// TransferWithContext 带上下文的传输函数
-func TransferWithContext(ctx context.Context, dst io.Writer, src io.Reader) {
-	// 使用带缓冲的传输来减少内存分配
-	buffer := make([]byte, 32*1024) // 32KB buffer
+	opts := forwarder.DefaultOptions()
+	opts.Timeout = *_Timeout
+	opts.MaxConns = *_MaxConns
+	opts.DrainTimeout = *_DrainTimeout
+	opts.DrainHalfCloseIdle = *_DrainHalfCloseIdle
+	opts.DrainLogInterval = *_DrainLogInterval
+	opts.HalfCloseLinger = *_HalfCloseLinger
+	opts.Logger = logrus.StandardLogger()
 
-	for {
-		select {
-		case <-ctx.Done():
+	// 初始化访问日志，收到重新打开信号时重新打开日志文件
+	if *_AccessLog != "" {
+		accessLogger, err := forwarder.NewAccessLogger(*_AccessLog, *_AccessLogFormat, *_AccessLogMaxSize<<20, *_AccessLogRotateEvery)
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to open access log:%s.", *_AccessLog)
 			return
-		default:
-			// 设置读取超时
-			if conn, ok := src.(net.Conn); ok {
-				conn.SetReadDeadline(time.Now().Add(*_Timeout))
-			}
-
-			n, err := src.Read(buffer)
-			if n > 0 {
-				if conn, ok := dst.(net.Conn); ok {
-					conn.SetWriteDeadline(time.Now().Add(*_Timeout))
-				}
-
-				_, writeErr := dst.Write(buffer[:n])
-				if writeErr != nil {
-					logrus.WithError(writeErr).Debug("Write error during transfer")
-					return
-				}
-			}
+		}
+		defer accessLogger.Close()
+		opts.AccessLog = accessLogger
 
-			if err != nil {
-				if err != io.EOF {
-					logrus.WithError(err).Debug("Read error during transfer")
+		reopenCh := make(chan os.Signal, 1)
+		notify(reopenCh, reopenSignals)
+		go func() {
+			for range reopenCh {
+				if err := accessLogger.Reopen(); err != nil {
+					logrus.WithError(err).Errorf("Failed to reopen access log:%s.", *_AccessLog)
+				} else {
+					logrus.Info("Access log reopened.")
 				}
-				return
 			}
-		}
+		}()
 	}
-}
 
-func main() {
-	flag.Parse()
-
-	if *_ConfigFile == "" {
-		logrus.Error("No configuration file provided.")
+	rules, err := loadRules(*_ConfigFile)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to load setting file:%s.", *_ConfigFile)
 		return
 	}
-	if *_MaxConns <= 0 {
-		logrus.Error("Invalid maximum concurrent connections.")
+	fwd, err := forwarder.New(opts, rules)
+	if err != nil {
+		logrus.WithError(err).Error("Invalid settings.")
 		return
 	}
-	if *_MaxConns > 4096 {
-		logrus.Error("Maximum concurrent connections is too large.")
+	if err := fwd.Start(context.Background()); err != nil {
+		logrus.WithError(err).Error("Failed to start service.")
 		return
 	}
+	logrus.Info("Service started.")
 
-	// 初始化全局连接管理器
-	globalConnManager = NewConnectionManager(*_MaxConns)
-	defer globalConnManager.CloseAll()
+	if *_AdminAddr != "" {
+		srv, err := startAdminServer(*_AdminAddr, fwd, *_AdminToxics)
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to start admin server on %s.", *_AdminAddr)
+			fwd.Stop(context.Background())
+			return
+		}
+		defer srv.Close()
+	}
 
-	if RunTrafficForwarder(*_ConfigFile) {
-		logrus.Info("Service started.")
-		signalCh := make(chan os.Signal, 1)
-		signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
-		<-signalCh
-		logrus.Warning("Service stopped.")
+	// 收到重新加载信号时重新读取配置文件，读取失败时保留当前规则
+	reloadCh := make(chan os.Signal, 1)
+	notify(reloadCh, reloadSignals)
+	go reloadOnSignal(reloadCh, *_ConfigFile, fwd)
 
-		// 等待所有连接优雅关闭，添加超时保护
-		done := make(chan struct{})
-		go func() {
-			globalConnManager.Wait()
-			close(done)
-		}()
+	signalCh := make(chan os.Signal, 2)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+	<-signalCh
+	logrus.Warning("Service stopping, no longer accepting new connections.")
 
-		select {
-		case <-done:
-			logrus.Info("All connections closed gracefully.")
-		case <-time.After(10 * time.Second):
-			logrus.Warning("Timeout waiting for connections to close, forcing shutdown.")
+	// 排空期间再次收到信号时强制关闭
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		if _, ok := <-signalCh; ok {
+			logrus.Warning("Second signal received, forcing shutdown.")
+			cancel()
 		}
-	} else {
-		logrus.Error("Failed to start service.")
+	}()
+	if err := fwd.Stop(ctx); err == nil {
+		logrus.Info("All connections closed gracefully.")
+	} else if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		logrus.WithError(err).Error("Failed to stop service.")
 	}
+	logrus.Warning("Service stopped.")
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/amazingchow/traffic-forwarder/forwarder"
+)
+
+// freePort 返回一个当前空闲的本地端口
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// listening 返回转发器当前监听的地址
+func listening(fwd *forwarder.Forwarder) []string {
+	var addrs []string
+	for _, rule := range fwd.Stats().Rules {
+		addrs = append(addrs, rule.Listen)
+	}
+	return addrs
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	conf := filepath.Join(t.TempDir(), "traffic-forwarder.conf")
+	writeConf := func(port int) {
+		line := fmt.Sprintf("%d | 127.0.0.1 | 9 | bind=127.0.0.1\n", port)
+		if err := os.WriteFile(conf, []byte(line), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, second := freePort(t), freePort(t)
+	writeConf(first)
+
+	rules, err := loadRules(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fwd, err := forwarder.New(forwarder.DefaultOptions(), rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fwd.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer fwd.Stop(context.Background())
+
+	ch := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		reloadOnSignal(ch, conf, fwd)
+		close(done)
+	}()
+
+	want := fmt.Sprintf("127.0.0.1:%d", second)
+	writeConf(second)
+	ch <- syscall.SIGHUP
+	deadline := time.Now().Add(5 * time.Second)
+	for strings.Join(listening(fwd), ",") != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("listening on %v after reload, want %s", listening(fwd), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 配置文件无法读取时保留当前规则
+	if err := os.Remove(conf); err != nil {
+		t.Fatal(err)
+	}
+	ch <- syscall.SIGHUP
+	close(ch)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reloadOnSignal did not return after the channel was closed")
+	}
+	if got := strings.Join(listening(fwd), ","); got != want {
+		t.Errorf("listening on %s after a failed reload, want %s", got, want)
+	}
+}
+
+func TestToxicsUnknownRule(t *testing.T) {
+	fwd, err := forwarder.New(forwarder.DefaultOptions(), []forwarder.Rule{{Name: "db", LocalPort: freePort(t), Backends: []forwarder.Backend{{Network: "tcp", Address: "127.0.0.1:9"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	handleToxics(mux, fwd)
+
+	for _, c := range []struct {
+		query string
+		code  int
+	}{
+		{"rule=db", http.StatusNoContent},
+		{"rule=bd", http.StatusNotFound},
+		{"rule=db&name=slow", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/toxics?"+c.query, nil))
+		if rec.Code != c.code {
+			t.Errorf("DELETE /toxics?%s returned %d, want %d", c.query, rec.Code, c.code)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reopenSignals 触发重新打开日志文件的信号
+var reopenSignals = []os.Signal{syscall.SIGUSR1}
+
+// reloadSignals 触发重新加载配置文件的信号
+var reloadSignals = []os.Signal{syscall.SIGHUP}
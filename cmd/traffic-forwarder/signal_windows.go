@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// reopenSignals Windows 不支持 SIGUSR1，不监听任何信号
+var reopenSignals = []os.Signal{}
+
+// reloadSignals Windows 不支持 SIGHUP，不监听任何信号
+var reloadSignals = []os.Signal{}
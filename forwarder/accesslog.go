@@ -0,0 +1,189 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// 隧道关闭原因
+const (
+	closeClientEOF   = "client_eof"
+	closeBackendEOF  = "backend_eof"
+	closeIdleTimeout = "idle_timeout"
+	closeLifetime    = "lifetime"
+	closeShutdown    = "shutdown"
+	closeError       = "error"
+)
+
+// AccessRecord 一条隧道结束时的访问日志记录
+type AccessRecord struct {
+	Start       time.Time     `json:"start"`
+	Duration    time.Duration `json:"-"`
+	ConnID      string        `json:"conn_id"`
+	Rule        string        `json:"rule"`
+	Client      string        `json:"client"`
+	Backend     string        `json:"backend"`
+	BytesUp     int64         `json:"bytes_up"`
+	BytesDown   int64         `json:"bytes_down"`
+	CloseReason string        `json:"close_reason"`
+	DialTime    time.Duration `json:"-"`
+}
+
+// MarshalJSON 以毫秒输出时长字段
+func (r *AccessRecord) MarshalJSON() ([]byte, error) {
+	type plain AccessRecord
+	return json.Marshal(struct {
+		*plain
+		DurationMs float64 `json:"duration_ms"`
+		DialTimeMs float64 `json:"dial_time_ms"`
+	}{
+		plain:      (*plain)(r),
+		DurationMs: float64(r.Duration) / float64(time.Millisecond),
+		DialTimeMs: float64(r.DialTime) / float64(time.Millisecond),
+	})
+}
+
+// AccessLogger 将访问日志写入可轮转的文件，格式为 JSON 或 text/template 模板
+type AccessLogger struct {
+	mu   sync.Mutex
+	w    *rotatingWriter
+	tmpl *template.Template
+	buf  bytes.Buffer
+}
+
+// NewAccessLogger 创建访问日志，format 为 "json" 或模板字符串
+func NewAccessLogger(path, format string, maxSize int64, rotateEvery time.Duration) (*AccessLogger, error) {
+	l := &AccessLogger{}
+	if format != "json" {
+		tmpl, err := template.New("access").Parse(format)
+		if err != nil {
+			return nil, err
+		}
+		l.tmpl = tmpl
+	}
+
+	w, err := newRotatingWriter(path, maxSize, rotateEvery)
+	if err != nil {
+		return nil, err
+	}
+	l.w = w
+	return l, nil
+}
+
+// Log 写入一条记录
+func (l *AccessLogger) Log(rec *AccessRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.buf.Reset()
+	if l.tmpl != nil {
+		if err := l.tmpl.Execute(&l.buf, rec); err != nil {
+			return err
+		}
+		l.buf.WriteByte('\n')
+	} else if err := json.NewEncoder(&l.buf).Encode(rec); err != nil {
+		return err
+	}
+	_, err := l.w.Write(l.buf.Bytes())
+	return err
+}
+
+// Reopen 重新打开日志文件，用于配合外部 logrotate
+func (l *AccessLogger) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.reopen()
+}
+
+// Close 关闭日志文件
+func (l *AccessLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Close()
+}
+
+// rotatingWriter 按大小或时间轮转的文件写入器，轮转时将当前文件重命名为带时间戳的备份
+type rotatingWriter struct {
+	path        string
+	maxSize     int64
+	rotateEvery time.Duration
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func newRotatingWriter(path string, maxSize int64, rotateEvery time.Duration) (*rotatingWriter, error) {
+	w := &rotatingWriter{path: path, maxSize: maxSize, rotateEvery: rotateEvery}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = fi.Size()
+	w.openedAt = time.Now()
+	return nil
+}
+
+func (w *rotatingWriter) reopen() error {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	return w.open()
+}
+
+func (w *rotatingWriter) rotate() error {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	backup := fmt.Sprintf("%s.%s", w.path, time.Now().Format("20060102-150405.000"))
+	if err := os.Rename(w.path, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return w.open()
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	if (w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize) ||
+		(w.rotateEvery > 0 && time.Since(w.openedAt) >= w.rotateEvery) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotatingWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
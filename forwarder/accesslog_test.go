@@ -0,0 +1,72 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAccessLoggerJSON 测试 JSON 格式的访问日志
+func TestAccessLoggerJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := NewAccessLogger(path, "json", 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to create access logger: %v", err)
+	}
+	defer l.Close()
+
+	l.Log(&AccessRecord{
+		ConnID:      "abc",
+		Rule:        "web",
+		BytesUp:     10,
+		BytesDown:   20,
+		CloseReason: closeClientEOF,
+		Duration:    1500 * time.Millisecond,
+	})
+
+	data, _ := os.ReadFile(path)
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Invalid JSON record %q: %v", data, err)
+	}
+	if got["conn_id"] != "abc" || got["close_reason"] != closeClientEOF || got["duration_ms"] != 1500.0 {
+		t.Errorf("Unexpected record: %v", got)
+	}
+}
+
+// TestAccessLoggerRotate 测试按大小轮转和重新打开
+func TestAccessLoggerRotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	l, err := NewAccessLogger(path, "{{.ConnID}} {{.Rule}} {{.CloseReason}}", 16, 0)
+	if err != nil {
+		t.Fatalf("Failed to create access logger: %v", err)
+	}
+	defer l.Close()
+
+	l.Log(&AccessRecord{ConnID: "1", Rule: "web", CloseReason: closeError})
+	l.Log(&AccessRecord{ConnID: "2", Rule: "web", CloseReason: closeError})
+
+	data, _ := os.ReadFile(path)
+	if string(data) != "2 web error\n" {
+		t.Errorf("Unexpected current log %q", data)
+	}
+	matches, _ := filepath.Glob(path + ".*")
+	if len(matches) != 1 {
+		t.Fatalf("Expected 1 rotated file, got %v", matches)
+	}
+
+	// 模拟外部 logrotate 移走文件后重新打开
+	os.Rename(path, path+".moved")
+	if err := l.Reopen(); err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	l.Log(&AccessRecord{ConnID: "3", Rule: "web", CloseReason: closeError})
+	data, _ = os.ReadFile(path)
+	if !strings.HasPrefix(string(data), "3 ") {
+		t.Errorf("Unexpected reopened log %q", data)
+	}
+}
@@ -1,12 +1,17 @@
-package main
+package forwarder
 
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 // BenchmarkConnectionManager 测试连接管理器的性能
@@ -57,6 +62,26 @@ func BenchmarkTransfer(b *testing.B) {
 	})
 }
 
+// BenchmarkTransferThroughput 测试经连接传输大块数据的吞吐量和每次传输的内存分配
+func BenchmarkTransferThroughput(b *testing.B) {
+	payload := make([]byte, 256<<10)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(payload)
+			client.Close()
+		}()
+		if _, err := TransferWithContext(context.Background(), io.Discard, server); err != nil {
+			b.Fatalf("Transfer failed: %v", err)
+		}
+		server.Close()
+	}
+}
+
 // BenchmarkMemoryUsage 测试内存使用情况
 func BenchmarkMemoryUsage(b *testing.B) {
 	cm := NewConnectionManager(100)
@@ -220,9 +245,10 @@ func BenchmarkMemoryAllocation(b *testing.B) {
 	b.ReportAllocs()
 
 	for i := 0; i < b.N; i++ {
-		// 测试缓冲区分配
-		buffer := make([]byte, 32*1024)
-		_ = buffer
+		// 测试缓冲区分配，与传输一样从缓冲池取出
+		buffer := defaultBufferPool.get(initialBufferClass)
+		(*buffer)[0] = 1
+		defaultBufferPool.put(initialBufferClass, buffer)
 
 		// 测试连接管理器创建
 		cm := NewConnectionManager(100)
@@ -230,6 +256,18 @@ func BenchmarkMemoryAllocation(b *testing.B) {
 	}
 }
 
+// BenchmarkBufferPool 测试从缓冲池取出和归还传输缓冲区的开销
+func BenchmarkBufferPool(b *testing.B) {
+	b.ReportAllocs()
+	pool := newBufferPool()
+
+	for i := 0; i < b.N; i++ {
+		buffer := newAdaptiveBuffer(pool)
+		buffer.bytes()[0] = 1
+		buffer.release()
+	}
+}
+
 // TestMemoryLeak 测试内存泄漏
 func TestMemoryLeak(t *testing.T) {
 	// 运行多次创建和销毁连接管理器
@@ -247,3 +285,79 @@ func TestMemoryLeak(t *testing.T) {
 		cm.Wait()
 	}
 }
+
+// BenchmarkConnectionRate 测试短连接的建立速率，比较单个接收循环和 SO_REUSEPORT 分片的接收循环
+func BenchmarkConnectionRate(b *testing.B) {
+	backend := bannerServer(b, "x")
+	for _, shards := range []int{0, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("reuseport=%d", shards), func(b *testing.B) {
+			if shards > 0 && !sockoptSupported {
+				b.Skip("SO_REUSEPORT listeners are only supported on Linux")
+			}
+			logger := logrus.New()
+			logger.SetLevel(logrus.WarnLevel)
+			opts := DefaultOptions()
+			opts.Logger = logger
+			opts.MaxConns = 100000
+			fwd, err := New(opts, []Rule{{Backends: []Backend{backend}, Socket: SocketOptions{ReusePort: shards}}})
+			if err != nil {
+				b.Fatalf("Failed to create forwarder: %v", err)
+			}
+			if err := fwd.Start(context.Background()); err != nil {
+				b.Fatalf("Failed to start forwarder: %v", err)
+			}
+			defer fwd.Stop(context.Background())
+			addr := fwd.Stats().Rules[0].Listen
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					conn, err := net.Dial("tcp", addr)
+					if err != nil {
+						b.Errorf("Failed to dial: %v", err)
+						return
+					}
+					io.Copy(io.Discard, conn)
+					conn.Close()
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkTunnelThroughput 测试经转发器从后端下载数据的吞吐量和内存分配，覆盖隧道实际使用的传输缓冲区
+func BenchmarkTunnelThroughput(b *testing.B) {
+	payload := strings.Repeat("x", 1<<20)
+	backend := bannerServer(b, payload)
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+	opts := DefaultOptions()
+	opts.Logger = logger
+	opts.MaxConns = 100000
+	fwd, err := New(opts, []Rule{{Backends: []Backend{backend}}})
+	if err != nil {
+		b.Fatalf("Failed to create forwarder: %v", err)
+	}
+	if err := fwd.Start(context.Background()); err != nil {
+		b.Fatalf("Failed to start forwarder: %v", err)
+	}
+	defer fwd.Stop(context.Background())
+	addr := fwd.Stats().Rules[0].Listen
+
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Errorf("Failed to dial: %v", err)
+				return
+			}
+			if n, _ := io.Copy(io.Discard, conn); n != int64(len(payload)) {
+				b.Errorf("Read %d bytes, want %d", n, len(payload))
+			}
+			conn.Close()
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package forwarder
+
+import (
+	"sync"
+	"time"
+)
+
+// 传输缓冲区的大小等级
+var bufferClasses = [...]int{4 << 10, 16 << 10, 64 << 10, 256 << 10}
+
+const (
+	initialBufferClass = 1 // 新传输从 16KB 开始
+	growAfterFullReads = 2 // 连续多少次读满缓冲区后升到更大的等级
+	shrinkAfterReads   = 64
+)
+
+// bufferPool 按大小等级缓存传输缓冲区，由一个转发器的所有隧道共享
+type bufferPool struct {
+	pools [len(bufferClasses)]sync.Pool
+}
+
+func newBufferPool() *bufferPool {
+	p := &bufferPool{}
+	for i, size := range bufferClasses {
+		p.pools[i].New = func() any {
+			buf := make([]byte, size)
+			return &buf
+		}
+	}
+	return p
+}
+
+// get 取出 class 等级的缓冲区，用完后以 put 归还；p 为 nil 时直接分配
+func (p *bufferPool) get(class int) *[]byte {
+	if p == nil {
+		buf := make([]byte, bufferClasses[class])
+		return &buf
+	}
+	return p.pools[class].Get().(*[]byte)
+}
+
+// put 归还 class 等级的缓冲区
+func (p *bufferPool) put(class int, buf *[]byte) {
+	if p != nil {
+		p.pools[class].Put(buf)
+	}
+}
+
+// adaptiveBuffer 按观察到的吞吐量调整大小的传输缓冲区：连续读满时升级，
+// 长时间只用到不足四分之一时降级，空闲连接不再占用大缓冲区
+type adaptiveBuffer struct {
+	pool  *bufferPool
+	class int
+	buf   *[]byte
+	full  int // 连续读满的次数
+	small int // 连续只用到不足四分之一的次数
+}
+
+func newAdaptiveBuffer(pool *bufferPool) *adaptiveBuffer {
+	return &adaptiveBuffer{pool: pool, class: initialBufferClass, buf: pool.get(initialBufferClass)}
+}
+
+// bytes 返回当前的缓冲区
+func (a *adaptiveBuffer) bytes() []byte {
+	return *a.buf
+}
+
+// observe 记录一次读到 n 字节，必要时更换缓冲区。调用方此后不再使用之前的缓冲区。
+// 没有缓冲池时不调整大小，每次更换都是一次新的分配
+func (a *adaptiveBuffer) observe(n int) {
+	if a.pool == nil {
+		return
+	}
+	size := len(*a.buf)
+	switch {
+	case n == size:
+		a.small = 0
+		if a.full++; a.full >= growAfterFullReads && a.class < len(bufferClasses)-1 {
+			a.resize(a.class + 1)
+		}
+	case n < size/4:
+		a.full = 0
+		if a.small++; a.small >= shrinkAfterReads && a.class > 0 {
+			a.resize(a.class - 1)
+		}
+	default:
+		a.full, a.small = 0, 0
+	}
+}
+
+func (a *adaptiveBuffer) resize(class int) {
+	a.pool.put(a.class, a.buf)
+	a.class, a.buf = class, a.pool.get(class)
+	a.full, a.small = 0, 0
+}
+
+// release 归还缓冲区
+func (a *adaptiveBuffer) release() {
+	a.pool.put(a.class, a.buf)
+	a.buf = nil
+}
+
+// coarseDeadline 粗粒度地延长连接的超时：距上次设置不足超时的 1/8 时不重新设置，
+// 减少每次读写都设置超时的开销，实际的空闲超时在 timeout 到 timeout*9/8 之间
+type coarseDeadline struct {
+	set     func(time.Time) error
+	timeout time.Duration
+	last    time.Time
+}
+
+// extend 在需要时把超时设置为 now 之后
+func (d *coarseDeadline) extend(now time.Time) {
+	if d.set == nil || now.Sub(d.last) < d.timeout/8 {
+		return
+	}
+	d.last = now
+	d.set(now.Add(d.timeout + d.timeout/8))
+}
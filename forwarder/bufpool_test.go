@@ -0,0 +1,69 @@
+package forwarder
+
+import (
+	"testing"
+	"time"
+)
+
+// TestAdaptiveBuffer 测试缓冲区在持续读满时升级、长时间用量很小时降级
+func TestAdaptiveBuffer(t *testing.T) {
+	buf := newAdaptiveBuffer(newBufferPool())
+	defer buf.release()
+	if got := len(buf.bytes()); got != bufferClasses[initialBufferClass] {
+		t.Fatalf("Expected initial buffer of %d bytes, got %d", bufferClasses[initialBufferClass], got)
+	}
+
+	for range 3 * growAfterFullReads {
+		buf.observe(len(buf.bytes()))
+	}
+	if got := len(buf.bytes()); got != bufferClasses[len(bufferClasses)-1] {
+		t.Errorf("Expected buffer to grow to %d bytes, got %d", bufferClasses[len(bufferClasses)-1], got)
+	}
+
+	// 读满之间夹杂的中等读取不会触发升降级
+	buf.resize(initialBufferClass)
+	for range 10 {
+		buf.observe(len(buf.bytes()))
+		buf.observe(len(buf.bytes()) / 2)
+	}
+	if got := len(buf.bytes()); got != bufferClasses[initialBufferClass] {
+		t.Errorf("Expected buffer to stay at %d bytes, got %d", bufferClasses[initialBufferClass], got)
+	}
+
+	for range shrinkAfterReads {
+		buf.observe(100)
+	}
+	if got := len(buf.bytes()); got != bufferClasses[0] {
+		t.Errorf("Expected buffer to shrink to %d bytes, got %d", bufferClasses[0], got)
+	}
+}
+
+// TestAdaptiveBufferWithoutPool 测试没有缓冲池时缓冲区保持初始大小
+func TestAdaptiveBufferWithoutPool(t *testing.T) {
+	buf := newAdaptiveBuffer(nil)
+	defer buf.release()
+	for range 3 * growAfterFullReads {
+		buf.observe(len(buf.bytes()))
+	}
+	if got := len(buf.bytes()); got != bufferClasses[initialBufferClass] {
+		t.Errorf("Expected buffer to stay at %d bytes, got %d", bufferClasses[initialBufferClass], got)
+	}
+}
+
+// TestCoarseDeadline 测试超时只在距上次设置超过超时的 1/8 后才重新设置，且不早于 timeout
+func TestCoarseDeadline(t *testing.T) {
+	var sets []time.Time
+	d := coarseDeadline{set: func(t time.Time) error { sets = append(sets, t); return nil }, timeout: 8 * time.Second}
+	now := time.Now()
+	for i := range 100 {
+		d.extend(now.Add(time.Duration(i) * 100 * time.Millisecond))
+	}
+	// 10 秒内每秒设置一次
+	if len(sets) != 10 {
+		t.Errorf("Expected 10 deadline updates, got %d", len(sets))
+	}
+	last := now.Add(9900 * time.Millisecond)
+	if deadline := sets[len(sets)-1]; deadline.Sub(last) < d.timeout {
+		t.Errorf("Expected deadline at least %v after the last activity, got %v", d.timeout, deadline.Sub(last))
+	}
+}
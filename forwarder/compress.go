@@ -0,0 +1,201 @@
+package forwarder
+
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 压缩协议。压缩端（compress 规则连接后端时）先发送一行协商使用的算法，解压端（decompress 规则接收客户端时）
+// 同意后回复 OK，否则回复 ERR 并断开，之后两个方向都是一个 DEFLATE 流：
+//
+//	client -> server: TFCOMP/1 <algorithm>
+//	server -> client: OK 或 ERR <reason>
+//
+// 写入的数据在空闲 compressFlushDelay 后或积累 compressMaxPending 字节后同步刷新，
+// 交互式协议的延迟不会因等待压缩块填满而增加。写方向结束时写出 DEFLATE 流的最后一块。
+const (
+	compressProtocol   = "TFCOMP/1"
+	compressDeflate    = "deflate"
+	compressFlushDelay = 2 * time.Millisecond
+	compressMaxPending = 64 << 10
+)
+
+// compressionStats 规则在压缩连接上累计的字节数，两个方向合计
+type compressionStats struct {
+	raw  atomic.Int64 // 压缩前
+	wire atomic.Int64 // 链路上实际传输
+}
+
+// compressionStats 返回规则的压缩统计，规则替换后继续累计
+func (f *Forwarder) compressionStats(rule string) *compressionStats {
+	s, _ := f.compression.LoadOrStore(rule, new(compressionStats))
+	return s.(*compressionStats)
+}
+
+// compressClient 与对端协商压缩算法，返回压缩后的连接
+func compressClient(conn net.Conn, algorithm string, stats *compressionStats) (net.Conn, error) {
+	if _, err := io.WriteString(conn, compressProtocol+" "+algorithm+"\n"); err != nil {
+		return nil, err
+	}
+	line, err := readAgentLine(conn)
+	if err != nil {
+		return nil, fmt.Errorf("compression handshake: %w", err)
+	}
+	if line != "OK" {
+		if reason, ok := strings.CutPrefix(line, "ERR "); ok {
+			return nil, fmt.Errorf("compression rejected by peer: %s", reason)
+		}
+		return nil, fmt.Errorf("peer does not decompress, unexpected reply %q", line)
+	}
+	return newCompressConn(conn, stats), nil
+}
+
+// compressServer 接受对端提出的压缩算法，与规则配置的算法不同时拒绝
+func compressServer(conn net.Conn, algorithm string, stats *compressionStats) (net.Conn, error) {
+	line, err := readAgentLine(conn)
+	if err != nil {
+		return nil, err
+	}
+	proposed, ok := strings.CutPrefix(line, compressProtocol+" ")
+	if !ok {
+		return nil, errors.New("peer does not compress")
+	}
+	if proposed != algorithm {
+		io.WriteString(conn, "ERR unsupported compression "+proposed+"\n")
+		return nil, fmt.Errorf("peer proposed unsupported compression %q", proposed)
+	}
+	if _, err := io.WriteString(conn, "OK\n"); err != nil {
+		return nil, err
+	}
+	return newCompressConn(conn, stats), nil
+}
+
+// compressConn 压缩连接，读写未压缩的数据，底层连接上传输 DEFLATE 流
+type compressConn struct {
+	net.Conn
+	stats *compressionStats
+	r     io.ReadCloser
+
+	wmu     sync.Mutex
+	w       *flate.Writer
+	pending int // 上次刷新后写入的字节数
+	timer   *time.Timer
+	werr    error
+	closed  atomic.Bool
+}
+
+func newCompressConn(conn net.Conn, stats *compressionStats) *compressConn {
+	c := &compressConn{Conn: conn, stats: stats}
+	c.r = flate.NewReader(&countingReader{r: conn, n: &stats.wire})
+	c.w, _ = flate.NewWriter(&countingWriter{w: conn, n: &stats.wire}, flate.DefaultCompression)
+	c.timer = time.AfterFunc(time.Hour, c.flushIdle)
+	c.timer.Stop()
+	return c
+}
+
+func (c *compressConn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.stats.raw.Add(int64(n))
+	return n, err
+}
+
+func (c *compressConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.werr != nil {
+		return 0, c.werr
+	}
+	n, err := c.w.Write(b)
+	c.stats.raw.Add(int64(n))
+	if err != nil {
+		c.werr = err
+		return n, err
+	}
+	c.pending += n
+	if c.pending >= compressMaxPending {
+		return n, c.flush()
+	}
+	c.timer.Reset(compressFlushDelay)
+	return n, nil
+}
+
+// flush 同步刷新已压缩的数据，调用方持有 wmu
+func (c *compressConn) flush() error {
+	c.timer.Stop()
+	if c.pending == 0 || c.werr != nil {
+		return c.werr
+	}
+	c.pending = 0
+	if err := c.w.Flush(); err != nil {
+		c.werr = err
+	}
+	return c.werr
+}
+
+// flushIdle 写方向空闲后刷新，错误留给下一次写入返回
+func (c *compressConn) flushIdle() {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if !c.closed.Load() {
+		c.flush()
+	}
+}
+
+// CloseWrite 写出 DEFLATE 流的最后一块并关闭底层连接的写方向
+func (c *compressConn) CloseWrite() error {
+	c.wmu.Lock()
+	c.timer.Stop()
+	c.closed.Store(true)
+	err := c.werr
+	if err == nil {
+		err = c.w.Close()
+	}
+	c.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+	return closeWrite(c.Conn)
+}
+
+// Close 关闭连接，不等待进行中的写入，以便唤醒阻塞的写
+func (c *compressConn) Close() error {
+	c.closed.Store(true)
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+// NetConn 返回被包装的连接
+func (c *compressConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// countingReader 统计读取的字节数
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// countingWriter 统计写出的字节数
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,77 @@
+package forwarder
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCompression 测试压缩端与解压端之间的隧道：交互式的小数据无需等待即可到达，
+// 大量文本压缩后正确传递并统计压缩率，未启用解压的对端被明确拒绝
+func TestCompression(t *testing.T) {
+	dir := t.TempDir()
+	echo := echoServer(t)
+	exit := startForwarder(t, Rule{Name: "exit", Backends: []Backend{echo}, Decompress: compressDeflate})
+	backend := Backend{Network: "tcp", Address: exit.Stats().Rules[0].Listen}
+	sock := filepath.Join(dir, "entry.sock")
+	entry := startForwarder(t, Rule{Name: "entry", LocalUnix: sock, Backends: []Backend{backend}, Compress: compressDeflate})
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Expected interactive echo, got %q, %v", buf, err)
+	}
+
+	payload := []byte(strings.Repeat("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n", 20000))
+	go func() {
+		conn.Write(payload)
+		conn.(*net.UnixConn).CloseWrite()
+	}()
+	got, err := io.ReadAll(conn)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("Expected %d bytes echoed, got %d, %v", len(payload), len(got), err)
+	}
+
+	for _, fwd := range []*Forwarder{entry, exit} {
+		rs := fwd.Stats().Rules[0]
+		if rs.UncompressedBytes < 2*int64(len(payload)) || rs.CompressionRatio < 10 {
+			t.Errorf("Rule %s: unexpected compression stats %d/%d, ratio %.1f", rs.Name, rs.UncompressedBytes, rs.CompressedBytes, rs.CompressionRatio)
+		}
+	}
+
+	// 后端是未启用解压的回显服务，收到的协商行原样返回
+	plain := filepath.Join(dir, "plain.sock")
+	startForwarder(t, Rule{LocalUnix: plain, Backends: []Backend{echo}, Compress: compressDeflate})
+	conn, err = net.Dial("unix", plain)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(buf); err != io.EOF {
+		t.Errorf("Expected mismatched peer to close the tunnel, got %d bytes, %v", n, err)
+	}
+}
+
+// TestCompressionWithEncryption 测试同时压缩和加密的规则被拒绝
+func TestCompressionWithEncryption(t *testing.T) {
+	backends := []Backend{{Network: "tcp", Address: "127.0.0.1:80"}}
+	for _, rule := range []Rule{
+		{LocalPort: 18080, Backends: backends, Compress: compressDeflate, Encrypt: "tunnel.keys"},
+		{LocalPort: 18080, Backends: backends, Decompress: compressDeflate, Decrypt: "tunnel.keys"},
+	} {
+		if _, err := New(DefaultOptions(), []Rule{rule}); err == nil {
+			t.Errorf("Expected rule %+v combining compression and encryption to be rejected", rule)
+		}
+	}
+}
@@ -0,0 +1,927 @@
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unixPrefix 标识 Unix 套接字地址，以 @ 开头的路径表示 Linux 抽象套接字
+const (
+	unixPrefix    = "unix:"
+	reversePrefix = "reverse:"
+	agentPrefix   = "agent:"
+)
+
+// 规则模式
+const (
+	ModeForward     = ""             // 转发到固定的后端
+	ModeSOCKS5      = "socks5"       // 作为 SOCKS5 代理，由客户端指定目标
+	ModeHTTPConnect = "http-connect" // 作为 HTTP CONNECT 代理，由客户端指定目标
+
+	ModeReverseServer = "reverse-server" // 接收反向隧道代理端的连接
+	ModeReverse       = "reverse"        // 通过反向隧道转发到代理端暴露的服务
+	ModeLinkServer    = "link-server"    // 接收其他转发器的多路复用链路，连接链路上请求的目标
+)
+
+// Backend 上游后端
+type Backend struct {
+	Network  string // tcp 或 unix
+	Address  string
+	Priority uint16 // 数值越小越优先，只有高优先级的后端全部不可用时才使用低优先级的后端
+	Weight   uint16 // 同一优先级内的相对权重，全部相同时按轮询选择
+}
+
+// key 返回后端的唯一标识
+func (b Backend) key() string {
+	return b.Network + "://" + b.Address
+}
+
+// String 返回后端的可读描述
+func (b Backend) String() string {
+	if b.Network == "unix" {
+		return unixPrefix + b.Address
+	}
+	return b.Address
+}
+
+// parseBackend 解析 host:port、unix:<path>，或使用默认端口的裸主机名
+func parseBackend(s, defaultPort string) (Backend, error) {
+	if path, ok := strings.CutPrefix(s, unixPrefix); ok {
+		if path == "" {
+			return Backend{}, errors.New("empty unix socket path")
+		}
+		return Backend{Network: "unix", Address: path}, nil
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = s, defaultPort
+	}
+	if host == "" {
+		return Backend{}, errors.New("empty remote host")
+	}
+	if p, _ := strconv.Atoi(port); p <= 0 || p > 65535 {
+		return Backend{}, fmt.Errorf("invalid remote port %q for %s", port, host)
+	}
+	return Backend{Network: "tcp", Address: net.JoinHostPort(host, port)}, nil
+}
+
+// RetryPolicy 连接后端失败时的重试策略
+type RetryPolicy struct {
+	Retries    int           // 首次失败后的重试次数
+	Backoff    time.Duration // 首次重试前的等待时间，之后每次翻倍
+	Failover   bool          // 重试时切换到池中的下一个后端
+	DialBudget time.Duration // 所有尝试的总时间预算，0 表示使用连接超时
+}
+
+// Rule 转发规则
+type Rule struct {
+	Name      string // 规则名称，用于日志，为空时使用 String()
+	LocalPort int
+	LocalUnix string   // 监听的 Unix 套接字路径，非空时忽略 LocalPort
+	Bind      []string // 监听的 IP 地址或网卡名称（监听网卡的所有地址），为空时监听所有地址
+	IPv6Only  bool     // IPv6 监听地址只接受 IPv6 连接，默认同时接受 IPv4 连接
+
+	Backends  []Backend // 后端池，按轮询方式选择
+	Discovery Discovery // 动态后端来源，设置后忽略 Backends
+	Backup    *Backend  // 后端池全部失败后使用的备用后端
+	Retry     RetryPolicy
+	Outlier   OutlierPolicy
+
+	DNSServer string        // 解析后端域名使用的 DNS 服务器，为空时使用系统解析器
+	DNSTTL    time.Duration // 使用系统解析器时的缓存时间
+
+	Source    []string // 连接后端或代理目标使用的源 IP 地址池，轮流使用，为空时由路由决定
+	Interface string   // 连接后端或代理目标时绑定的网卡（SO_BINDTODEVICE），仅 Linux
+	FWMark    uint32   // 出站连接的防火墙标记（SO_MARK），仅 Linux
+
+	Socket SocketOptions // 监听和出站连接的 TCP 套接字选项
+
+	SocketMode  os.FileMode // 监听套接字文件的权限，0 表示保持默认
+	UnlinkStale bool        // 监听前清理无人监听的残留套接字文件
+
+	Filters []string // 按顺序作用于隧道数据的过滤器名称，在 Options.Filters 中注册
+
+	Mode     string   // 规则模式，代理模式下不使用后端池
+	AuthFile string   // 代理模式的用户名密码文件，每行一个 user:password，为空时不认证
+	Allow    []string // 代理模式允许访问的目标，为空时不限制
+
+	ReverseServer string // 非空时规则作为反向隧道的代理端，不在本地监听，而是从该服务端接收连接
+	Service       string // 代理端暴露的服务名称，或反向隧道规则转发到的服务名称
+	TokenFile     string // 反向隧道或链路两端共享的令牌文件
+
+	Via       string // 非空时经到该 link-server 的多路复用链路连接后端，后端地址由远端解析
+	LinkConns int    // 链路的最大连接数，0 表示使用默认值 2
+
+	Encrypt string // 非空时用该密钥文件加密到后端的连接，后端是启用 decrypt 的转发器
+	Decrypt string // 非空时客户端连接须由启用 encrypt 的转发器用该密钥文件中的密钥加密
+
+	// 不能与 Encrypt 和 Decrypt 同时设置
+	Compress   string // 非空时用该算法压缩到后端的连接，后端是启用 decompress 的转发器
+	Decompress string // 非空时客户端连接须由启用 compress 的转发器用该算法压缩
+
+	WebSocket       string // 非空时经该路径的 WebSocket 连接后端，后端是启用 websocket-accept 的转发器
+	WebSocketAccept string // 非空时客户端连接须是该路径上携带令牌的 WebSocket 升级请求
+	WebSocketTLS    bool   // 经 TLS 连接 WebSocket 后端（wss）
+	WebSocketCA     string // 校验 WebSocket 后端证书的 CA 证书文件，为空时使用系统根证书
+	WebSocketProxy  string // 非空时经该 HTTP 代理（http://[user:password@]host:port）以 CONNECT 连接 WebSocket 后端
+	WebSocketCert   string // 非空时 websocket-accept 规则以该证书和 WebSocketKey 接受 TLS 连接
+	WebSocketKey    string
+}
+
+// String 返回规则的可读描述
+func (r Rule) String() string {
+	return fmt.Sprintf("%s->%s", r.localString(), r.remoteString())
+}
+
+// RuleName 返回规则名称
+func (r Rule) RuleName() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.String()
+}
+
+func (r Rule) localString() string {
+	if r.ReverseServer != "" {
+		return reversePrefix + r.ReverseServer
+	}
+	if r.LocalUnix != "" {
+		return unixPrefix + r.LocalUnix
+	}
+	if len(r.Bind) > 0 {
+		addrs := make([]string, len(r.Bind))
+		for i, b := range r.Bind {
+			addrs[i] = net.JoinHostPort(b, strconv.Itoa(r.LocalPort))
+		}
+		return strings.Join(addrs, ",")
+	}
+	return fmt.Sprintf("[::]:%d", r.LocalPort)
+}
+
+func (r Rule) remoteString() string {
+	if r.Mode == ModeReverse {
+		return agentPrefix + r.Service
+	}
+	if r.Mode != ModeForward {
+		return r.Mode
+	}
+	if r.Discovery.Kind != "" {
+		return r.Discovery.String()
+	}
+	backends := make([]string, len(r.Backends))
+	for i, b := range r.Backends {
+		backends[i] = b.String()
+	}
+	return strings.Join(backends, ",")
+}
+
+// listenAddr 返回监听使用的网络类型和地址，TCP 规则的地址可能是逗号分隔的多个地址，网卡名称在监听时解析
+func (r Rule) listenAddr() (string, string) {
+	if r.ReverseServer != "" {
+		return "reverse", r.ReverseServer + "/" + r.Service
+	}
+	if r.LocalUnix != "" {
+		return "unix", r.LocalUnix
+	}
+	if r.IPv6Only {
+		return "tcp6", r.localString()
+	}
+	return "tcp", r.localString()
+}
+
+// addressKey 返回监听地址的唯一标识
+func (r Rule) addressKey() string {
+	network, address := r.listenAddr()
+	return network + "://" + address
+}
+
+// listenKey 返回监听器的唯一标识，重新加载时据此判断规则是否对应同一个监听器
+func (r Rule) listenKey() string {
+	key := r.addressKey()
+	if s := r.Socket; s.kernel() || s.NoKeepAlive || s.KeepAliveIdle != 0 || s.KeepAliveInterval != 0 || s.KeepAliveCount != 0 {
+		// 监听套接字的选项在创建时设置，选项改变时需要重新监听
+		key += fmt.Sprintf("?%+v", s)
+	}
+	if r.bindsInterface() {
+		// 网卡名在监听时才解析为地址，网卡的地址变化后需要重新监听
+		addrs, err := r.bindAddrs()
+		if err != nil {
+			return key + "#" + err.Error()
+		}
+		key += fmt.Sprintf("#%v", addrs)
+	}
+	return key
+}
+
+// bindsInterface 判断 bind 是否包含网卡名
+func (r Rule) bindsInterface() bool {
+	return slices.ContainsFunc(r.Bind, func(b string) bool {
+		_, err := netip.ParseAddr(b)
+		return err != nil
+	})
+}
+
+// ParseRules 解析一行配置，local 为端口范围 first-last 时展开为每个端口一条规则：remote port 为
+// 同样大小的范围时按顺序一一对应（相同端口或整体偏移），为单个端口时都转发到该端口。
+// 设置了 name 时每条规则的名称加上 "-<本地端口>" 后缀。其余格式同 ParseRule。
+func ParseRules(line string) ([]Rule, error) {
+	setting := strings.Split(line, "|")
+	if len(setting) != 3 && len(setting) != 4 {
+		return nil, errors.New("expect 3 or 4 fields")
+	}
+	local, remote := strings.TrimSpace(setting[0]), strings.TrimSpace(setting[2])
+	first, last, localRange, err := parsePortRange(local)
+	if err != nil {
+		return nil, err
+	}
+	remoteFirst, remoteLast, remoteRange, err := parsePortRange(remote)
+	if err != nil {
+		return nil, err
+	}
+	if !localRange {
+		if remoteRange {
+			return nil, errors.New("remote port range requires a local port range")
+		}
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, err
+		}
+		return []Rule{rule}, nil
+	}
+	if remoteRange && remoteLast-remoteFirst != last-first {
+		return nil, fmt.Errorf("local range %s and remote range %s differ in size", local, remote)
+	}
+
+	rules := make([]Rule, 0, last-first+1)
+	for port := first; port <= last; port++ {
+		setting[0] = strconv.Itoa(port)
+		if remoteRange {
+			setting[2] = strconv.Itoa(remoteFirst + port - first)
+		}
+		rule, err := ParseRule(strings.Join(setting, "|"))
+		if err != nil {
+			return nil, fmt.Errorf("port %d: %w", port, err)
+		}
+		if rule.Name != "" {
+			rule.Name += "-" + setting[0]
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parsePortRange 解析 first-last 形式的端口范围，不是端口范围时 ok 为 false
+func parsePortRange(s string) (first, last int, ok bool, err error) {
+	a, b, found := strings.Cut(s, "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+	first, errFirst := strconv.Atoi(a)
+	last, errLast := strconv.Atoi(b)
+	if errFirst != nil || errLast != nil {
+		return 0, 0, false, nil
+	}
+	if first <= 0 || last > 65535 || first > last {
+		return 0, 0, false, fmt.Errorf("invalid port range %q", s)
+	}
+	return first, last, true, nil
+}
+
+// ParseRule 解析一行配置:
+//
+//	local | remote host | remote port [| key=value ...]
+//
+// local 为端口号、unix:<path>，或 reverse:<host:port> 表示作为反向隧道的代理端从该服务端接收连接；remote host 为逗号分隔的后端列表，每项为主机名、IP、
+// host:port 或 unix:<path>，未写端口的主机使用 remote port，不需要时 remote port 填 "-"。
+// remote host 也可以是 srv:<name> 或 file:<path>，从 DNS SRV 记录或文件动态获取后端；
+// 为 socks5 或 http-connect 时规则作为代理运行，由客户端指定目标；为 reverse-server 时接收
+// 反向隧道代理端的连接，为 agent:<service> 时通过反向隧道转发到代理端暴露的服务；
+// 为 link-server 时接收其他转发器的多路复用链路。
+func ParseRule(line string) (Rule, error) {
+	setting := strings.Split(line, "|")
+	if len(setting) != 3 && len(setting) != 4 {
+		return Rule{}, errors.New("expect 3 or 4 fields")
+	}
+	for i := range setting {
+		setting[i] = strings.TrimSpace(setting[i])
+	}
+
+	rule := Rule{
+		UnlinkStale: true,
+		Retry:       RetryPolicy{Backoff: 100 * time.Millisecond, Failover: true},
+		Outlier: OutlierPolicy{
+			ConsecutiveFailures: 5,
+			BaseEjection:        10 * time.Second,
+			MaxEjection:         5 * time.Minute,
+		},
+		DNSTTL:    30 * time.Second,
+		Discovery: Discovery{Interval: 5 * time.Second},
+	}
+	if server, ok := strings.CutPrefix(setting[0], reversePrefix); ok {
+		if _, port, err := net.SplitHostPort(server); err != nil || port == "" {
+			return rule, fmt.Errorf("invalid reverse tunnel server %q", server)
+		}
+		rule.ReverseServer = server
+	} else if path, ok := strings.CutPrefix(setting[0], unixPrefix); ok {
+		if path == "" {
+			return rule, errors.New("empty local unix socket path")
+		}
+		rule.LocalUnix = path
+	} else {
+		rule.LocalPort, _ = strconv.Atoi(setting[0])
+		if rule.LocalPort <= 0 || rule.LocalPort > 65535 {
+			return rule, fmt.Errorf("invalid local port %q", setting[0])
+		}
+	}
+
+	defaultPort := setting[2]
+	if defaultPort == "-" {
+		defaultPort = ""
+	}
+	if slices.Contains([]string{ModeSOCKS5, ModeHTTPConnect, ModeReverseServer, ModeLinkServer}, setting[1]) {
+		rule.Mode = setting[1]
+		if defaultPort != "" {
+			return rule, errors.New("remote port must be '-' for proxy rules")
+		}
+	} else if service, ok := strings.CutPrefix(setting[1], agentPrefix); ok {
+		if service == "" {
+			return rule, errors.New("empty reverse tunnel service")
+		}
+		if defaultPort != "" {
+			return rule, errors.New("remote port must be '-' for reverse tunnel rules")
+		}
+		rule.Mode, rule.Service = ModeReverse, service
+	} else if name, ok := strings.CutPrefix(setting[1], srvPrefix); ok {
+		rule.Discovery.Kind, rule.Discovery.Name = "srv", name
+	} else if path, ok := strings.CutPrefix(setting[1], filePrefix); ok {
+		rule.Discovery.Kind, rule.Discovery.Name = "file", path
+	} else {
+		for _, item := range strings.Split(setting[1], ",") {
+			backend, err := parseBackend(strings.TrimSpace(item), defaultPort)
+			if err != nil {
+				return rule, err
+			}
+			rule.Backends = append(rule.Backends, backend)
+		}
+	}
+	if rule.Discovery.Kind != "" {
+		if rule.Discovery.Name == "" {
+			return rule, errors.New("empty discovery source")
+		}
+		if defaultPort != "" {
+			return rule, errors.New("remote port must be '-' for discovered backends")
+		}
+	}
+
+	if len(setting) == 4 {
+		opts, err := parseOptions(setting[3])
+		if err != nil {
+			return rule, err
+		}
+		if err := rule.applyOptions(opts); err != nil {
+			return rule, err
+		}
+	}
+	if rule.ReverseServer != "" && rule.Mode != ModeForward {
+		return rule, errors.New("agent rules must forward to backends")
+	}
+	if (rule.ReverseServer != "" || rule.Mode == ModeReverseServer || rule.Mode == ModeLinkServer || rule.Via != "") && rule.TokenFile == "" {
+		return rule, errors.New("reverse tunnel rules require a token-file option")
+	}
+	if (rule.WebSocket != "" || rule.WebSocketAccept != "") && rule.TokenFile == "" {
+		return rule, errors.New("websocket rules require a token-file option")
+	}
+	if rule.ReverseServer != "" && rule.Service == "" {
+		return rule, errors.New("agent rules require a service option")
+	}
+	if rule.Via != "" {
+		if rule.Mode != ModeForward {
+			return rule, errors.New("via option requires a forwarding rule")
+		}
+		backends := slices.Clone(rule.Backends)
+		if rule.Backup != nil {
+			backends = append(backends, *rule.Backup)
+		}
+		for _, b := range backends {
+			if b.Network != "tcp" {
+				return rule, errors.New("unix backends cannot be reached through a link")
+			}
+		}
+	}
+	if rule.WebSocketProxy != "" {
+		if slices.ContainsFunc(rule.Backends, func(b Backend) bool { return b.Network != "tcp" }) ||
+			(rule.Backup != nil && rule.Backup.Network != "tcp") {
+			return rule, errors.New("unix backends cannot be reached through a websocket proxy")
+		}
+	}
+	return rule, nil
+}
+
+// parseOptions 解析以空白分隔的 key=value 选项
+func parseOptions(s string) (map[string]string, error) {
+	opts := make(map[string]string)
+	for _, field := range strings.Fields(s) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid option %q", field)
+		}
+		if _, exists := opts[key]; exists {
+			return nil, fmt.Errorf("duplicate option %q", key)
+		}
+		opts[key] = value
+	}
+	return opts, nil
+}
+
+// parsePositive 解析正整数选项值
+func parsePositive(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err == nil && n <= 0 {
+		err = errors.New("non-positive value")
+	}
+	return n, err
+}
+
+// parsePositiveDuration 解析正的时长选项值
+func parsePositiveDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err == nil && d <= 0 {
+		err = errors.New("non-positive duration")
+	}
+	return d, err
+}
+
+// applyOptions 将选项应用到规则上，未知选项视为错误
+func (r *Rule) applyOptions(opts map[string]string) error {
+	for key, value := range opts {
+		var err error
+		switch key {
+		case "name":
+			r.Name = value
+		case "mode":
+			var mode uint64
+			mode, err = strconv.ParseUint(value, 8, 32)
+			r.SocketMode = os.FileMode(mode) & os.ModePerm
+		case "unlink-stale":
+			r.UnlinkStale, err = strconv.ParseBool(value)
+		case "backup":
+			var backup Backend
+			if backup, err = parseBackend(value, ""); err == nil {
+				r.Backup = &backup
+			}
+		case "retries":
+			r.Retry.Retries, err = strconv.Atoi(value)
+			if err == nil && r.Retry.Retries < 0 {
+				err = errors.New("negative retries")
+			}
+		case "retry-backoff":
+			r.Retry.Backoff, err = time.ParseDuration(value)
+		case "failover":
+			r.Retry.Failover, err = strconv.ParseBool(value)
+		case "dial-budget":
+			r.Retry.DialBudget, err = time.ParseDuration(value)
+		case "outlier-failures":
+			r.Outlier.ConsecutiveFailures, err = strconv.Atoi(value)
+		case "outlier-ejection":
+			r.Outlier.BaseEjection, err = time.ParseDuration(value)
+		case "outlier-max-ejection":
+			r.Outlier.MaxEjection, err = time.ParseDuration(value)
+		case "outlier-reset-window":
+			r.Outlier.ResetWindow, err = time.ParseDuration(value)
+		case "max-dials":
+			r.Outlier.MaxDials, err = strconv.Atoi(value)
+		case "max-pending":
+			r.Outlier.MaxPending, err = strconv.Atoi(value)
+		case "dns":
+			r.DNSServer = value
+		case "dns-ttl":
+			r.DNSTTL, err = time.ParseDuration(value)
+		case "filters":
+			r.Filters = strings.Split(value, ",")
+			if slices.Contains(r.Filters, "") {
+				err = errors.New("empty filter name")
+			}
+		case "auth":
+			r.AuthFile = value
+		case "allow":
+			r.Allow = strings.Split(value, ",")
+			_, err = parseAllowlist(r.Allow)
+		case "service":
+			r.Service = value
+			if r.ReverseServer == "" {
+				err = errors.New("service requires an agent rule")
+			}
+		case "token-file":
+			r.TokenFile = value
+		case "via":
+			r.Via = value
+			if _, port, splitErr := net.SplitHostPort(value); splitErr != nil || port == "" {
+				err = errors.New("invalid link address")
+			}
+		case "link-conns":
+			r.LinkConns, err = strconv.Atoi(value)
+			if err == nil && r.LinkConns <= 0 {
+				err = errors.New("non-positive link connections")
+			}
+		case "encrypt":
+			r.Encrypt = value
+		case "decrypt":
+			r.Decrypt = value
+		case "compress":
+			r.Compress = value
+			if value != compressDeflate {
+				err = errors.New("unsupported compression")
+			}
+		case "decompress":
+			r.Decompress = value
+			if value != compressDeflate {
+				err = errors.New("unsupported compression")
+			}
+		case "websocket":
+			r.WebSocket = value
+			if !strings.HasPrefix(value, "/") {
+				err = errors.New("path must start with /")
+			}
+		case "websocket-accept":
+			r.WebSocketAccept = value
+			if !strings.HasPrefix(value, "/") {
+				err = errors.New("path must start with /")
+			}
+		case "websocket-tls":
+			r.WebSocketTLS, err = strconv.ParseBool(value)
+		case "websocket-ca":
+			r.WebSocketCA = value
+		case "websocket-proxy":
+			r.WebSocketProxy = value
+			_, err = parseProxyURL(value)
+		case "websocket-cert":
+			r.WebSocketCert = value
+		case "websocket-key":
+			r.WebSocketKey = value
+		case "bind":
+			r.Bind = strings.Split(value, ",")
+			if slices.Contains(r.Bind, "") {
+				err = errors.New("empty bind address")
+			}
+		case "ipv6only":
+			r.IPv6Only, err = strconv.ParseBool(value)
+		case "source":
+			r.Source = strings.Split(value, ",")
+			for _, s := range r.Source {
+				if _, perr := netip.ParseAddr(s); perr != nil || strings.Contains(s, "%") {
+					err = errors.New("invalid source address")
+				}
+			}
+		case "interface":
+			r.Interface = value
+			if value == "" {
+				err = errors.New("empty interface")
+			}
+		case "fwmark":
+			var mark uint64
+			mark, err = strconv.ParseUint(value, 0, 32)
+			r.FWMark = uint32(mark)
+			if err == nil && mark == 0 {
+				err = errors.New("zero fwmark")
+			}
+		case "nodelay":
+			var nodelay bool
+			nodelay, err = strconv.ParseBool(value)
+			r.Socket.Nagle = !nodelay
+		case "keepalive":
+			var keepalive bool
+			keepalive, err = strconv.ParseBool(value)
+			r.Socket.NoKeepAlive = !keepalive
+		case "keepalive-idle":
+			r.Socket.KeepAliveIdle, err = parsePositiveDuration(value)
+		case "keepalive-interval":
+			r.Socket.KeepAliveInterval, err = parsePositiveDuration(value)
+		case "keepalive-count":
+			r.Socket.KeepAliveCount, err = parsePositive(value)
+		case "rcvbuf":
+			r.Socket.RecvBuffer, err = parsePositive(value)
+		case "sndbuf":
+			r.Socket.SendBuffer, err = parsePositive(value)
+		case "user-timeout":
+			r.Socket.UserTimeout, err = parsePositiveDuration(value)
+		case "notsent-lowat":
+			r.Socket.NotSentLowat, err = parsePositive(value)
+		case "tos":
+			var tos uint64
+			tos, err = strconv.ParseUint(value, 0, 8)
+			r.Socket.TOS = int(tos)
+		case "dscp":
+			var dscp uint64
+			dscp, err = strconv.ParseUint(value, 0, 6)
+			r.Socket.TOS = int(dscp) << 2
+		case "fastopen":
+			r.Socket.FastOpen, err = strconv.ParseBool(value)
+		case "backlog":
+			r.Socket.Backlog, err = parsePositive(value)
+		case "reuseport":
+			r.Socket.ReusePort, err = parsePositive(value)
+		case "reuseport-cpu":
+			r.Socket.ReusePortCPU, err = strconv.ParseBool(value)
+		case "discovery-interval":
+			r.Discovery.Interval, err = time.ParseDuration(value)
+			if err == nil && r.Discovery.Interval <= 0 {
+				err = errors.New("non-positive interval")
+			}
+		default:
+			return fmt.Errorf("unknown option %q", key)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value %q for option %q", value, key)
+		}
+	}
+	if r.AuthFile != "" && r.Mode != ModeSOCKS5 && r.Mode != ModeHTTPConnect {
+		return errors.New("auth option requires a proxy rule")
+	}
+	if len(r.Allow) > 0 && r.Mode != ModeSOCKS5 && r.Mode != ModeHTTPConnect && r.Mode != ModeLinkServer {
+		return errors.New("allow option requires a proxy or link-server rule")
+	}
+	if r.TokenFile != "" && r.ReverseServer == "" && r.Mode != ModeReverseServer && r.Mode != ModeLinkServer && r.Via == "" &&
+		r.WebSocket == "" && r.WebSocketAccept == "" {
+		return errors.New("token-file option requires a reverse tunnel, link or websocket rule")
+	}
+	if r.LinkConns != 0 && r.Via == "" {
+		return errors.New("link-conns option requires the via option")
+	}
+	if (r.Encrypt != "" || r.Decrypt != "") && r.Mode != ModeForward {
+		return errors.New("encrypt and decrypt options require a forwarding rule")
+	}
+	if (r.Compress != "" || r.Decompress != "") && r.Mode != ModeForward {
+		return errors.New("compress and decompress options require a forwarding rule")
+	}
+	if (r.WebSocket != "" || r.WebSocketAccept != "") && r.Mode != ModeForward {
+		return errors.New("websocket options require a forwarding rule")
+	}
+	if (r.WebSocketTLS || r.WebSocketCA != "" || r.WebSocketProxy != "") && r.WebSocket == "" {
+		return errors.New("websocket-tls, websocket-ca and websocket-proxy options require the websocket option")
+	}
+	if r.WebSocketCA != "" && !r.WebSocketTLS {
+		return errors.New("websocket-ca option requires websocket-tls=true")
+	}
+	if (r.WebSocketCert != "" || r.WebSocketKey != "") && (r.WebSocketAccept == "" || r.WebSocketCert == "" || r.WebSocketKey == "") {
+		return errors.New("websocket-cert and websocket-key options must be set together on a websocket-accept rule")
+	}
+	if r.WebSocketProxy != "" && r.Via != "" {
+		return errors.New("websocket-proxy and via options are mutually exclusive")
+	}
+	if (r.SocketMode != 0 || !r.UnlinkStale) && r.LocalUnix == "" {
+		return errors.New("socket file options require a unix socket listener")
+	}
+	if (len(r.Bind) > 0 || r.IPv6Only || r.Socket.ReusePort > 0) && (r.LocalUnix != "" || r.ReverseServer != "") {
+		return errors.New("bind and reuseport options require a tcp listener")
+	}
+	if r.Socket.ReusePortCPU && r.Socket.ReusePort == 0 {
+		return errors.New("reuseport-cpu option requires the reuseport option")
+	}
+	_, tos := opts["tos"]
+	if _, dscp := opts["dscp"]; tos && dscp {
+		return errors.New("tos and dscp options are mutually exclusive")
+	}
+	if r.Socket.NoKeepAlive && (r.Socket.KeepAliveIdle != 0 || r.Socket.KeepAliveInterval != 0 || r.Socket.KeepAliveCount != 0) {
+		return errors.New("keepalive tuning options require keepalive")
+	}
+	if r.Socket.kernel() && !sockoptSupported {
+		return errors.New("rcvbuf, sndbuf, user-timeout, notsent-lowat, tos, dscp, fastopen, backlog and reuseport options are only supported on Linux")
+	}
+	if len(r.Source) > 0 || r.Interface != "" || r.FWMark != 0 {
+		if r.Mode == ModeReverse || r.Mode == ModeReverseServer || r.Via != "" {
+			return errors.New("outbound options require a rule that dials backends or proxy targets")
+		}
+		if (r.Interface != "" || r.FWMark != 0) && !sockoptSupported {
+			return errors.New("interface and fwmark options are only supported on Linux")
+		}
+	}
+	return nil
+}
+
+// listen 根据规则创建监听器，Unix 套接字会按配置清理残留文件并设置权限
+func (r Rule) listen() (net.Listener, error) {
+	network, address := r.listenAddr()
+	if strings.HasPrefix(network, "tcp") {
+		return r.listenTCP()
+	}
+	abstract := strings.HasPrefix(address, "@")
+	if network == "unix" && !abstract && r.UnlinkStale {
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" && !abstract && r.SocketMode != 0 {
+		if err := os.Chmod(address, r.SocketMode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// listenTCP 在规则的每个绑定地址上监听，多个地址的连接合并到一个监听器
+func (r Rule) listenTCP() (net.Listener, error) {
+	addrs, err := r.bindAddrs()
+	if err != nil {
+		return nil, err
+	}
+	shards := max(r.Socket.ReusePort, 1)
+	listeners := make([]net.Listener, 0, len(addrs)*shards)
+	for _, addr := range addrs {
+		network := "tcp"
+		if r.IPv6Only && addr.Addr().Is6() {
+			network = "tcp6"
+		}
+		for range shards {
+			ln, err := r.Socket.listen(network, addr.String())
+			if err != nil {
+				for _, ln := range listeners {
+					ln.Close()
+				}
+				return nil, err
+			}
+			listeners = append(listeners, ln)
+			// 同组的其余套接字绑定第一个套接字分配到的端口
+			addr = netip.AddrPortFrom(addr.Addr(), uint16(ln.Addr().(*net.TCPAddr).Port))
+		}
+	}
+	if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+	return newMultiListener(listeners), nil
+}
+
+// multiListener 把多个监听器作为一个监听器管理。转发器为每个监听器运行独立的接收循环，
+// 直接调用 Accept 时把各监听器接收的连接合并
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	done      chan struct{}
+	runOnce   sync.Once
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	m := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		done:      make(chan struct{}),
+	}
+	return m
+}
+
+func (m *multiListener) run(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil && errors.Is(err, net.ErrClosed) {
+			return
+		}
+		select {
+		case m.accepted <- acceptResult{conn, err}:
+		case <-m.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	m.runOnce.Do(func() {
+		for _, ln := range m.listeners {
+			go m.run(ln)
+		}
+	})
+	select {
+	case r := <-m.accepted:
+		return r.conn, r.err
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	var errs []error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		for _, ln := range m.listeners {
+			errs = append(errs, ln.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// Addr 返回所有监听地址，String 以逗号分隔
+func (m *multiListener) Addr() net.Addr {
+	addrs := make(multiAddr, len(m.listeners))
+	for i, ln := range m.listeners {
+		addrs[i] = ln.Addr()
+	}
+	return addrs
+}
+
+type multiAddr []net.Addr
+
+func (a multiAddr) Network() string {
+	return a[0].Network()
+}
+
+func (a multiAddr) String() string {
+	s := make([]string, 0, len(a))
+	for _, addr := range a {
+		// SO_REUSEPORT 的同组套接字地址相同，只列出一次
+		if !slices.Contains(s, addr.String()) {
+			s = append(s, addr.String())
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+// bindAddrs 返回规则监听的地址，网卡名称解析为网卡当前的所有地址
+func (r Rule) bindAddrs() ([]netip.AddrPort, error) {
+	port := uint16(r.LocalPort)
+	if len(r.Bind) == 0 {
+		return []netip.AddrPort{netip.AddrPortFrom(netip.IPv6Unspecified(), port)}, nil
+	}
+	var addrs []netip.AddrPort
+	for _, b := range r.Bind {
+		if ip, err := netip.ParseAddr(b); err == nil {
+			addrs = append(addrs, netip.AddrPortFrom(ip, port))
+			continue
+		}
+		iface, err := net.InterfaceByName(b)
+		if err != nil {
+			return nil, err
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		n := len(addrs)
+		for _, a := range ifaceAddrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, _ := netip.AddrFromSlice(ipnet.IP)
+			ip = ip.Unmap()
+			if ip.Is6() && ip.IsLinkLocalUnicast() {
+				ip = ip.WithZone(iface.Name)
+			}
+			addrs = append(addrs, netip.AddrPortFrom(ip, port))
+		}
+		if len(addrs) == n {
+			return nil, fmt.Errorf("interface %s has no addresses", b)
+		}
+	}
+	return addrs, nil
+}
+
+// removeStaleSocket 删除已无进程监听的套接字文件，拒绝删除非套接字文件
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is still in use", path)
+	}
+	return os.Remove(path)
+}
+
+// addrString 返回地址的字符串形式，兼容未命名的 Unix 套接字对端
+func addrString(addr net.Addr) string {
+	if addr == nil || addr.String() == "" {
+		return "@"
+	}
+	return addr.String()
+}
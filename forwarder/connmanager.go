@@ -0,0 +1,198 @@
+package forwarder
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connState 单个连接的状态
+type connState struct {
+	rule       string
+	client     bool
+	halfClosed bool
+	lastActive atomic.Int64
+	inner      net.Conn // 隧道实际读写的最内层客户端连接，半关闭经它进行以便发出加密或 WebSocket 的结束标记
+}
+
+func (s *connState) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// ConnectionManager 管理连接的生命周期
+type ConnectionManager struct {
+	mu         sync.RWMutex
+	conns      map[net.Conn]*connState
+	ctx        context.Context
+	cancel     context.CancelFunc
+	acceptCtx  context.Context
+	stopAccept context.CancelFunc
+	wg         sync.WaitGroup
+	maxConns   int
+}
+
+// NewConnectionManager 创建新的连接管理器
+func NewConnectionManager(maxConns int) *ConnectionManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	acceptCtx, stopAccept := context.WithCancel(ctx)
+	return &ConnectionManager{
+		conns:      make(map[net.Conn]*connState),
+		ctx:        ctx,
+		cancel:     cancel,
+		acceptCtx:  acceptCtx,
+		stopAccept: stopAccept,
+		maxConns:   maxConns,
+	}
+}
+
+// AddConnection 添加连接
+func (cm *ConnectionManager) AddConnection(conn net.Conn) bool {
+	return cm.addConnection(conn, "", false)
+}
+
+// AddClientConnection 添加属于某条转发规则的客户端连接，每个客户端连接对应一条隧道
+func (cm *ConnectionManager) AddClientConnection(conn net.Conn, rule string) bool {
+	return cm.addConnection(conn, rule, true)
+}
+
+func (cm *ConnectionManager) addConnection(conn net.Conn, rule string, client bool) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if len(cm.conns) >= cm.maxConns {
+		return false
+	}
+
+	state := &connState{rule: rule, client: client}
+	state.touch()
+	cm.conns[conn] = state
+	cm.wg.Add(1)
+	return true
+}
+
+// RemoveConnection 移除连接
+func (cm *ConnectionManager) RemoveConnection(conn net.Conn) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if _, exists := cm.conns[conn]; exists {
+		delete(cm.conns, conn)
+		conn.Close()
+		cm.wg.Done()
+	}
+}
+
+// Track 返回一个在读写时刷新活跃时间的连接包装，用于排空时判断隧道是否空闲
+func (cm *ConnectionManager) Track(conn net.Conn) net.Conn {
+	cm.mu.RLock()
+	state, exists := cm.conns[conn]
+	cm.mu.RUnlock()
+	if !exists {
+		return conn
+	}
+	return &trackedConn{Conn: conn, state: state}
+}
+
+// setInner 记录客户端连接经 WebSocket、加密或压缩包装后的最内层连接
+func (cm *ConnectionManager) setInner(conn, inner net.Conn) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if state, exists := cm.conns[conn]; exists {
+		state.inner = inner
+	}
+}
+
+// StopAccepting 停止接收新连接，已建立的隧道不受影响
+func (cm *ConnectionManager) StopAccepting() {
+	cm.stopAccept()
+}
+
+// Remaining 按规则统计仍在进行中的隧道数
+func (cm *ConnectionManager) Remaining() map[string]int {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	remaining := make(map[string]int)
+	for _, state := range cm.conns {
+		if state.client {
+			remaining[state.rule]++
+		}
+	}
+	return remaining
+}
+
+// HalfCloseIdle 关闭空闲超过 idle 的隧道的客户端写方向，促使客户端主动断开，返回本次处理的隧道数
+func (cm *ConnectionManager) HalfCloseIdle(idle time.Duration) int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	deadline := time.Now().Add(-idle).UnixNano()
+	n := 0
+	for conn, state := range cm.conns {
+		if !state.client || state.halfClosed || state.lastActive.Load() > deadline {
+			continue
+		}
+		target := conn
+		if state.inner != nil {
+			target = state.inner
+		}
+		if cw, ok := target.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+			state.halfClosed = true
+			n++
+		}
+	}
+	return n
+}
+
+// CloseAll 关闭所有连接
+func (cm *ConnectionManager) CloseAll() {
+	cm.cancel()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	for conn := range cm.conns {
+		conn.Close()
+		cm.wg.Done()
+	}
+	cm.conns = make(map[net.Conn]*connState)
+}
+
+// Wait 等待所有连接关闭
+func (cm *ConnectionManager) Wait() {
+	cm.wg.Wait()
+}
+
+// trackedConn 读写时刷新所属连接的活跃时间
+type trackedConn struct {
+	net.Conn
+	state *connState
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.state.touch()
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.state.touch()
+	}
+	return n, err
+}
+
+// NetConn 返回被包装的连接
+func (c *trackedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite 关闭底层连接的写方向
+func (c *trackedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
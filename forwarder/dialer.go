@@ -0,0 +1,369 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// backendPool 规则的后端池，负责选择后端并按重试策略建立连接。
+// 启用服务发现时后端列表会被动态替换，被移除的后端不再接收新连接，已建立的隧道不受影响。
+type backendPool struct {
+	rule     Rule
+	log      *logrus.Entry
+	backup   *backendState
+	resolver *Resolver
+	link     *linkClient // 非空时经链路在远端连接后端
+	out      *outbound
+	timeout  time.Duration
+	next     atomic.Uint64
+
+	mu       sync.RWMutex
+	backends []*backendState
+	previous map[string]*backendState // 重新加载前的后端状态，服务发现首次得到同一地址的后端时沿用
+}
+
+// newBackendPool 创建规则的后端池，timeout 为单次连接超时和默认的总拨号预算
+func newBackendPool(rule Rule, timeout time.Duration, log *logrus.Entry) *backendPool {
+	log = log.WithField(fieldRule, rule.RuleName())
+	p := &backendPool{
+		rule:     rule,
+		log:      log,
+		resolver: NewResolver(rule.DNSServer, rule.DNSTTL, log),
+		timeout:  timeout,
+	}
+	p.out = newOutbound(rule, timeout, p.log)
+	for _, backend := range rule.Backends {
+		p.backends = append(p.backends, newBackendState(backend, rule.Outlier, p.log))
+	}
+	if rule.Backup != nil {
+		p.backup = newBackendState(*rule.Backup, rule.Outlier, p.log)
+	}
+	return p
+}
+
+// inherit 沿用重新加载前同一规则的后端池中地址相同的后端的熔断、摘除和并发拨号状态，
+// 避免仅修改超时或过滤器等设置就让摘除中的后端以完整权重重新接收连接。摘除策略变化时不沿用
+func (p *backendPool) inherit(old *backendPool) {
+	if old.rule.Outlier != p.rule.Outlier {
+		return
+	}
+	previous := make(map[string]*backendState)
+	for _, b := range old.states() {
+		previous[b.backendInfo().key()] = b
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, b := range p.backends {
+		if prev, ok := previous[b.backend.key()]; ok {
+			prev.setBackend(b.backend)
+			p.backends[i] = prev
+		}
+	}
+	if p.backup != nil {
+		if prev, ok := previous[p.backup.backend.key()]; ok {
+			prev.setBackend(p.backup.backend)
+			p.backup = prev
+		}
+	}
+	p.previous = previous
+}
+
+// current 返回当前的后端列表
+func (p *backendPool) current() []*backendState {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.backends
+}
+
+// update 替换后端列表，保留仍然存在的后端的熔断状态
+func (p *backendPool) update(backends []Backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	existing := make(map[string]*backendState, len(p.backends))
+	for _, b := range p.backends {
+		existing[b.backend.key()] = b
+	}
+
+	updated := make([]*backendState, 0, len(backends))
+	for _, backend := range backends {
+		key := backend.key()
+		if b, ok := existing[key]; ok {
+			delete(existing, key)
+			b.setBackend(backend)
+			updated = append(updated, b)
+			continue
+		}
+		if b, ok := p.previous[key]; ok {
+			b.setBackend(backend)
+			updated = append(updated, b)
+			continue
+		}
+		updated = append(updated, newBackendState(backend, p.rule.Outlier, p.log))
+		p.log.WithField(fieldBackend, backend.String()).Info("Backend added.")
+	}
+	for _, b := range existing {
+		b.log.Info("Backend removed, existing tunnels keep running.")
+	}
+	p.backends = updated
+	p.previous = nil
+}
+
+// states 返回池中所有后端（含备用后端）的状态
+func (p *backendPool) states() []*backendState {
+	states := append([]*backendState(nil), p.current()...)
+	if p.backup != nil {
+		states = append(states, p.backup)
+	}
+	return states
+}
+
+// pick 选择一个未被摘除且未尝试过的后端：优先使用优先级数值最小的一组，
+// 组内权重相同时从 index 开始轮询，否则按权重随机选择
+func (p *backendPool) pick(index int, tried map[*backendState]bool) *backendState {
+	backends := p.current()
+	now := time.Now()
+
+	priorities := make([]uint16, 0, 1)
+	groups := make(map[uint16][]*backendState)
+	for _, b := range backends {
+		prio := b.backendInfo().Priority
+		if _, ok := groups[prio]; !ok {
+			priorities = append(priorities, prio)
+		}
+		groups[prio] = append(groups[prio], b)
+	}
+	slices.Sort(priorities)
+
+	// 先选择本次未尝试过的后端，都尝试过后再从头轮换
+	for _, retry := range []bool{false, true} {
+		for _, prio := range priorities {
+			for _, b := range orderGroup(groups[prio], index) {
+				if tried[b] == retry && b.allow(now) {
+					return b
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// orderGroup 返回同一优先级组内的尝试顺序
+func orderGroup(group []*backendState, index int) []*backendState {
+	if len(group) == 0 {
+		return nil
+	}
+	weighted := false
+	for _, b := range group[1:] {
+		if b.backendInfo().Weight != group[0].backendInfo().Weight {
+			weighted = true
+			break
+		}
+	}
+
+	ordered := make([]*backendState, 0, len(group))
+	if !weighted {
+		for i := range group {
+			ordered = append(ordered, group[(index+i)%len(group)])
+		}
+		return ordered
+	}
+
+	// 按 RFC 2782 的方式依权重随机排列，权重为 0 的后端只有很小的概率被优先选择
+	remaining := append([]*backendState(nil), group...)
+	for len(remaining) > 0 {
+		total := 0
+		for _, b := range remaining {
+			total += effectiveWeight(b.backendInfo().Weight)
+		}
+		n := rand.IntN(total)
+		for i, b := range remaining {
+			if n -= effectiveWeight(b.backendInfo().Weight); n < 0 {
+				ordered = append(ordered, b)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+	return ordered
+}
+
+func effectiveWeight(w uint16) int {
+	if w == 0 {
+		return 1
+	}
+	return int(w) * 100
+}
+
+// dial 按重试策略连接后端，跳过被摘除的后端，返回连接和实际使用的后端。
+// 重试只发生在转发任何数据之前，因此对客户端是透明的。
+func (p *backendPool) dial(ctx context.Context, log *logrus.Entry) (net.Conn, *backendState, error) {
+	policy := p.rule.Retry
+	budget := policy.DialBudget
+	if budget <= 0 {
+		budget = p.timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+
+	start := int(p.next.Add(1) - 1)
+	backoff := policy.Backoff
+	tried := make(map[*backendState]bool)
+	var last *backendState
+
+	var lastErr error
+	for attempt := 0; attempt <= policy.Retries; attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(ctx, backoff); err != nil {
+				break
+			}
+			backoff *= 2
+		}
+
+		// 故障转移时跳过本次已尝试过的后端，否则重试同一个后端
+		var b *backendState
+		if policy.Failover || last == nil {
+			b = p.pick(start+attempt, tried)
+		} else if last.allow(time.Now()) {
+			b = last
+		}
+		if b == nil {
+			lastErr = errNoHealthyBackend
+			continue
+		}
+		tried[b], last = true, b
+		conn, err := p.dialBackend(ctx, b)
+		if err == nil {
+			return conn, b, nil
+		}
+		lastErr = err
+		log.WithError(err).WithField(fieldBackend, b.backendInfo().String()).Warnf("Dial attempt %d failed.", attempt+1)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if p.backup != nil && ctx.Err() == nil && p.backup.allow(time.Now()) {
+		conn, err := p.dialBackend(ctx, p.backup)
+		if err == nil {
+			log.WithField(fieldBackend, p.backup.backendInfo().String()).Warn("Failed over to backup backend.")
+			return conn, p.backup, nil
+		}
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		lastErr = ctx.Err()
+	}
+	return nil, nil, lastErr
+}
+
+// dialBackend 在拨号名额内连接单个后端，并记录拨号失败
+func (p *backendPool) dialBackend(ctx context.Context, b *backendState) (net.Conn, error) {
+	release, err := b.acquireDial(ctx)
+	if err != nil {
+		b.cancelTrial()
+		return nil, err
+	}
+	defer release()
+
+	conn, err := p.dialAddr(ctx, b.backendInfo())
+	if err == nil && (p.rule.WebSocket != "" || p.rule.Encrypt != "") {
+		conn, err = p.handshake(ctx, conn, b.backendInfo())
+	}
+	if err != nil {
+		// 因预算耗尽或关闭而中断的拨号不计入后端失败
+		if ctx.Err() == nil {
+			b.failure("dial")
+		} else {
+			b.cancelTrial()
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialAddr 在单次连接超时和总预算内连接后端，域名经解析器解析后按 Happy Eyeballs 连接；
+// 经链路转发时由链路的远端解析和连接，经 WebSocket 代理时连接代理，由代理解析和连接
+func (p *backendPool) dialAddr(ctx context.Context, backend Backend) (net.Conn, error) {
+	if p.link != nil {
+		ctx, cancel := context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+		return p.link.dial(ctx, backend.Address)
+	}
+	dialer := p.out
+	if p.rule.WebSocketProxy != "" {
+		proxy, err := parseProxyURL(p.rule.WebSocketProxy)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.DialContext(ctx, "tcp", proxy.Host)
+	}
+	if backend.Network != "tcp" {
+		return dialer.DialContext(ctx, backend.Network, backend.Address)
+	}
+
+	host, port, err := net.SplitHostPort(backend.Address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, backend.Network, backend.Address)
+	}
+	addrs, err := p.resolver.Lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return dialHappyEyeballs(ctx, dialer, addrs, port)
+}
+
+// handshake 在单次连接超时内完成到后端转发器的 WebSocket 升级和加密握手，失败时关闭连接
+func (p *backendPool) handshake(ctx context.Context, conn net.Conn, backend Backend) (net.Conn, error) {
+	deadline := time.Now().Add(p.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	if p.rule.WebSocket != "" {
+		ws, err := wsClient(ctx, conn, backend.Address, p.rule)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("websocket: %w", err)
+		}
+		conn = ws
+	}
+	if p.rule.Encrypt != "" {
+		sc, err := secureClient(conn, p.rule.Encrypt)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("secure handshake: %w", err)
+		}
+		conn = sc
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// sleepContext 等待指定时间，上下文结束时提前返回错误
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,106 @@
+package forwarder
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// closedAddr 返回一个没有监听者的本地地址
+func closedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// TestBackendPoolFailover 测试连接失败时切换到下一个后端和备用后端
+func TestBackendPoolFailover(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	live := Backend{Network: "tcp", Address: ln.Addr().String()}
+	dead := Backend{Network: "tcp", Address: closedAddr(t)}
+	log := logrus.NewEntry(logrus.StandardLogger())
+
+	pool := newBackendPool(Rule{
+		Backends: []Backend{dead, live},
+		Retry:    RetryPolicy{Retries: 1, Backoff: time.Millisecond, Failover: true},
+	}, time.Second, log)
+	conn, backend, err := pool.dial(context.Background(), log)
+	if err != nil {
+		t.Fatalf("Expected failover to succeed: %v", err)
+	}
+	conn.Close()
+	if backend.backendInfo() != live {
+		t.Errorf("Expected live backend, got %v", backend)
+	}
+
+	pool = newBackendPool(Rule{
+		Backends: []Backend{dead},
+		Backup:   &live,
+		Retry:    RetryPolicy{Retries: 2, Backoff: time.Millisecond},
+	}, time.Second, log)
+	conn, backend, err = pool.dial(context.Background(), log)
+	if err != nil {
+		t.Fatalf("Expected backup to succeed: %v", err)
+	}
+	conn.Close()
+	if backend.backendInfo() != live {
+		t.Errorf("Expected backup backend, got %v", backend)
+	}
+}
+
+// TestBackendPoolDialBudget 测试总预算耗尽后停止重试
+func TestBackendPoolDialBudget(t *testing.T) {
+	pool := newBackendPool(Rule{
+		Backends: []Backend{{Network: "tcp", Address: closedAddr(t)}},
+		Retry:    RetryPolicy{Retries: 100, Backoff: 50 * time.Millisecond, DialBudget: 200 * time.Millisecond},
+	}, time.Second, logrus.NewEntry(logrus.StandardLogger()))
+
+	start := time.Now()
+	if _, _, err := pool.dial(context.Background(), logrus.NewEntry(logrus.StandardLogger())); err == nil {
+		t.Fatal("Expected dial to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Dial budget not respected, took %v", elapsed)
+	}
+}
+
+// TestBackendPoolSkipsEjected 测试被摘除的后端不再接收新连接
+func TestBackendPoolSkipsEjected(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	live := Backend{Network: "tcp", Address: ln.Addr().String()}
+	dead := Backend{Network: "tcp", Address: closedAddr(t)}
+
+	pool := newBackendPool(Rule{
+		Backends: []Backend{dead, live},
+		Outlier:  OutlierPolicy{ConsecutiveFailures: 1, BaseEjection: time.Minute, MaxEjection: time.Minute},
+	}, time.Second, logrus.NewEntry(logrus.StandardLogger()))
+	log := logrus.NewEntry(logrus.StandardLogger())
+
+	// 第一次落在故障后端上并将其摘除，之后都应选择健康后端
+	pool.dial(context.Background(), log)
+	for i := 0; i < 4; i++ {
+		conn, backend, err := pool.dial(context.Background(), log)
+		if err != nil {
+			t.Fatalf("Dial %d failed: %v", i, err)
+		}
+		conn.Close()
+		if backend.backendInfo() != live {
+			t.Errorf("Dial %d used ejected backend", i)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 服务发现来源前缀
+const (
+	srvPrefix  = "srv:"
+	filePrefix = "file:"
+)
+
+// Discovery 动态后端来源
+type Discovery struct {
+	Kind     string        // srv 或 file
+	Name     string        // SRV 记录名或文件路径
+	Interval time.Duration // 文件检查间隔；SRV 记录在未指定 DNS 服务器时的刷新间隔
+}
+
+// String 返回来源的可读描述
+func (d Discovery) String() string {
+	return d.Kind + ":" + d.Name
+}
+
+// discoverer 获取当前后端列表，返回下次刷新前的等待时间
+type discoverer interface {
+	discover(ctx context.Context) ([]Backend, time.Duration, error)
+}
+
+// newDiscoverer 根据规则的服务发现配置创建 discoverer
+func newDiscoverer(rule Rule) discoverer {
+	if rule.Discovery.Kind == "srv" {
+		return &srvDiscoverer{name: rule.Discovery.Name, server: normalizeDNSServer(rule.DNSServer), interval: rule.Discovery.Interval}
+	}
+	return &fileDiscoverer{path: rule.Discovery.Name, interval: rule.Discovery.Interval}
+}
+
+// watchDiscovery 持续刷新后端池，直到上下文结束
+func watchDiscovery(ctx context.Context, pool *backendPool, d discoverer, wait time.Duration) {
+	for {
+		if err := sleepContext(ctx, wait); err != nil {
+			return
+		}
+		wait = refreshPool(ctx, pool, d)
+	}
+}
+
+// refreshPool 执行一次服务发现并更新后端池，失败时保留原有后端
+func refreshPool(ctx context.Context, pool *backendPool, d discoverer) time.Duration {
+	backends, wait, err := d.discover(ctx)
+	if err != nil {
+		pool.log.WithError(err).Warnf("Failed to discover backends from %s.", pool.rule.Discovery)
+		return pool.rule.Discovery.Interval
+	}
+	if backends != nil {
+		pool.update(backends)
+	}
+	return wait
+}
+
+// srvDiscoverer 从 DNS SRV 记录获取后端
+type srvDiscoverer struct {
+	name     string
+	server   string
+	interval time.Duration
+}
+
+func (d *srvDiscoverer) discover(ctx context.Context) ([]Backend, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if d.server == "" {
+		_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", d.name)
+		if err != nil {
+			return nil, 0, err
+		}
+		backends := make([]Backend, len(srvs))
+		for i, srv := range srvs {
+			backends[i] = srvBackend(srv.Target, srv.Port, srv.Priority, srv.Weight)
+		}
+		return backends, d.interval, nil
+	}
+
+	records, err := dnsQuery(ctx, d.server, d.name, dnsTypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	var backends []Backend
+	ttl := d.interval
+	for _, rec := range records {
+		if rec.Type != dnsTypeSRV || rec.Target == "" {
+			continue
+		}
+		backends = append(backends, srvBackend(rec.Target, rec.Port, rec.Priority, rec.Weight))
+		ttl = min(ttl, max(rec.TTL, minDNSTTL))
+	}
+	if len(backends) == 0 {
+		return nil, 0, errDNSNotFound
+	}
+	return backends, ttl, nil
+}
+
+func srvBackend(target string, port, priority, weight uint16) Backend {
+	return Backend{
+		Network:  "tcp",
+		Address:  net.JoinHostPort(strings.TrimSuffix(target, "."), strconv.Itoa(int(port))),
+		Priority: priority,
+		Weight:   weight,
+	}
+}
+
+// fileDiscoverer 从本地文件获取后端，文件每行一个 host:port [weight]，修改后重新读取
+type fileDiscoverer struct {
+	path     string
+	interval time.Duration
+
+	modTime time.Time
+	size    int64
+}
+
+func (d *fileDiscoverer) discover(ctx context.Context) ([]Backend, time.Duration, error) {
+	fi, err := os.Stat(d.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if fi.ModTime().Equal(d.modTime) && fi.Size() == d.size {
+		return nil, d.interval, nil
+	}
+
+	backends, err := readBackendFile(d.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	d.modTime, d.size = fi.ModTime(), fi.Size()
+	return backends, d.interval, nil
+}
+
+// readBackendFile 解析后端列表文件，空行和以 # 开头的行被忽略
+func readBackendFile(path string) ([]Backend, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	backends := []Backend{}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%s:%d: expect host:port [weight]", path, lineNo)
+		}
+		backend, err := parseBackend(fields[0], "")
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		if len(fields) == 2 {
+			weight, err := strconv.ParseUint(fields[1], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid weight %q", path, lineNo, fields[1])
+			}
+			backend.Weight = uint16(weight)
+		}
+		backends = append(backends, backend)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(backends) == 0 {
+		return nil, errors.New("no backends listed in " + path)
+	}
+	return backends, nil
+}
@@ -0,0 +1,99 @@
+package forwarder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestSRVDiscovery 测试从 SRV 记录获取带优先级和权重的后端
+func TestSRVDiscovery(t *testing.T) {
+	dns := newStubDNSServer(t)
+	dns.set("_web._tcp.test",
+		dnsRecord{Type: dnsTypeSRV, TTL: 2 * time.Second, Priority: 10, Weight: 5, Port: 8080, Target: "a.test"},
+		dnsRecord{Type: dnsTypeSRV, TTL: 2 * time.Second, Priority: 20, Weight: 0, Port: 8081, Target: "b.test"},
+	)
+
+	d := &srvDiscoverer{name: "_web._tcp.test", server: dns.addr(), interval: time.Minute}
+	backends, wait, err := d.discover(context.Background())
+	if err != nil {
+		t.Fatalf("SRV discovery failed: %v", err)
+	}
+	if len(backends) != 2 || backends[0] != (Backend{Network: "tcp", Address: "a.test:8080", Priority: 10, Weight: 5}) {
+		t.Errorf("Unexpected backends %+v", backends)
+	}
+	if wait != 2*time.Second {
+		t.Errorf("Refresh should follow the record TTL, got %v", wait)
+	}
+}
+
+// TestFileDiscovery 测试从文件获取后端并在文件变化时重新读取
+func TestFileDiscovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backends")
+	os.WriteFile(path, []byte("# backends\n10.0.0.1:80 3\n10.0.0.2:80\n"), 0644)
+
+	d := &fileDiscoverer{path: path, interval: time.Second}
+	backends, _, err := d.discover(context.Background())
+	if err != nil {
+		t.Fatalf("File discovery failed: %v", err)
+	}
+	if len(backends) != 2 || backends[0].Weight != 3 || backends[1].Address != "10.0.0.2:80" {
+		t.Errorf("Unexpected backends %+v", backends)
+	}
+
+	if backends, _, _ := d.discover(context.Background()); backends != nil {
+		t.Errorf("Unchanged file should not produce an update, got %+v", backends)
+	}
+
+	os.WriteFile(path, []byte("10.0.0.3:80\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	backends, _, err = d.discover(context.Background())
+	if err != nil || len(backends) != 1 || backends[0].Address != "10.0.0.3:80" {
+		t.Errorf("Expected updated backends, got %+v (%v)", backends, err)
+	}
+
+	os.WriteFile(path, []byte("not a backend\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	if _, _, err := d.discover(context.Background()); err == nil {
+		t.Error("Expected invalid file to fail")
+	}
+}
+
+// TestBackendPoolUpdate 测试更新后端列表时保留熔断状态，并按优先级选择后端
+func TestBackendPoolUpdate(t *testing.T) {
+	pool := newBackendPool(Rule{
+		Outlier: OutlierPolicy{ConsecutiveFailures: 1, BaseEjection: time.Minute, MaxEjection: time.Minute},
+	}, time.Second, logrus.NewEntry(logrus.StandardLogger()))
+	primary := Backend{Network: "tcp", Address: "10.0.0.1:80", Priority: 0}
+	secondary := Backend{Network: "tcp", Address: "10.0.0.2:80", Priority: 1}
+	pool.update([]Backend{primary, secondary})
+
+	for i := 0; i < 4; i++ {
+		if b := pool.pick(i, nil); b.backendInfo() != primary {
+			t.Fatalf("Expected the higher priority backend, got %v", b.backendInfo())
+		}
+	}
+
+	pool.current()[0].failure("dial")
+	if b := pool.pick(0, nil); b.backendInfo() != secondary {
+		t.Fatalf("Expected fallback to the lower priority backend, got %v", b.backendInfo())
+	}
+
+	// 更新后仍然存在的后端保留被摘除的状态
+	pool.update([]Backend{primary})
+	if b := pool.pick(0, nil); b != nil {
+		t.Errorf("Ejected backend should stay ejected after update, got %v", b.backendInfo())
+	}
+
+	// 重新加载后服务发现首次得到的同一后端沿用原状态
+	reloaded := newBackendPool(pool.rule, time.Second, logrus.NewEntry(logrus.StandardLogger()))
+	reloaded.inherit(pool)
+	reloaded.update([]Backend{primary, secondary})
+	if b := reloaded.pick(0, nil); b == nil || b.backendInfo() != secondary {
+		t.Errorf("Ejected backend should stay ejected after reload, got %v", b)
+	}
+}
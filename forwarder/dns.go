@@ -0,0 +1,259 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNS 记录类型
+const (
+	dnsTypeA     = 1
+	dnsTypeCNAME = 5
+	dnsTypeAAAA  = 28
+	dnsTypeSRV   = 33
+
+	dnsClassIN = 1
+)
+
+var (
+	errDNSMalformed = errors.New("malformed dns message")
+	errDNSNotFound  = errors.New("dns name not found")
+)
+
+// dnsRecord 应答中的一条资源记录
+type dnsRecord struct {
+	Name string
+	Type uint16
+	TTL  time.Duration
+
+	IP net.IP // A/AAAA
+
+	Target   string // CNAME/SRV
+	Priority uint16 // SRV
+	Weight   uint16 // SRV
+	Port     uint16 // SRV
+}
+
+// dnsQuery 向指定服务器查询一个名字，UDP 应答被截断时改用 TCP 重试
+func dnsQuery(ctx context.Context, server, name string, qtype uint16) ([]dnsRecord, error) {
+	id := uint16(rand.Uint32())
+	query, err := buildDNSQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := dnsExchange(ctx, "udp", server, query)
+	if err != nil {
+		return nil, err
+	}
+	records, truncated, err := parseDNSResponse(resp, id)
+	if truncated {
+		if resp, err = dnsExchange(ctx, "tcp", server, query); err != nil {
+			return nil, err
+		}
+		records, _, err = parseDNSResponse(resp, id)
+	}
+	return records, err
+}
+
+// dnsExchange 发送一次查询并读取应答，TCP 报文带两字节长度前缀
+func dnsExchange(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// buildDNSQuery 构造只有一个问题的递归查询报文
+func buildDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 1<<8) // RD
+	binary.BigEndian.PutUint16(msg[4:], 1)    // QDCOUNT
+
+	msg, err := appendDNSName(msg, name)
+	if err != nil {
+		return nil, err
+	}
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	return msg, nil
+}
+
+// appendDNSName 以标签序列编码域名
+func appendDNSName(msg []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid dns name %q", name)
+			}
+			msg = append(msg, byte(len(label)))
+			msg = append(msg, label...)
+		}
+	}
+	return append(msg, 0), nil
+}
+
+// parseDNSResponse 解析应答报文中的 A、AAAA、CNAME 和 SRV 记录
+func parseDNSResponse(msg []byte, id uint16) ([]dnsRecord, bool, error) {
+	if len(msg) < 12 {
+		return nil, false, errDNSMalformed
+	}
+	if binary.BigEndian.Uint16(msg[0:]) != id {
+		return nil, false, errors.New("dns response id mismatch")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&(1<<15) == 0 {
+		return nil, false, errDNSMalformed
+	}
+	truncated := flags&(1<<9) != 0
+	switch rcode := flags & 0xf; rcode {
+	case 0:
+	case 3:
+		return nil, truncated, errDNSNotFound
+	default:
+		return nil, truncated, fmt.Errorf("dns server returned rcode %d", rcode)
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, truncated, err
+		}
+		off = next + 4
+	}
+
+	var records []dnsRecord
+	for i := 0; i < ancount; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, truncated, err
+		}
+		off = next
+		if off+10 > len(msg) {
+			return nil, truncated, errDNSMalformed
+		}
+		rec := dnsRecord{
+			Name: name,
+			Type: binary.BigEndian.Uint16(msg[off:]),
+			TTL:  time.Duration(binary.BigEndian.Uint32(msg[off+4:])) * time.Second,
+		}
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, truncated, errDNSMalformed
+		}
+		rdata := msg[off : off+rdlen]
+
+		switch rec.Type {
+		case dnsTypeA:
+			if rdlen != net.IPv4len {
+				return nil, truncated, errDNSMalformed
+			}
+			rec.IP = net.IP(append([]byte(nil), rdata...))
+		case dnsTypeAAAA:
+			if rdlen != net.IPv6len {
+				return nil, truncated, errDNSMalformed
+			}
+			rec.IP = net.IP(append([]byte(nil), rdata...))
+		case dnsTypeCNAME:
+			if rec.Target, _, err = readDNSName(msg, off); err != nil {
+				return nil, truncated, err
+			}
+		case dnsTypeSRV:
+			if rdlen < 7 {
+				return nil, truncated, errDNSMalformed
+			}
+			rec.Priority = binary.BigEndian.Uint16(rdata[0:])
+			rec.Weight = binary.BigEndian.Uint16(rdata[2:])
+			rec.Port = binary.BigEndian.Uint16(rdata[4:])
+			if rec.Target, _, err = readDNSName(msg, off+6); err != nil {
+				return nil, truncated, err
+			}
+		default:
+			off += rdlen
+			continue
+		}
+		records = append(records, rec)
+		off += rdlen
+	}
+	return records, truncated, nil
+}
+
+// readDNSName 读取可能带压缩指针的域名，返回域名和紧随其后的偏移
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSMalformed
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errDNSMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errDNSMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
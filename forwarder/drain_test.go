@@ -0,0 +1,88 @@
+package forwarder
+
+import (
+	"testing"
+	"time"
+)
+
+// halfCloseConn 支持半关闭的模拟连接
+type halfCloseConn struct {
+	mockConn
+	writeClosed bool
+}
+
+func (c *halfCloseConn) CloseWrite() error {
+	c.writeClosed = true
+	return nil
+}
+
+// TestConnectionManagerRemaining 测试按规则统计剩余隧道
+func TestConnectionManagerRemaining(t *testing.T) {
+	cm := NewConnectionManager(10)
+	defer cm.CloseAll()
+
+	cm.AddClientConnection(&mockConn{}, "a")
+	cm.AddClientConnection(&mockConn{}, "a")
+	cm.AddClientConnection(&mockConn{}, "b")
+	cm.AddConnection(&mockConn{}) // 后端连接不计入隧道数
+
+	remaining := cm.Remaining()
+	if remaining["a"] != 2 || remaining["b"] != 1 || len(remaining) != 2 {
+		t.Errorf("Unexpected remaining tunnels: %v", remaining)
+	}
+}
+
+// TestConnectionManagerStopAccepting 测试停止接收不影响已建立的隧道
+func TestConnectionManagerStopAccepting(t *testing.T) {
+	cm := NewConnectionManager(10)
+	defer cm.CloseAll()
+
+	cm.StopAccepting()
+	if cm.acceptCtx.Err() == nil {
+		t.Error("Accept context should be cancelled")
+	}
+	if cm.ctx.Err() != nil {
+		t.Error("Tunnel context should stay alive while draining")
+	}
+}
+
+// TestConnectionManagerHalfCloseIdle 测试只半关闭空闲的隧道
+func TestConnectionManagerHalfCloseIdle(t *testing.T) {
+	cm := NewConnectionManager(10)
+	defer cm.CloseAll()
+
+	idle := &halfCloseConn{}
+	active := &halfCloseConn{}
+	cm.AddClientConnection(idle, "a")
+	cm.AddClientConnection(active, "a")
+	cm.conns[idle].lastActive.Store(time.Now().Add(-time.Minute).UnixNano())
+
+	if n := cm.HalfCloseIdle(time.Second); n != 1 {
+		t.Errorf("Expected 1 half-closed tunnel, got %d", n)
+	}
+	if !idle.writeClosed || active.writeClosed {
+		t.Error("Only the idle tunnel should be half-closed")
+	}
+	if n := cm.HalfCloseIdle(time.Second); n != 0 {
+		t.Errorf("Tunnel should not be half-closed twice, got %d", n)
+	}
+}
+
+// TestConnectionManagerHalfCloseInner 测试半关闭经最内层的包装连接进行
+func TestConnectionManagerHalfCloseInner(t *testing.T) {
+	cm := NewConnectionManager(10)
+	defer cm.CloseAll()
+
+	raw := &halfCloseConn{}
+	inner := &halfCloseConn{}
+	cm.AddClientConnection(raw, "a")
+	cm.setInner(raw, inner)
+	cm.conns[raw].lastActive.Store(time.Now().Add(-time.Minute).UnixNano())
+
+	if n := cm.HalfCloseIdle(time.Second); n != 1 {
+		t.Errorf("Expected 1 half-closed tunnel, got %d", n)
+	}
+	if !inner.writeClosed || raw.writeClosed {
+		t.Error("Expected the tunnel to be half-closed through its inner conn")
+	}
+}
@@ -0,0 +1,94 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+)
+
+// Direction 数据在隧道中的流向
+type Direction int
+
+const (
+	Upstream   Direction = iota // 客户端到后端
+	Downstream                  // 后端到客户端
+)
+
+// String 返回流向的可读描述
+func (d Direction) String() string {
+	if d == Upstream {
+		return "up"
+	}
+	return "down"
+}
+
+// StreamInfo 过滤器所在隧道的元数据
+type StreamInfo struct {
+	ConnID    string
+	Rule      string
+	Client    string
+	Backend   string
+	Direction Direction
+}
+
+// Filter 检查或改写隧道一个方向上的数据流，同一方向的调用是串行的。
+//
+// Process 对每次从源端读到的数据调用，返回值交给链中的下一个过滤器，最后写到目标端：
+// 返回修改后的数据即可改写数据流，返回空切片则丢弃本次数据，阻塞即可延迟数据（应在 ctx
+// 结束时返回），返回错误则关闭整条隧道。data 在调用返回后会被复用，需要保留时应复制。
+//
+// Flush 在源端正常结束时调用，返回缓存中尚未输出的数据，用于按帧处理数据的过滤器。
+type Filter interface {
+	Process(ctx context.Context, data []byte) ([]byte, error)
+	Flush(ctx context.Context) ([]byte, error)
+}
+
+// FilterFactory 为隧道的一个方向创建过滤器，返回 nil 表示该方向不需要过滤
+type FilterFactory func(info StreamInfo) (Filter, error)
+
+// newFilterChain 按规则配置的顺序为一个方向创建过滤器链
+func newFilterChain(factories map[string]FilterFactory, names []string, info StreamInfo) ([]Filter, error) {
+	var chain []Filter
+	for _, name := range names {
+		filter, err := factories[name](info)
+		if err != nil {
+			return nil, fmt.Errorf("filter %s: %w", name, err)
+		}
+		if filter != nil {
+			chain = append(chain, filter)
+		}
+	}
+	return chain, nil
+}
+
+// runFilters 将数据依次交给 filters 处理，数据被丢弃时返回空切片
+func runFilters(ctx context.Context, filters []Filter, data []byte) ([]byte, error) {
+	for _, filter := range filters {
+		if len(data) == 0 {
+			return nil, nil
+		}
+		var err error
+		if data, err = filter.Process(ctx, data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// flushFilters 源端结束时依次取出每个过滤器缓存的数据，并交给其后的过滤器处理
+func flushFilters(ctx context.Context, filters []Filter, write func([]byte) error) error {
+	for i, filter := range filters {
+		data, err := filter.Flush(ctx)
+		if err != nil {
+			return err
+		}
+		if data, err = runFilters(ctx, filters[i+1:], data); err != nil {
+			return err
+		}
+		if len(data) > 0 {
+			if err := write(data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// upperFilter 将数据转换为大写
+type upperFilter struct{}
+
+func (upperFilter) Process(ctx context.Context, data []byte) ([]byte, error) {
+	return bytes.ToUpper(data), nil
+}
+
+func (upperFilter) Flush(ctx context.Context) ([]byte, error) { return nil, nil }
+
+// lineFilter 按行输出数据并为每行加上前缀，未结束的行缓存到 Flush 时输出
+type lineFilter struct {
+	prefix string
+	buf    []byte
+}
+
+func (f *lineFilter) Process(ctx context.Context, data []byte) ([]byte, error) {
+	f.buf = append(f.buf, data...)
+	var out []byte
+	for {
+		i := bytes.IndexByte(f.buf, '\n')
+		if i < 0 {
+			return out, nil
+		}
+		out = append(append(out, f.prefix...), f.buf[:i+1]...)
+		f.buf = f.buf[i+1:]
+	}
+}
+
+func (f *lineFilter) Flush(ctx context.Context) ([]byte, error) {
+	if len(f.buf) == 0 {
+		return nil, nil
+	}
+	return append([]byte(f.prefix), f.buf...), nil
+}
+
+var errQuit = errors.New("quit received")
+
+// quitFilter 收到 quit 时关闭隧道
+type quitFilter struct{}
+
+func (quitFilter) Process(ctx context.Context, data []byte) ([]byte, error) {
+	if bytes.Contains(data, []byte("quit")) {
+		return nil, errQuit
+	}
+	return data, nil
+}
+
+func (quitFilter) Flush(ctx context.Context) ([]byte, error) { return nil, nil }
+
+// TestTransferWithFilters 测试过滤器链按顺序处理数据，并在源端结束时输出缓存的数据
+func TestTransferWithFilters(t *testing.T) {
+	var dst bytes.Buffer
+	src := io.MultiReader(strings.NewReader("hello\nwor"), strings.NewReader("ld\nbye"))
+	n, err := TransferWithContext(context.Background(), &dst, src, &lineFilter{prefix: "> "}, upperFilter{})
+	if err != nil {
+		t.Fatalf("Transfer failed: %v", err)
+	}
+	want := "> HELLO\n> WORLD\n> BYE"
+	if dst.String() != want {
+		t.Errorf("Expected %q, got %q", want, dst.String())
+	}
+	if n != int64(len(want)) {
+		t.Errorf("Expected %d bytes written, got %d", len(want), n)
+	}
+
+	dst.Reset()
+	_, err = TransferWithContext(context.Background(), &dst, strings.NewReader("ok quit"), quitFilter{})
+	if !errors.Is(err, errQuit) {
+		t.Errorf("Expected filter error, got %v", err)
+	}
+	if dst.Len() != 0 {
+		t.Errorf("Expected nothing written, got %q", dst.String())
+	}
+}
+
+// TestForwarderFilters 测试规则按名称引用的过滤器作用于隧道的各个方向
+func TestForwarderFilters(t *testing.T) {
+	infos := make(chan StreamInfo, 4)
+	opts := DefaultOptions()
+	opts.Filters = map[string]FilterFactory{
+		"upper": func(info StreamInfo) (Filter, error) {
+			infos <- info
+			if info.Direction != Upstream {
+				return nil, nil
+			}
+			return upperFilter{}, nil
+		},
+		"quit": func(info StreamInfo) (Filter, error) {
+			return quitFilter{}, nil
+		},
+	}
+	rule := Rule{
+		Name:     "echo",
+		Backends: []Backend{echoServer(t)},
+		Filters:  []string{"quit", "upper"},
+	}
+	if _, err := New(DefaultOptions(), []Rule{rule}); err == nil {
+		t.Error("Expected unknown filter to be rejected")
+	}
+	fwd, err := New(opts, []Rule{rule})
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %v", err)
+	}
+	if err := fwd.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start forwarder: %v", err)
+	}
+	defer fwd.Stop(context.Background())
+
+	client, err := net.Dial("tcp", fwd.Stats().Rules[0].Listen)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	client.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if string(buf) != "HELLO" {
+		t.Errorf("Expected HELLO, got %q", buf)
+	}
+	for _, dir := range []Direction{Upstream, Downstream} {
+		info := <-infos
+		if info.Direction != dir || info.Rule != "echo" || info.ConnID == "" {
+			t.Errorf("Unexpected stream info %+v", info)
+		}
+	}
+
+	// 过滤器返回错误时关闭整条隧道
+	client.Write([]byte("quit"))
+	if _, err := client.Read(buf); err != io.EOF {
+		t.Errorf("Expected tunnel to be closed, got %v", err)
+	}
+}
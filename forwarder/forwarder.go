@@ -0,0 +1,480 @@
+// Package forwarder 实现 TCP 和 Unix 套接字的流量转发，可以嵌入到其他程序中使用。
+//
+// 一个 Forwarder 管理一组转发规则及其全部运行状态，同一进程内的多个 Forwarder 互不影响。
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultTimeout 默认的连接超时
+const DefaultTimeout = 30 * time.Second
+
+// Options 转发器的全局设置
+type Options struct {
+	Timeout  time.Duration // 连接、空闲读写和隧道生命周期的超时
+	MaxConns int           // 同时存在的最大连接数
+
+	DrainTimeout       time.Duration // Stop 时等待进行中的隧道结束的最长时间，0 表示只受 Stop 的上下文限制
+	DrainHalfCloseIdle time.Duration // 排空期间对空闲超过该时间的隧道关闭客户端写方向，0 表示不处理
+	DrainLogInterval   time.Duration // 排空期间输出剩余隧道数的间隔
+
+	HalfCloseLinger time.Duration // 一端结束发送后隧道继续保持的时间
+
+	Logger    *logrus.Logger // 运行日志，为空时丢弃
+	AccessLog *AccessLogger  // 访问日志，为空时不记录，由调用方负责关闭
+
+	Filters map[string]FilterFactory // 可在规则中按名称引用的过滤器
+}
+
+// DefaultOptions 返回默认设置
+func DefaultOptions() Options {
+	return Options{
+		Timeout:          DefaultTimeout,
+		MaxConns:         1000,
+		DrainTimeout:     10 * time.Second,
+		DrainLogInterval: 2 * time.Second,
+		HalfCloseLinger:  10 * time.Second,
+	}
+}
+
+// validate 检查设置是否有效
+func (o Options) validate() error {
+	switch {
+	case o.Timeout <= 0:
+		return errors.New("timeout must be positive")
+	case o.MaxConns <= 0:
+		return errors.New("maximum concurrent connections must be positive")
+	case o.DrainTimeout < 0 || o.DrainHalfCloseIdle < 0 || o.DrainLogInterval <= 0:
+		return errors.New("invalid drain settings")
+	case o.HalfCloseLinger < 0:
+		return errors.New("negative half-close linger")
+	}
+	return nil
+}
+
+// Forwarder 流量转发器
+type Forwarder struct {
+	opts   Options
+	log    *logrus.Entry
+	conns  *ConnectionManager
+	toxics toxicRegistry
+	agents *agentRegistry
+	links  *linkRegistry
+
+	buffers *bufferPool // 所有隧道共享的传输缓冲区
+
+	compression sync.Map // 规则名称 -> *compressionStats
+
+	mu        sync.Mutex
+	rules     []Rule
+	listeners map[string]*listener
+	started   bool
+	stopped   bool
+}
+
+// listener 一个监听地址及其当前生效的规则，重新加载时规则可以原地替换而不重新监听
+type listener struct {
+	ln      net.Listener
+	rt      atomic.Pointer[ruleRuntime]
+	closed  atomic.Bool
+	stop    func() bool
+	done    chan struct{}
+	address string
+}
+
+// ruleRuntime 规则的运行状态，转发模式使用后端池，代理模式使用 proxy
+type ruleRuntime struct {
+	rule   Rule
+	pool   *backendPool
+	proxy  proxyHandler
+	out    *outbound          // 连接后端或代理目标的出站设置，反向隧道模式下为空
+	cancel context.CancelFunc // 停止服务发现、关闭解析器并释放链路
+}
+
+// New 根据设置和规则创建转发器，调用 Start 后开始监听
+func New(opts Options, rules []Rule) (*Forwarder, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateRules(rules, opts.Filters); err != nil {
+		return nil, err
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = discardLogger()
+	}
+	return &Forwarder{
+		opts:      opts,
+		log:       logrus.NewEntry(logger),
+		conns:     NewConnectionManager(opts.MaxConns),
+		agents:    newAgentRegistry(),
+		links:     newLinkRegistry(),
+		buffers:   newBufferPool(),
+		rules:     append([]Rule(nil), rules...),
+		listeners: make(map[string]*listener),
+	}, nil
+}
+
+// validateRules 检查规则是否完整、内核接受其套接字选项、引用的过滤器均已注册、不同时压缩和加密、
+// 不以明文发送 WebSocket 令牌，且没有两条规则使用同一个监听地址
+func validateRules(rules []Rule, filters map[string]FilterFactory) error {
+	seen := make(map[string]string, len(rules))
+	reverseServer := slices.ContainsFunc(rules, func(r Rule) bool { return r.Mode == ModeReverseServer })
+	for _, rule := range rules {
+		if rule.Mode == ModeForward && len(rule.Backends) == 0 && rule.Discovery.Kind == "" {
+			return fmt.Errorf("rule %s has no backends", rule.RuleName())
+		}
+		if rule.Mode == ModeReverse && (rule.Service == "" || !reverseServer) {
+			return fmt.Errorf("rule %s needs a service and a reverse-server rule", rule.RuleName())
+		}
+		if rule.ReverseServer != "" && (rule.Mode != ModeForward || rule.Service == "") {
+			return fmt.Errorf("agent rule %s needs a service and backends", rule.RuleName())
+		}
+		if rule.Via != "" && rule.Mode != ModeForward {
+			return fmt.Errorf("rule %s can only use a link to reach backends", rule.RuleName())
+		}
+		// 压缩后的长度随内容变化，与加密同时使用时，能向隧道注入数据并观察密文长度的攻击者
+		// 可以借此猜出同一隧道中的秘密（CRIME/BREACH），因此同一规则不能同时压缩和加密
+		if (rule.Compress != "" && rule.Encrypt != "") || (rule.Decompress != "" && rule.Decrypt != "") {
+			return fmt.Errorf("rule %s cannot combine compression with encryption", rule.RuleName())
+		}
+		if rule.WebSocket != "" && !rule.WebSocketTLS && rule.Encrypt == "" {
+			return fmt.Errorf("rule %s would send its websocket token in clear text, set websocket-tls or encrypt", rule.RuleName())
+		}
+		if err := rule.probeSocket(); err != nil {
+			return fmt.Errorf("rule %s: %w", rule.RuleName(), err)
+		}
+		for _, name := range rule.Filters {
+			if filters[name] == nil {
+				return fmt.Errorf("rule %s uses unknown filter %q", rule.RuleName(), name)
+			}
+		}
+		key := rule.addressKey()
+		if other, ok := seen[key]; ok {
+			return fmt.Errorf("rules %s and %s listen on the same address", other, rule.RuleName())
+		}
+		seen[key] = rule.RuleName()
+	}
+	return nil
+}
+
+// Start 为所有规则开始监听，任一规则监听失败时关闭已启动的监听并返回错误。
+// ctx 只用于启动过程，例如首次服务发现；停止转发器请调用 Stop。
+func (f *Forwarder) Start(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.started {
+		return errors.New("forwarder already started")
+	}
+	f.started = true
+
+	for _, rule := range f.rules {
+		l, err := f.listen(ctx, rule)
+		if err != nil {
+			for key, l := range f.listeners {
+				l.close()
+				l.rt.Load().cancel()
+				delete(f.listeners, key)
+			}
+			return fmt.Errorf("rule %s: %w", rule.RuleName(), err)
+		}
+		f.listeners[rule.listenKey()] = l
+	}
+	return nil
+}
+
+// Reload 替换转发规则：新增的规则开始监听，删除的规则停止监听，监听地址不变但配置变化的规则
+// 原地替换后端池，不会中断监听。已建立的隧道不受影响。部分规则监听失败时其余规则仍然生效。
+func (f *Forwarder) Reload(rules []Rule) error {
+	if err := validateRules(rules, f.opts.Filters); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.started || f.stopped {
+		return errors.New("forwarder not running")
+	}
+
+	wanted := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		wanted[rule.listenKey()] = true
+	}
+	for key, l := range f.listeners {
+		if !wanted[key] {
+			rt := l.rt.Load()
+			l.close()
+			<-l.done
+			rt.cancel()
+			delete(f.listeners, key)
+			f.log.WithField(fieldRule, rt.rule.RuleName()).Info("Rule removed, existing tunnels keep running.")
+		}
+	}
+
+	var errs []error
+	for _, rule := range rules {
+		key := rule.listenKey()
+		l, ok := f.listeners[key]
+		if !ok {
+			l, err := f.listen(f.conns.acceptCtx, rule)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("rule %s: %w", rule.RuleName(), err))
+				continue
+			}
+			f.listeners[key] = l
+			continue
+		}
+		if reflect.DeepEqual(l.rt.Load().rule, rule) {
+			continue
+		}
+		rt, err := f.newRuntime(f.conns.acceptCtx, rule, l.rt.Load())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %w", rule.RuleName(), err))
+			continue
+		}
+		l.rt.Swap(rt).cancel()
+		f.log.WithField(fieldRule, rule.RuleName()).Info("Rule updated.")
+	}
+	f.rules = append([]Rule(nil), rules...)
+	return errors.Join(errs...)
+}
+
+// Stop 停止接收新连接并等待进行中的隧道结束，超过 DrainTimeout 或 ctx 结束时强制关闭剩余连接并返回错误。
+// 转发器停止后不能再次启动。
+func (f *Forwarder) Stop(ctx context.Context) error {
+	f.mu.Lock()
+	if f.stopped {
+		f.mu.Unlock()
+		return nil
+	}
+	f.stopped = true
+	listeners := f.listeners
+	f.listeners = make(map[string]*listener)
+	f.mu.Unlock()
+
+	f.conns.StopAccepting()
+	for _, l := range listeners {
+		<-l.done
+		l.rt.Load().cancel()
+	}
+
+	err := f.drain(ctx)
+	f.conns.CloseAll()
+	return err
+}
+
+// drain 在排空期内等待进行中的隧道结束，定期输出剩余隧道数
+func (f *Forwarder) drain(ctx context.Context) error {
+	if f.opts.DrainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.opts.DrainTimeout)
+		defer cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		f.conns.Wait()
+		close(done)
+	}()
+
+	progress := time.NewTicker(f.opts.DrainLogInterval)
+	defer progress.Stop()
+
+	halfCloseIdle := func() {
+		if f.opts.DrainHalfCloseIdle <= 0 {
+			return
+		}
+		if n := f.conns.HalfCloseIdle(f.opts.DrainHalfCloseIdle); n > 0 {
+			f.log.Infof("Half-closed %d idle tunnel(s).", n)
+		}
+	}
+	halfCloseIdle()
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-progress.C:
+			for rule, n := range f.conns.Remaining() {
+				f.log.WithField(fieldRule, rule).Infof("Draining, %d tunnel(s) remaining.", n)
+			}
+			halfCloseIdle()
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				f.log.Warning("Drain timeout exceeded, forcing shutdown.")
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// listen 为规则创建监听器并开始接收连接
+func (f *Forwarder) listen(ctx context.Context, rule Rule) (*listener, error) {
+	// 反向隧道的代理端不在本地监听，而是从服务端接收连接
+	var ln net.Listener
+	var err error
+	switch {
+	case rule.ReverseServer != "":
+		ln, err = f.listenAgent(rule)
+	case rule.Mode == ModeLinkServer:
+		ln, err = f.listenLink(rule)
+	default:
+		ln, err = rule.listen()
+	}
+	if err != nil {
+		return nil, err
+	}
+	rt, err := f.newRuntime(ctx, rule, nil)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	l := &listener{
+		ln:      ln,
+		done:    make(chan struct{}),
+		address: addrString(ln.Addr()),
+	}
+	l.rt.Store(rt)
+	// 停止接收新连接时关闭监听器
+	l.stop = context.AfterFunc(f.conns.acceptCtx, l.close)
+	f.log.WithField(fieldRule, rule.RuleName()).Infof("Listening on %s.", rule.localString())
+
+	go f.serve(l)
+	return l, nil
+}
+
+// newRuntime 创建规则的运行状态。代理和反向隧道模式创建代理处理器；转发模式创建后端池，
+// 启用服务发现时先同步获取一次后端，之后在后台持续刷新。重新加载时 prev 为被替换的运行状态，后端状态按地址沿用
+func (f *Forwarder) newRuntime(ctx context.Context, rule Rule, prev *ruleRuntime) (*ruleRuntime, error) {
+	if rule.Mode != ModeForward {
+		var proxy proxyHandler
+		var out *outbound
+		cancel := func() {}
+		var err error
+		if rule.Mode == ModeReverse || rule.Mode == ModeReverseServer {
+			proxy, err = f.newReverseHandler(rule)
+		} else {
+			out = newOutbound(rule, f.opts.Timeout, f.log.WithField(fieldRule, rule.RuleName()))
+			proxy, cancel, err = newProxyHandler(rule, out, f.log)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &ruleRuntime{rule: rule, proxy: proxy, out: out, cancel: cancel}, nil
+	}
+
+	pool := newBackendPool(rule, f.opts.Timeout, f.log)
+	if prev != nil && prev.pool != nil {
+		pool.inherit(prev.pool)
+	}
+	var release func()
+	if rule.Via != "" {
+		link, err := f.links.acquire(rule, f.opts.Timeout, f.log)
+		if err != nil {
+			return nil, err
+		}
+		pool.link = link
+		release = sync.OnceFunc(func() { f.links.release(link) })
+	}
+	watchCtx, cancelWatch := context.WithCancel(f.conns.acceptCtx)
+	if rule.Discovery.Kind != "" {
+		d := newDiscoverer(rule)
+		wait := refreshPool(ctx, pool, d)
+		go watchDiscovery(watchCtx, pool, d, wait)
+	}
+	cancel := func() {
+		cancelWatch()
+		pool.resolver.Close()
+		if release != nil {
+			release()
+		}
+	}
+	return &ruleRuntime{rule: rule, pool: pool, out: pool.out, cancel: cancel}, nil
+}
+
+// close 关闭监听器，已建立的隧道不受影响
+func (l *listener) close() {
+	if l.closed.CompareAndSwap(false, true) {
+		l.stop()
+		l.ln.Close()
+	}
+}
+
+// serve 接收连接直到监听器关闭，监听器由多个套接字组成时每个套接字有独立的接收循环
+func (f *Forwarder) serve(l *listener) {
+	defer close(l.done)
+	m, ok := l.ln.(*multiListener)
+	if !ok {
+		f.acceptLoop(l, l.ln)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, ln := range m.listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.acceptLoop(l, ln)
+		}()
+	}
+	wg.Wait()
+}
+
+// acceptLoop 从 ln 接收连接并为每个连接启动隧道
+func (f *Forwarder) acceptLoop(l *listener, ln net.Listener) {
+	for {
+		upstream, err := ln.Accept()
+		rt := l.rt.Load()
+		name := rt.rule.RuleName()
+		log := f.log.WithField(fieldRule, name)
+		if err != nil {
+			if l.closed.Load() {
+				// 服务正在关闭
+				return
+			}
+			log.WithError(err).Errorf("Failed to accept new connection on %s.", rt.rule.localString())
+			continue
+		}
+
+		rt.rule.Socket.tuneConn(upstream)
+
+		record := &AccessRecord{
+			Start:   time.Now(),
+			ConnID:  newConnID(),
+			Rule:    name,
+			Client:  addrString(upstream.RemoteAddr()),
+			Backend: rt.rule.remoteString(),
+		}
+		connLog := log.WithFields(logrus.Fields{
+			fieldConnID: record.ConnID,
+			fieldClient: record.Client,
+		})
+
+		if f.toxics.drop(name) {
+			connLog.Warn("Connection dropped by toxic.")
+			upstream.Close()
+			continue
+		}
+
+		// 检查连接数量限制
+		if !f.conns.AddClientConnection(upstream, name) {
+			connLog.Warn("Connection limit reached, rejecting connection.")
+			upstream.Close()
+			continue
+		}
+
+		connLog.Info("Client connected.")
+
+		go f.handle(upstream, rt, connLog, record)
+	}
+}
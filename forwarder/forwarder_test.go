@@ -0,0 +1,462 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startForwarder 启动使用随机端口的转发器，测试结束时停止
+func startForwarder(t *testing.T, rules ...Rule) *Forwarder {
+	t.Helper()
+	opts := DefaultOptions()
+	opts.Timeout = 5 * time.Second
+	fwd, err := New(opts, rules)
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %v", err)
+	}
+	if err := fwd.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start forwarder: %v", err)
+	}
+	t.Cleanup(func() { fwd.Stop(context.Background()) })
+	return fwd
+}
+
+// bannerServer 启动一个向每个连接写入 banner 后关闭连接的后端
+func bannerServer(t testing.TB, banner string) Backend {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(banner))
+			conn.Close()
+		}
+	}()
+	return Backend{Network: "tcp", Address: ln.Addr().String()}
+}
+
+// echoServer 启动一个回显后端
+func echoServer(t *testing.T) Backend {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return Backend{Network: "tcp", Address: ln.Addr().String()}
+}
+
+// readBanner 通过转发器连接后端并读取 banner
+func readBanner(t *testing.T, addr string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	return string(data)
+}
+
+// TestForwarderReload 测试重新加载时原地替换后端、新增和删除规则
+func TestForwarderReload(t *testing.T) {
+	one, two := bannerServer(t, "one"), bannerServer(t, "two")
+	fwd := startForwarder(t, Rule{Name: "a", Backends: []Backend{one}})
+	addr := fwd.Stats().Rules[0].Listen
+	if got := readBanner(t, addr); got != "one" {
+		t.Fatalf("Expected banner one, got %q", got)
+	}
+
+	// 同一监听地址换用新后端，监听器保持不变
+	if err := fwd.Reload([]Rule{{Name: "a", Backends: []Backend{two}}}); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if got := readBanner(t, addr); got != "two" {
+		t.Errorf("Expected banner two after reload, got %q", got)
+	}
+
+	// 删除规则后不再接收连接
+	unix := t.TempDir() + "/fwd.sock"
+	if err := fwd.Reload([]Rule{{Name: "b", LocalUnix: unix, Backends: []Backend{one}}}); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Error("Expected removed rule to stop listening")
+	}
+	stats := fwd.Stats()
+	if len(stats.Rules) != 1 || stats.Rules[0].Name != "b" {
+		t.Fatalf("Unexpected rules after reload: %+v", stats.Rules)
+	}
+
+	conn, err := net.Dial("unix", unix)
+	if err != nil {
+		t.Fatalf("Failed to dial unix socket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if data, _ := io.ReadAll(conn); string(data) != "one" {
+		t.Errorf("Expected banner one from new rule, got %q", data)
+	}
+}
+
+// TestForwarderStopTimeout 测试排空超时后强制关闭剩余隧道
+func TestForwarderStopTimeout(t *testing.T) {
+	// 后端保持连接但从不发送数据
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	opts := DefaultOptions()
+	opts.DrainTimeout = 100 * time.Millisecond
+	fwd, err := New(opts, []Rule{{Backends: []Backend{{Network: "tcp", Address: ln.Addr().String()}}}})
+	if err != nil {
+		t.Fatalf("Failed to create forwarder: %v", err)
+	}
+	if err := fwd.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start forwarder: %v", err)
+	}
+	stats := fwd.Stats()
+	client, err := net.Dial("tcp", stats.Rules[0].Listen)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fwd.Stats().Rules[0].Backends[0].Tunnels == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := fwd.Stop(context.Background()); err != context.DeadlineExceeded {
+		t.Errorf("Expected drain timeout, got %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected tunnel to be closed, got %v", err)
+	}
+	if err := fwd.Reload(nil); err == nil {
+		t.Error("Expected reload after stop to fail")
+	}
+}
+
+// TestNewRejectsDuplicateListen 测试两条规则使用同一监听地址时创建失败
+func TestNewRejectsDuplicateListen(t *testing.T) {
+	backends := []Backend{{Network: "tcp", Address: "127.0.0.1:80"}}
+	rules := []Rule{{LocalPort: 18080, Backends: backends}, {LocalPort: 18080, Backends: backends}}
+	if _, err := New(DefaultOptions(), rules); err == nil {
+		t.Error("Expected duplicate listen address to be rejected")
+	}
+	if _, err := New(DefaultOptions(), []Rule{{LocalPort: 18080}}); err == nil {
+		t.Error("Expected rule without backends to be rejected")
+	}
+}
+
+// TestBindAddresses 测试规则只在指定的地址或网卡上监听，以及只接受 IPv6 连接的监听
+func TestBindAddresses(t *testing.T) {
+	one := bannerServer(t, "one")
+	fwd := startForwarder(t,
+		Rule{Name: "v4", Bind: []string{"127.0.0.1"}, Backends: []Backend{one}},
+		Rule{Name: "lo", Bind: []string{"lo"}, Backends: []Backend{one}},
+		Rule{Name: "v6only", IPv6Only: true, Backends: []Backend{one}},
+	)
+	listen := make(map[string]string)
+	for _, rs := range fwd.Stats().Rules {
+		listen[rs.Name] = rs.Listen
+	}
+
+	if got := readBanner(t, listen["v4"]); got != "one" {
+		t.Errorf("Expected banner through 127.0.0.1, got %q", got)
+	}
+	if _, err := net.DialTimeout("tcp", net.JoinHostPort("::1", portOf(listen["v4"])), time.Second); err == nil {
+		t.Error("Expected rule bound to 127.0.0.1 not to accept on ::1")
+	}
+
+	// 网卡的每个地址各有一个监听器
+	addrs := strings.Split(listen["lo"], ",")
+	if len(addrs) != 2 {
+		t.Fatalf("Expected listeners on both loopback addresses, got %q", listen["lo"])
+	}
+	for _, addr := range addrs {
+		if got := readBanner(t, addr); got != "one" {
+			t.Errorf("Expected banner through %s, got %q", addr, got)
+		}
+	}
+
+	// 监听标识包含网卡当前的地址，地址变化后重新加载时重新监听
+	if key := (Rule{Bind: []string{"lo"}}).listenKey(); !strings.Contains(key, "127.0.0.1") {
+		t.Errorf("Expected listen key to carry the interface addresses, got %q", key)
+	}
+
+	port := portOf(listen["v6only"])
+	if got := readBanner(t, net.JoinHostPort("::1", port)); got != "one" {
+		t.Errorf("Expected banner through ::1, got %q", got)
+	}
+	if _, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", port), time.Second); err == nil {
+		t.Error("Expected IPv6-only rule not to accept IPv4 connections")
+	}
+}
+
+// TestOutboundSource 测试出站连接轮流使用源地址池，以及源地址不可用时的统计
+func TestOutboundSource(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			conn.Write([]byte(host))
+			conn.Close()
+		}
+	}()
+	backend := Backend{Network: "tcp", Address: ln.Addr().String()}
+
+	pool := startForwarder(t, Rule{Name: "pool", Source: []string{"127.0.0.2", "127.0.0.3", "::1"}, Backends: []Backend{backend}})
+	unavailable := startForwarder(t, Rule{Name: "unavailable", Source: []string{"192.0.2.1"}, Backends: []Backend{backend}})
+
+	// IPv6 源地址不用于 IPv4 后端
+	for _, want := range []string{"127.0.0.2", "127.0.0.3", "127.0.0.2"} {
+		if got := readBanner(t, pool.Stats().Rules[0].Listen); got != want {
+			t.Errorf("Expected backend to see source %s, got %q", want, got)
+		}
+	}
+
+	if got := readBanner(t, unavailable.Stats().Rules[0].Listen); got != "" {
+		t.Errorf("Expected connection with unavailable source to be closed, got %q", got)
+	}
+	if got := pool.Stats().Rules[0].SourceExhaustions; got != 0 {
+		t.Errorf("Expected no source exhaustions, got %d", got)
+	}
+	if got := unavailable.Stats().Rules[0].SourceExhaustions; got != 1 {
+		t.Errorf("Expected 1 source exhaustion, got %d", got)
+	}
+}
+
+// TestAddressExhausted 测试只有 EADDRNOTAVAIL 算作本地地址耗尽，端口冲突的 EADDRINUSE 不算
+func TestAddressExhausted(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EADDRNOTAVAIL)}, true},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}, false},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, false},
+	} {
+		if got := isAddressExhausted(tc.err); got != tc.want {
+			t.Errorf("isAddressExhausted(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+// TestReloadClosesReplacedRuntime 测试重新加载时未变化的规则保留运行状态，被替换或删除的规则的解析器被关闭
+func TestReloadClosesReplacedRuntime(t *testing.T) {
+	one := bannerServer(t, "one")
+	byName := Backend{Network: "tcp", Address: net.JoinHostPort("localhost", portOf(one.Address))}
+	a := Rule{Name: "a", Backends: []Backend{byName}}
+	b := Rule{Name: "b", LocalUnix: t.TempDir() + "/b.sock", UnlinkStale: true, Backends: []Backend{byName}}
+	fwd := startForwarder(t, a, b)
+	runtime := func(r Rule) *ruleRuntime {
+		fwd.mu.Lock()
+		defer fwd.mu.Unlock()
+		return fwd.listeners[r.listenKey()].rt.Load()
+	}
+	closed := func(rt *ruleRuntime) bool {
+		rt.pool.resolver.mu.Lock()
+		defer rt.pool.resolver.mu.Unlock()
+		return rt.pool.resolver.closed
+	}
+	addr := fwd.Stats().Rules[0].Listen
+	if got := readBanner(t, addr); got != "one" {
+		t.Fatalf("Expected banner one, got %q", got)
+	}
+
+	// 规则未变化时保留原运行状态
+	oldA, oldB := runtime(a), runtime(b)
+	if err := fwd.Reload([]Rule{a, b}); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if runtime(a) != oldA || closed(oldA) {
+		t.Error("Expected unchanged rule to keep its runtime and resolver")
+	}
+
+	// 替换规则 a 并删除规则 b
+	a.Retry.Retries = 1
+	if err := fwd.Reload([]Rule{a}); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	newA := runtime(a)
+	if newA == oldA || !closed(oldA) || closed(newA) {
+		t.Error("Expected replaced rule to get a new runtime and close the old resolver")
+	}
+	if !closed(oldB) {
+		t.Error("Expected removed rule to close its resolver")
+	}
+	if got := readBanner(t, addr); got != "one" {
+		t.Errorf("Expected banner one after reload, got %q", got)
+	}
+}
+
+// freePortRange 返回 n 个连续且当前空闲的本地端口中的第一个
+func freePortRange(t *testing.T, n int) int {
+	t.Helper()
+	for base := 20000 + rand.IntN(20000); base < 60000; base += n {
+		var lns []net.Listener
+		for port := base; port < base+n; port++ {
+			ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+			if err != nil {
+				break
+			}
+			lns = append(lns, ln)
+		}
+		for _, ln := range lns {
+			ln.Close()
+		}
+		if len(lns) == n {
+			return base
+		}
+	}
+	t.Fatalf("No %d consecutive free ports", n)
+	return 0
+}
+
+// TestReloadShrinkPortRange 测试端口范围缩小时只关闭移出范围的端口，其余端口保留原监听器
+func TestReloadShrinkPortRange(t *testing.T) {
+	// 相当于把 8000-8010 缩小为 8000-8005：关闭 5 个端口，保留 6 个
+	base := freePortRange(t, 11)
+	parse := func(last int) []Rule {
+		rules, err := ParseRules(fmt.Sprintf("%d-%d | 127.0.0.1 | 9 | bind=127.0.0.1", base, last))
+		if err != nil {
+			t.Fatalf("Failed to parse rules: %v", err)
+		}
+		return rules
+	}
+	fwd := startForwarder(t, parse(base+10)...)
+	listeners := func() map[string]*listener {
+		fwd.mu.Lock()
+		defer fwd.mu.Unlock()
+		return maps.Clone(fwd.listeners)
+	}
+	before := listeners()
+	if len(before) != 11 {
+		t.Fatalf("Expected 11 listeners, got %d", len(before))
+	}
+
+	kept := parse(base + 5)
+	if err := fwd.Reload(kept); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	after := listeners()
+	if len(after) != 6 {
+		t.Errorf("Expected 6 listeners after shrinking the range, got %d", len(after))
+	}
+	for _, rule := range kept {
+		if l := after[rule.listenKey()]; l == nil || l != before[rule.listenKey()] {
+			t.Errorf("Expected port %d to keep its listener", rule.LocalPort)
+		}
+	}
+	for port := base; port <= base+10; port++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			conn.Close()
+		}
+		if open := err == nil; open != (port <= base+5) {
+			t.Errorf("Port %d open = %v after shrinking the range to %d-%d", port, open, base, base+5)
+		}
+	}
+}
+
+// TestReloadKeepsBackendState 测试规则的其他设置变化时，地址不变的后端保留摘除状态，摘除策略变化时重新开始
+func TestReloadKeepsBackendState(t *testing.T) {
+	live := bannerServer(t, "live")
+	dead := Backend{Network: "tcp", Address: closedAddr(t)}
+	rule := Rule{
+		Name:     "pool",
+		Backends: []Backend{dead, live},
+		Outlier:  OutlierPolicy{ConsecutiveFailures: 1, BaseEjection: time.Minute, MaxEjection: time.Minute},
+	}
+	fwd := startForwarder(t, rule)
+	pool := func() *backendPool {
+		fwd.mu.Lock()
+		defer fwd.mu.Unlock()
+		return fwd.listeners[rule.listenKey()].rt.Load().pool
+	}
+	ejected := func(p *backendPool) bool {
+		return !p.current()[0].allow(time.Now())
+	}
+
+	// 依次落在两个后端上，故障后端被摘除
+	log := fwd.log
+	for i := 0; i < 2; i++ {
+		if conn, _, err := pool().dial(context.Background(), log); err == nil {
+			conn.Close()
+		}
+	}
+	old := pool()
+	if !ejected(old) {
+		t.Fatal("Expected the dead backend to be ejected")
+	}
+
+	rule.Retry.Retries = 2
+	if err := fwd.Reload([]Rule{rule}); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if p := pool(); p == old || p.current()[0] != old.current()[0] || !ejected(p) {
+		t.Error("Expected the dead backend to stay ejected after an unrelated change")
+	}
+
+	rule.Outlier.BaseEjection = 2 * time.Minute
+	if err := fwd.Reload([]Rule{rule}); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if ejected(pool()) {
+		t.Error("Expected a new outlier policy to start from a clean state")
+	}
+}
@@ -0,0 +1,51 @@
+package forwarder
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestHalfClosePropagation 测试客户端关闭写方向后仍能收到完整响应
+func TestHalfClosePropagation(t *testing.T) {
+	// 后端读到 EOF 后才返回收到的字节数
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte(strconv.Itoa(len(data))))
+	}()
+
+	fwd := startForwarder(t, Rule{
+		Backends: []Backend{{Network: "tcp", Address: backend.Addr().String()}},
+	})
+
+	client, err := net.Dial("tcp", fwd.Stats().Rules[0].Listen)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	client.Write(make([]byte, 4096))
+	client.(*net.TCPConn).CloseWrite()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if string(resp) != "4096" {
+		t.Errorf("Expected response 4096, got %q", resp)
+	}
+}
@@ -0,0 +1,142 @@
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const proxyRealm = "traffic-forwarder"
+
+var errHeaderTooLarge = errors.New("request header too large")
+
+// readHTTPRequest 读取客户端的 HTTP 请求，请求头最多读取约 http.DefaultMaxHeaderBytes 字节，
+// 避免客户端不断发送请求头占用内存。解析后取消限制，返回的读取器继续读取之后的数据
+func readHTTPRequest(conn net.Conn) (*http.Request, *bufio.Reader, error) {
+	// 与 net/http 一样为 bufio 的预读留出 4096 字节
+	lr := &io.LimitedReader{R: conn, N: http.DefaultMaxHeaderBytes + 4096}
+	br := bufio.NewReader(lr)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		if lr.N == 0 {
+			return nil, nil, errHeaderTooLarge
+		}
+		return nil, nil, err
+	}
+	lr.N = math.MaxInt64
+	return req, br, nil
+}
+
+// httpConnectHandler HTTP CONNECT 代理，可选 Proxy-Authorization 基本认证
+type httpConnectHandler struct {
+	creds   map[string]string
+	target  *targetDialer
+	timeout time.Duration
+}
+
+func (h *httpConnectHandler) accept(ctx context.Context, client net.Conn, record *AccessRecord, log *logrus.Entry) (net.Conn, error) {
+	req, br, err := readHTTPRequest(client)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errHeaderTooLarge) {
+			status = http.StatusRequestHeaderFieldsTooLarge
+		}
+		writeHTTPStatus(client, status, nil)
+		return nil, err
+	}
+	req.Body.Close()
+
+	if req.Method != http.MethodConnect {
+		writeHTTPStatus(client, http.StatusMethodNotAllowed, http.Header{"Allow": {http.MethodConnect}})
+		return nil, fmt.Errorf("unsupported method %s", req.Method)
+	}
+	if h.creds != nil {
+		user, password, ok := parseProxyAuthorization(req.Header.Get("Proxy-Authorization"))
+		if !ok || !checkPassword(h.creds, user, password) {
+			writeHTTPStatus(client, http.StatusProxyAuthRequired, http.Header{
+				"Proxy-Authenticate": {`Basic realm="` + proxyRealm + `"`},
+			})
+			if !ok {
+				return nil, errors.New("missing proxy credentials")
+			}
+			return nil, fmt.Errorf("proxy authentication failed for user %q", user)
+		}
+	}
+
+	// CONNECT 的请求目标为 authority 形式 host:port
+	target := req.RequestURI
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		writeHTTPStatus(client, http.StatusBadRequest, nil)
+		return nil, fmt.Errorf("invalid CONNECT target %q", target)
+	}
+	record.Backend = target
+
+	conn, err := h.target.dial(ctx, target)
+	if err != nil {
+		writeHTTPStatus(client, httpStatusCode(err), nil)
+		return nil, err
+	}
+	if err := writeHTTPStatus(client, http.StatusOK, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// 客户端可能不等回复就发送数据，已读入缓冲区的部分先转给目标
+	if n := br.Buffered(); n > 0 {
+		buffered, _ := br.Peek(n)
+		conn.SetWriteDeadline(time.Now().Add(h.timeout))
+		if _, err := conn.Write(buffered); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		record.BytesUp += int64(n)
+	}
+	return conn, nil
+}
+
+// parseProxyAuthorization 解析 Basic 认证头
+func parseProxyAuthorization(header string) (user, password string, ok bool) {
+	scheme, encoded, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// writeHTTPStatus 回复状态行和附加头，错误回复后客户端连接随即关闭
+func writeHTTPStatus(w net.Conn, code int, header http.Header) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	header.Write(&b)
+	if code != http.StatusOK {
+		b.WriteString("Connection: close\r\nContent-Length: 0\r\n")
+	}
+	b.WriteString("\r\n")
+	_, err := w.Write([]byte(b.String()))
+	return err
+}
+
+// httpStatusCode 根据连接目标的错误选择回复状态码
+func httpStatusCode(err error) int {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errNotAllowed):
+		return http.StatusForbidden
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,106 @@
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// httpConnect 通过代理发送请求，返回连接、读取器和响应
+func httpConnect(t *testing.T, proxy, request string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(request))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return conn, br, resp
+}
+
+// TestHTTPConnect 测试 CONNECT、代理认证、允许列表和非 CONNECT 请求
+func TestHTTPConnect(t *testing.T) {
+	echo := echoServer(t)
+	creds := filepath.Join(t.TempDir(), "proxy.passwd")
+	os.WriteFile(creds, []byte("alice:secret\n"), 0600)
+
+	rule := Rule{Mode: ModeHTTPConnect, AuthFile: creds, Allow: []string{"127.0.0.0/8:" + portOf(echo.Address)}}
+	fwd := startForwarder(t, rule)
+	proxy := fwd.Stats().Rules[0].Listen
+	auth := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")) + "\r\n"
+
+	// 客户端不等回复就发送的数据也要转发
+	conn, br, resp := httpConnect(t, proxy, "CONNECT "+echo.Address+" HTTP/1.1\r\nHost: "+echo.Address+"\r\n"+auth+"\r\nhello")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %s", resp.Status)
+	}
+	conn.Write([]byte(" world"))
+	buf := make([]byte, 11)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "hello world" {
+		t.Errorf("Expected echo through proxy, got %q, %v", buf, err)
+	}
+
+	cases := []struct {
+		request string
+		status  int
+	}{
+		{"CONNECT " + echo.Address + " HTTP/1.1\r\n\r\n", http.StatusProxyAuthRequired},
+		{"CONNECT " + echo.Address + " HTTP/1.1\r\nProxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("alice:wrong")) + "\r\n\r\n", http.StatusProxyAuthRequired},
+		{"GET http://" + echo.Address + "/ HTTP/1.1\r\nHost: " + echo.Address + "\r\n" + auth + "\r\n", http.StatusMethodNotAllowed},
+		{"CONNECT 127.0.0.1:1 HTTP/1.1\r\n" + auth + "\r\n", http.StatusForbidden},
+		{"CONNECT 10.1.2.3:80 HTTP/1.1\r\n" + auth + "\r\n", http.StatusForbidden},
+		{"CONNECT nohost HTTP/1.1\r\n" + auth + "\r\n", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if _, _, resp := httpConnect(t, proxy, c.request); resp.StatusCode != c.status {
+			t.Errorf("Request %q: expected %d, got %s", c.request, c.status, resp.Status)
+		}
+	}
+}
+
+// TestHTTPConnectHeaderLimit 测试请求头超过上限时返回 431 并停止读取
+func TestHTTPConnectHeaderLimit(t *testing.T) {
+	fwd := startForwarder(t, Rule{Mode: ModeHTTPConnect, Allow: []string{"127.0.0.0/8"}})
+	conn, err := net.Dial("tcp", fwd.Stats().Rules[0].Listen)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// 不断发送请求头，转发器停止读取并关闭连接后写入失败
+	const limit = 64 << 20
+	written := make(chan int, 1)
+	go func() {
+		n, _ := conn.Write([]byte("CONNECT 127.0.0.1:1 HTTP/1.1\r\nX-Pad: "))
+		chunk := bytes.Repeat([]byte("a"), 64<<10)
+		for n < limit {
+			m, err := conn.Write(chunk)
+			n += m
+			if err != nil {
+				break
+			}
+		}
+		written <- n
+	}()
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err == nil && resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Expected 431, got %s", resp.Status)
+	}
+	if n := <-written; n >= limit {
+		t.Errorf("Forwarder kept reading %d header bytes", n)
+	}
+}
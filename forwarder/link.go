@@ -0,0 +1,337 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	linkProtocol     = "TFLINK/1"
+	linkSubject      = "link"
+	defaultLinkConns = 2
+)
+
+// linkRegistry 转发器到各链路服务端的连接池，经同一链路转发的规则共享连接
+type linkRegistry struct {
+	mu    sync.Mutex
+	links map[string]*linkClient
+}
+
+func newLinkRegistry() *linkRegistry {
+	return &linkRegistry{links: make(map[string]*linkClient)}
+}
+
+// acquire 返回规则使用的链路并增加引用计数，规则不再使用时调用 release
+func (r *linkRegistry) acquire(rule Rule, timeout time.Duration, log *logrus.Entry) (*linkClient, error) {
+	token, err := loadToken(rule.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	size := rule.LinkConns
+	if size <= 0 {
+		size = defaultLinkConns
+	}
+	// 键只含令牌的摘要，令牌不留在注册表中
+	digest := sha256.Sum256(token)
+	key := fmt.Sprintf("%s|%d|%x", rule.Via, size, digest)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.links[key]; ok {
+		c.refs++
+		return c, nil
+	}
+	c := &linkClient{
+		key:     key,
+		server:  rule.Via,
+		token:   token,
+		size:    size,
+		timeout: timeout,
+		log:     log.WithField("link", rule.Via),
+		refs:    1,
+		ready:   make(chan struct{}),
+	}
+	r.links[key] = c
+	return c, nil
+}
+
+// release 减少链路的引用计数，不再被引用的链路在其上的流全部结束后断开
+func (r *linkRegistry) release(c *linkClient) {
+	r.mu.Lock()
+	c.refs--
+	if c.refs > 0 {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.links, c.key)
+	r.mu.Unlock()
+
+	c.mu.Lock()
+	c.closing = true
+	sessions := c.sessions
+	c.sessions = nil
+	c.mu.Unlock()
+	for _, s := range sessions {
+		s.drain()
+	}
+}
+
+// linkClient 到一个链路服务端的连接池，最多保持 size 条连接，流分配到打开流最少的连接上
+type linkClient struct {
+	key     string
+	server  string
+	token   []byte
+	size    int
+	timeout time.Duration
+	log     *logrus.Entry
+	refs    int // 由 linkRegistry.mu 保护
+
+	mu       sync.Mutex
+	sessions []*linkSession
+	dialing  int
+	ready    chan struct{} // 每次建立连接结束时关闭并替换，唤醒等待连接的拨号
+	closing  bool
+}
+
+// dial 经链路打开到远端目标的流
+func (c *linkClient) dial(ctx context.Context, address string) (net.Conn, error) {
+	s, err := c.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.open(ctx, address)
+}
+
+// session 选择打开流最少的连接，连接数未达上限时先建立新的连接，
+// 没有可用连接且达到上限时等待正在建立的连接
+func (c *linkClient) session(ctx context.Context) (*linkSession, error) {
+	for {
+		c.mu.Lock()
+		if c.closing {
+			c.mu.Unlock()
+			return nil, errLinkClosed
+		}
+		c.sessions = slices.DeleteFunc(c.sessions, (*linkSession).closed)
+		if len(c.sessions)+c.dialing < c.size {
+			break
+		}
+		if len(c.sessions) > 0 {
+			best := c.sessions[0]
+			for _, s := range c.sessions[1:] {
+				if s.load() < best.load() {
+					best = s
+				}
+			}
+			c.mu.Unlock()
+			return best, nil
+		}
+		ready := c.ready
+		c.mu.Unlock()
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	c.dialing++
+	c.mu.Unlock()
+
+	s, err := c.connect(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dialing--
+	close(c.ready)
+	c.ready = make(chan struct{})
+	if err != nil {
+		return nil, err
+	}
+	if c.closing {
+		s.drain()
+		return nil, errLinkClosed
+	}
+	c.sessions = append(c.sessions, s)
+	return s, nil
+}
+
+// connect 建立一条链路连接并完成认证
+func (c *linkClient) connect(ctx context.Context) (*linkSession, error) {
+	d := net.Dialer{Timeout: c.timeout}
+	conn, err := d.DialContext(ctx, "tcp", c.server)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err = io.WriteString(conn, linkProtocol+"\n"); err == nil {
+		err = answerChallenge(conn, c.token, linkSubject)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("link to %s: %w", c.server, err)
+	}
+	conn.SetDeadline(time.Time{})
+	c.log.Infof("Link to %s established.", c.server)
+	return newLinkSession(conn, true, c.timeout, c.log, nil), nil
+}
+
+// linkListener link-server 规则的监听器：认证链路连接，把链路上打开的每个流作为新连接交给规则的接收循环
+type linkListener struct {
+	net.Listener
+	tokenFile string
+	timeout   time.Duration
+	log       *logrus.Entry
+	conns     chan net.Conn
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	mu       sync.Mutex
+	sessions map[*linkSession]bool
+}
+
+// listenLink 创建 link-server 规则的监听器，令牌文件在每次建立链路时重新读取
+func (f *Forwarder) listenLink(rule Rule) (net.Listener, error) {
+	ln, err := rule.listen()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &linkListener{
+		Listener:  ln,
+		tokenFile: rule.TokenFile,
+		timeout:   f.opts.Timeout,
+		log:       f.log.WithField(fieldRule, rule.RuleName()),
+		conns:     make(chan net.Conn),
+		ctx:       ctx,
+		cancel:    cancel,
+		sessions:  make(map[*linkSession]bool),
+	}
+	go l.run()
+	return l, nil
+}
+
+func (l *linkListener) run() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if l.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			l.log.WithError(err).Error("Failed to accept link connection.")
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake 认证链路连接并开始多路复用会话
+func (l *linkListener) handshake(conn net.Conn) {
+	log := l.log.WithField(fieldClient, addrString(conn.RemoteAddr()))
+	conn.SetDeadline(time.Now().Add(l.timeout))
+	token, err := loadToken(l.tokenFile)
+	if err == nil {
+		var line string
+		if line, err = readAgentLine(conn); err == nil && line != linkProtocol {
+			err = fmt.Errorf("invalid link greeting %q", line)
+		}
+	}
+	if err == nil {
+		err = verifyChallenge(conn, token, linkSubject)
+	}
+	if err != nil {
+		log.WithError(err).Warn("Link handshake failed.")
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	s := newLinkSession(conn, false, l.timeout, log, l.deliver)
+	l.mu.Lock()
+	if l.ctx.Err() != nil {
+		l.mu.Unlock()
+		s.drain()
+		return
+	}
+	l.sessions[s] = true
+	l.mu.Unlock()
+	log.Info("Link established.")
+
+	<-s.done
+	l.mu.Lock()
+	delete(l.sessions, s)
+	l.mu.Unlock()
+}
+
+// deliver 将新打开的流交给接收循环
+func (l *linkListener) deliver(st *linkStream) {
+	go func() {
+		select {
+		case l.conns <- st:
+		case <-l.ctx.Done():
+			st.abort("shutting down")
+		}
+	}()
+}
+
+func (l *linkListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// Close 停止接收新的链路和流，已打开的流结束后断开链路
+func (l *linkListener) Close() error {
+	l.cancel()
+	err := l.Listener.Close()
+	l.mu.Lock()
+	sessions := make([]*linkSession, 0, len(l.sessions))
+	for s := range l.sessions {
+		sessions = append(sessions, s)
+	}
+	l.mu.Unlock()
+	for _, s := range sessions {
+		s.drain()
+	}
+	return err
+}
+
+// linkHandler link-server 规则的处理器，连接流请求的目标
+type linkHandler struct {
+	target *targetDialer
+}
+
+func (h *linkHandler) accept(ctx context.Context, client net.Conn, record *AccessRecord, log *logrus.Entry) (net.Conn, error) {
+	st, ok := netConn(client).(*linkStream)
+	if !ok {
+		return nil, errors.New("not a link stream")
+	}
+	record.Backend = st.target
+	conn, err := h.target.dial(ctx, st.target)
+	if err != nil {
+		st.abort(err.Error())
+		return nil, err
+	}
+	if err := st.accept(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// netConn 返回包装连接的底层连接
+func netConn(conn net.Conn) net.Conn {
+	if w, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		return w.NetConn()
+	}
+	return conn
+}
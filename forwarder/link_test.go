@@ -0,0 +1,127 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestLink 测试经多路复用链路转发：多个隧道共享一条连接，大于窗口的数据和半关闭都能正确传递，
+// 远端不允许的目标被拒绝
+func TestLink(t *testing.T) {
+	dir := t.TempDir()
+	token := filepath.Join(dir, "link.token")
+	os.WriteFile(token, []byte("s3cret"), 0600)
+
+	echo := echoServer(t)
+	far := startForwarder(t, Rule{Mode: ModeLinkServer, TokenFile: token, Allow: []string{"127.0.0.0/8:" + portOf(echo.Address)}})
+	_, port, _ := net.SplitHostPort(far.Stats().Rules[0].Listen)
+	via := net.JoinHostPort("127.0.0.1", port)
+
+	allowed := filepath.Join(dir, "allowed.sock")
+	denied := filepath.Join(dir, "denied.sock")
+	near := startForwarder(t,
+		Rule{Name: "allowed", LocalUnix: allowed, Backends: []Backend{echo}, Via: via, TokenFile: token, LinkConns: 1},
+		Rule{Name: "denied", LocalUnix: denied, Backends: []Backend{{Network: "tcp", Address: "127.0.0.1:1"}}, Via: via, TokenFile: token, LinkConns: 1},
+	)
+
+	payload := make([]byte, 1<<20)
+	rand.Read(payload)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("unix", allowed)
+			if err != nil {
+				t.Errorf("Failed to dial: %v", err)
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			go func() {
+				conn.Write(payload)
+				conn.(*net.UnixConn).CloseWrite()
+			}()
+			got, err := io.ReadAll(conn)
+			if err != nil || !bytes.Equal(got, payload) {
+				t.Errorf("Expected %d bytes echoed through link, got %d, %v", len(payload), len(got), err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	near.links.mu.Lock()
+	if n := len(near.links.links); n != 1 {
+		t.Errorf("Expected one shared link client, got %d", n)
+	}
+	for key, c := range near.links.links {
+		if strings.Contains(key, "s3cret") {
+			t.Errorf("Expected link registry key without the token, got %q", key)
+		}
+		c.mu.Lock()
+		if len(c.sessions) != 1 {
+			t.Errorf("Expected one link connection, got %d", len(c.sessions))
+		}
+		c.mu.Unlock()
+	}
+	near.links.mu.Unlock()
+
+	conn, err := net.Dial("unix", denied)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected denied target to close the tunnel, got %d bytes, %v", n, err)
+	}
+}
+
+// TestLinkImpostorServer 测试不知道令牌的链路服务端无法让入口建立链路
+func TestLinkImpostorServer(t *testing.T) {
+	token := filepath.Join(t.TempDir(), "link.token")
+	os.WriteFile(token, []byte("s3cret"), 0600)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// 接受任何应答，并回复以猜测的令牌计算的证明
+			go func() {
+				defer conn.Close()
+				readAgentLine(conn)
+				io.WriteString(conn, "CHALLENGE "+agentNonce()+"\n")
+				line, _ := readAgentLine(conn)
+				if fields := strings.Fields(line); len(fields) == 3 {
+					io.WriteString(conn, "OK "+serverMAC([]byte("guess"), "", fields[2], linkSubject)+"\n")
+				}
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	r := newLinkRegistry()
+	c, err := r.acquire(Rule{Via: ln.Addr().String(), TokenFile: token}, 5*time.Second, loggerFrom(context.Background()))
+	if err != nil {
+		t.Fatalf("Failed to acquire link: %v", err)
+	}
+	defer r.release(c)
+	if _, err := c.dial(context.Background(), "127.0.0.1:80"); err == nil || !strings.Contains(err.Error(), "prove") {
+		t.Errorf("Expected link to an impostor server to fail, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 日志字段名，所有与隧道相关的日志统一使用
+const (
+	fieldConnID    = "conn_id"
+	fieldRule      = "rule"
+	fieldClient    = "client"
+	fieldBackend   = "backend"
+	fieldBytesUp   = "bytes_up"
+	fieldBytesDown = "bytes_down"
+	fieldDuration  = "duration"
+	fieldKeyID     = "key_id"
+)
+
+// newConnID 生成隧道的唯一标识
+func newConnID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+type loggerKey struct{}
+
+// withLogger 将隧道日志记录器附加到上下文
+func withLogger(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, entry)
+}
+
+// loggerFrom 取出上下文中的隧道日志记录器，不存在时丢弃日志
+func loggerFrom(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+	return logrus.NewEntry(discardLogger())
+}
+
+// discardLogger 返回丢弃所有输出的记录器，嵌入方未提供记录器时不写入进程全局的标准记录器
+func discardLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	logger.SetLevel(logrus.PanicLevel)
+	return logger
+}
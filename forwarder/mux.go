@@ -0,0 +1,576 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 多路复用链路的帧格式：TYPE(1) STREAM(4) LENGTH(4) PAYLOAD，整数均为大端序。
+// WINDOW 和 PING 帧没有负载，LENGTH 分别为窗口增量和任意值。
+const (
+	frameData   = 0 // 流数据
+	frameWindow = 1 // 接收方读取数据后增加发送方的窗口
+	frameOpen   = 2 // 客户端打开流，负载为目标 host:port
+	frameOpened = 3 // 服务端已连接目标
+	frameFin    = 4 // 发送方不再发送数据
+	frameReset  = 5 // 中止流，负载为原因
+	framePing   = 6 // 保活
+
+	linkHeaderSize = 9
+	linkMaxPayload = 16 << 10
+	linkWindow     = 256 << 10 // 每个流的接收窗口
+	linkKeepalive  = 15 * time.Second
+)
+
+var (
+	errLinkClosed  = errors.New("link closed")
+	errStreamReset = errors.New("stream reset by peer")
+)
+
+// linkSession 一条链路连接上的多路复用会话。客户端打开流，服务端连接流请求的目标；
+// 双方定时发送 PING，超过三个周期收不到任何帧时断开。
+type linkSession struct {
+	conn    net.Conn
+	client  bool
+	timeout time.Duration
+	log     *logrus.Entry
+	onOpen  func(*linkStream) // 服务端收到打开请求时调用，不能阻塞
+
+	wmu sync.Mutex // 串行化帧的写入
+
+	mu       sync.Mutex
+	streams  map[uint32]*linkStream
+	nextID   uint32
+	draining bool // 不再打开新流，最后一个流结束后关闭
+	err      error
+	done     chan struct{}
+}
+
+func newLinkSession(conn net.Conn, client bool, timeout time.Duration, log *logrus.Entry, onOpen func(*linkStream)) *linkSession {
+	s := &linkSession{
+		conn:    conn,
+		client:  client,
+		timeout: timeout,
+		log:     log,
+		onOpen:  onOpen,
+		streams: make(map[uint32]*linkStream),
+		done:    make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.keepalive()
+	return s
+}
+
+// open 打开一个到目标的流，等待服务端连接目标的结果
+func (s *linkSession) open(ctx context.Context, target string) (*linkStream, error) {
+	s.mu.Lock()
+	if s.err != nil || s.draining {
+		s.mu.Unlock()
+		return nil, errLinkClosed
+	}
+	s.nextID++
+	st := newLinkStream(s, s.nextID, target)
+	opened := make(chan error, 1)
+	st.opened = opened
+	s.streams[st.id] = st
+	s.mu.Unlock()
+
+	if err := s.send(frameOpen, st.id, []byte(target)); err != nil {
+		s.remove(st.id)
+		return nil, err
+	}
+	select {
+	case err := <-opened:
+		if err != nil {
+			return nil, err
+		}
+		return st, nil
+	case <-ctx.Done():
+		st.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// load 返回会话上打开的流数
+func (s *linkSession) load() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// closed 判断会话是否已断开或正在关闭
+func (s *linkSession) closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err != nil || s.draining
+}
+
+// drain 停止打开新流，已有的流结束后关闭会话
+func (s *linkSession) drain() {
+	s.mu.Lock()
+	s.draining = true
+	idle := len(s.streams) == 0
+	s.mu.Unlock()
+	if idle {
+		s.close(errLinkClosed)
+	}
+}
+
+// close 断开会话并中止所有流
+func (s *linkSession) close(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*linkStream)
+	close(s.done)
+	s.mu.Unlock()
+
+	s.conn.Close()
+	for _, st := range streams {
+		st.fail(errLinkClosed)
+	}
+	if errors.Is(err, errLinkClosed) {
+		s.log.Info("Link closed.")
+	} else {
+		s.log.WithError(err).Warn("Link lost.")
+	}
+}
+
+func (s *linkSession) stream(id uint32) *linkStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+// remove 移除已结束的流，正在关闭的会话在最后一个流结束后关闭
+func (s *linkSession) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	idle := s.draining && len(s.streams) == 0
+	s.mu.Unlock()
+	if idle {
+		s.close(errLinkClosed)
+	}
+}
+
+// send 发送带负载的帧
+func (s *linkSession) send(typ byte, id uint32, payload []byte) error {
+	return s.writeFrame(typ, id, uint32(len(payload)), payload)
+}
+
+// writeFrame 发送一帧，写入失败时断开会话
+func (s *linkSession) writeFrame(typ byte, id, length uint32, payload []byte) error {
+	var header [linkHeaderSize]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:5], id)
+	binary.BigEndian.PutUint32(header[5:9], length)
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	select {
+	case <-s.done:
+		return errLinkClosed
+	default:
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	buffers := net.Buffers{header[:], payload}
+	if _, err := buffers.WriteTo(s.conn); err != nil {
+		s.close(err)
+		return err
+	}
+	return nil
+}
+
+// readLoop 读取并分发帧，直到会话断开
+func (s *linkSession) readLoop() {
+	var header [linkHeaderSize]byte
+	buf := make([]byte, linkMaxPayload)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(3 * linkKeepalive))
+		if _, err := io.ReadFull(s.conn, header[:]); err != nil {
+			s.close(err)
+			return
+		}
+		typ := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		length := binary.BigEndian.Uint32(header[5:9])
+		var payload []byte
+		if typ != frameWindow && typ != framePing {
+			if length > linkMaxPayload {
+				s.close(fmt.Errorf("frame of %d bytes exceeds the limit", length))
+				return
+			}
+			payload = buf[:length]
+			if _, err := io.ReadFull(s.conn, payload); err != nil {
+				s.close(err)
+				return
+			}
+		}
+		if err := s.dispatch(typ, id, length, payload); err != nil {
+			s.close(err)
+			return
+		}
+	}
+}
+
+// dispatch 处理一帧。读循环中不能同步写入，否则双方同时写满缓冲区时会互相阻塞
+func (s *linkSession) dispatch(typ byte, id, length uint32, payload []byte) error {
+	switch typ {
+	case framePing:
+		return nil
+	case frameOpen:
+		if s.client || s.onOpen == nil {
+			return errors.New("unexpected open frame")
+		}
+		s.mu.Lock()
+		if _, exists := s.streams[id]; exists {
+			s.mu.Unlock()
+			return fmt.Errorf("stream %d already open", id)
+		}
+		st := newLinkStream(s, id, string(payload))
+		if s.draining {
+			s.mu.Unlock()
+			go s.send(frameReset, id, []byte("shutting down"))
+			return nil
+		}
+		s.streams[id] = st
+		s.mu.Unlock()
+		s.onOpen(st)
+		return nil
+	}
+
+	st := s.stream(id)
+	if st == nil {
+		// 本端已关闭的流，对端在收到重置前发送的帧直接丢弃
+		return nil
+	}
+	switch typ {
+	case frameData:
+		st.receive(payload)
+	case frameWindow:
+		st.grow(length)
+	case frameOpened:
+		st.openResult(nil)
+	case frameFin:
+		st.finReceived()
+	case frameReset:
+		reason := string(payload)
+		if reason == "" {
+			st.fail(errStreamReset)
+		} else {
+			st.fail(fmt.Errorf("%w: %s", errStreamReset, reason))
+		}
+		s.remove(id)
+	default:
+		return fmt.Errorf("unknown frame type %d", typ)
+	}
+	return nil
+}
+
+// keepalive 定时发送 PING
+func (s *linkSession) keepalive() {
+	ticker := time.NewTicker(linkKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if s.writeFrame(framePing, 0, 0, nil) != nil {
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// linkStream 链路上的一个流，实现 net.Conn，支持半关闭和按窗口的流量控制
+type linkStream struct {
+	session *linkSession
+	id      uint32
+	target  string
+
+	mu            sync.Mutex
+	buf           []byte // 已收到但未读取的数据
+	consumed      uint32 // 已读取但未通知对端的字节数
+	sendWindow    uint32
+	remoteFin     bool
+	localFin      bool
+	closed        bool
+	err           error
+	opened        chan error // 客户端等待打开结果，收到结果后置为 nil
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readable      chan struct{}
+	writable      chan struct{}
+}
+
+func newLinkStream(s *linkSession, id uint32, target string) *linkStream {
+	return &linkStream{
+		session:    s,
+		id:         id,
+		target:     target,
+		sendWindow: linkWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+// notify 唤醒等待者，不阻塞
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// waitStream 等待流的状态变化，超过截止时间时返回超时错误
+func waitStream(ch <-chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (st *linkStream) wake() {
+	notify(st.readable)
+	notify(st.writable)
+}
+
+func (st *linkStream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		switch {
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return 0, err
+		case st.closed:
+			st.mu.Unlock()
+			return 0, net.ErrClosed
+		case len(st.buf) > 0:
+			n := copy(b, st.buf)
+			st.buf = st.buf[n:]
+			if len(st.buf) == 0 {
+				st.buf = nil
+			}
+			st.consumed += uint32(n)
+			var update uint32
+			if st.consumed >= linkWindow/2 && !st.remoteFin {
+				update, st.consumed = st.consumed, 0
+			}
+			st.mu.Unlock()
+			if update > 0 {
+				st.session.writeFrame(frameWindow, st.id, update, nil)
+			}
+			return n, nil
+		case st.remoteFin:
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+		if err := waitStream(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *linkStream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		st.mu.Lock()
+		switch {
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return written, err
+		case st.closed:
+			st.mu.Unlock()
+			return written, net.ErrClosed
+		case st.localFin:
+			st.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := waitStream(st.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(len(b)-written, int(st.sendWindow), linkMaxPayload)
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+		if err := st.session.send(frameData, st.id, b[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite 通知对端不再发送数据
+func (st *linkStream) CloseWrite() error {
+	st.mu.Lock()
+	if st.err != nil || st.closed {
+		st.mu.Unlock()
+		return net.ErrClosed
+	}
+	if st.localFin {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localFin = true
+	st.mu.Unlock()
+	return st.session.send(frameFin, st.id, nil)
+}
+
+// Close 关闭流。双方都已结束发送时正常结束，否则重置流，丢弃未读取的数据
+func (st *linkStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	var typ byte = frameReset
+	send := st.err == nil
+	if send && st.remoteFin && len(st.buf) == 0 {
+		typ = frameFin
+		send = !st.localFin
+	}
+	st.buf = nil
+	st.mu.Unlock()
+	st.wake()
+
+	if send {
+		st.session.send(typ, st.id, nil)
+	}
+	st.session.remove(st.id)
+	return nil
+}
+
+// abort 以 reason 重置流
+func (st *linkStream) abort(reason string) {
+	st.mu.Lock()
+	if st.closed || st.err != nil {
+		st.mu.Unlock()
+		return
+	}
+	st.err = fmt.Errorf("stream aborted: %s", reason)
+	st.mu.Unlock()
+	st.wake()
+	st.session.send(frameReset, st.id, []byte(reason))
+	st.session.remove(st.id)
+}
+
+// accept 服务端通知客户端目标已连接
+func (st *linkStream) accept() error {
+	return st.session.send(frameOpened, st.id, nil)
+}
+
+// receive 缓存收到的数据，超出窗口的数据视为协议错误并重置流
+func (st *linkStream) receive(data []byte) {
+	st.mu.Lock()
+	if st.closed || st.err != nil {
+		st.mu.Unlock()
+		return
+	}
+	if st.remoteFin || len(st.buf)+int(st.consumed)+len(data) > linkWindow {
+		st.mu.Unlock()
+		go st.abort("flow control violation")
+		return
+	}
+	st.buf = append(st.buf, data...)
+	st.mu.Unlock()
+	notify(st.readable)
+}
+
+func (st *linkStream) grow(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	notify(st.writable)
+}
+
+func (st *linkStream) finReceived() {
+	st.mu.Lock()
+	st.remoteFin = true
+	st.mu.Unlock()
+	notify(st.readable)
+}
+
+// openResult 通知等待打开结果的客户端
+func (st *linkStream) openResult(err error) {
+	st.mu.Lock()
+	opened := st.opened
+	st.opened = nil
+	st.mu.Unlock()
+	if opened != nil {
+		opened <- err
+	}
+}
+
+// fail 以 err 结束流，唤醒所有等待者
+func (st *linkStream) fail(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+	st.openResult(err)
+	st.wake()
+}
+
+func (st *linkStream) LocalAddr() net.Addr  { return st.session.conn.LocalAddr() }
+func (st *linkStream) RemoteAddr() net.Addr { return st.session.conn.RemoteAddr() }
+
+func (st *linkStream) SetDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline, st.writeDeadline = t, t
+	st.mu.Unlock()
+	st.wake()
+	return nil
+}
+
+func (st *linkStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readable)
+	return nil
+}
+
+func (st *linkStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writable)
+	return nil
+}
@@ -0,0 +1,147 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// outbound 规则连接后端和代理目标时的出站设置：源地址池、绑定的网卡、防火墙标记和套接字选项
+type outbound struct {
+	sources   []netip.Addr
+	socket    SocketOptions
+	iface     string
+	mark      uint32
+	timeout   time.Duration
+	log       *logrus.Entry
+	next      atomic.Uint64
+	exhausted atomic.Uint64 // 因本地地址或端口耗尽而失败的连接次数
+	noPort    sync.Once     // 只记录一次无法推迟分配本地端口的错误
+}
+
+func newOutbound(rule Rule, timeout time.Duration, log *logrus.Entry) *outbound {
+	o := &outbound{socket: rule.Socket, iface: rule.Interface, mark: rule.FWMark, timeout: timeout, log: log}
+	for _, s := range rule.Source {
+		if addr, err := netip.ParseAddr(s); err == nil {
+			o.sources = append(o.sources, addr.Unmap())
+		}
+	}
+	return o
+}
+
+// DialContext 连接 address。设置了源地址池时轮流选用与目标同一地址族的源地址，
+// 某个源地址的本地端口耗尽或冲突时换用下一个，全部失败时返回错误，其中有端口耗尽时记录
+func (o *outbound) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d := net.Dialer{Timeout: o.timeout}
+	d.KeepAlive, d.KeepAliveConfig = o.socket.keepAlive()
+	if o.socket.kernel() || o.iface != "" || o.mark != 0 || len(o.sources) > 0 {
+		d.Control = o.control
+	}
+	target, err := netip.ParseAddrPort(address)
+	if len(o.sources) == 0 || err != nil || network == "unix" {
+		conn, err := d.DialContext(ctx, network, address)
+		if err != nil && isAddressExhausted(err) {
+			o.exhausted.Add(1)
+			o.log.WithError(err).Error("Local addresses exhausted.")
+		}
+		if err == nil {
+			o.socket.tuneConn(conn)
+		}
+		return conn, err
+	}
+
+	sources := o.candidates(target.Addr().Unmap().Is4())
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no source address of the same family as %s", target.Addr())
+	}
+	var lastErr error
+	exhausted := false
+	for _, src := range sources {
+		d.LocalAddr = &net.TCPAddr{IP: src.AsSlice()}
+		conn, err := d.DialContext(ctx, network, address)
+		if err == nil {
+			o.socket.tuneConn(conn)
+		}
+		// 分配到的本地端口与已有连接冲突（EADDRINUSE）时同样换用下一个源地址，但不算作耗尽
+		if err == nil || !(isAddressExhausted(err) || errors.Is(err, syscall.EADDRINUSE)) {
+			return conn, err
+		}
+		exhausted = exhausted || isAddressExhausted(err)
+		lastErr = err
+	}
+	if !exhausted {
+		return nil, fmt.Errorf("all %d source addresses failed: %w", len(sources), lastErr)
+	}
+	o.exhausted.Add(1)
+	o.log.WithError(lastErr).Errorf("All %d source addresses exhausted.", len(sources))
+	return nil, fmt.Errorf("source addresses exhausted: %w", lastErr)
+}
+
+// control 在 bind 之前设置出站套接字选项
+func (o *outbound) control(network, address string, c syscall.RawConn) error {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil
+	}
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		if err = o.socket.setsockopt(fd, network, false); err == nil {
+			err = o.setsockopt(fd)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// listenUDP 打开 UDP ASSOCIATE 发送数据报的出站套接字，与 TCP 出站连接一样绑定网卡和防火墙标记。
+// 设置了源地址池时轮流绑定其中一个源地址，该关联只能发往与其同一地址族的目标
+func (o *outbound) listenUDP(ctx context.Context) (*net.UDPConn, error) {
+	var lc net.ListenConfig
+	if o.iface != "" || o.mark != 0 {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) { err = o.bindDevice(fd) }); cerr != nil {
+				return cerr
+			}
+			return err
+		}
+	}
+	address := ":0"
+	if len(o.sources) > 0 {
+		src := o.sources[int(o.next.Add(1)-1)%len(o.sources)]
+		address = net.JoinHostPort(src.String(), "0")
+	}
+	conn, err := lc.ListenPacket(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// candidates 从轮转位置开始返回指定地址族的源地址
+func (o *outbound) candidates(ipv4 bool) []netip.Addr {
+	start := int(o.next.Add(1) - 1)
+	var out []netip.Addr
+	for i := range o.sources {
+		src := o.sources[(start+i)%len(o.sources)]
+		if src.Is4() == ipv4 {
+			out = append(out, src)
+		}
+	}
+	return out
+}
+
+// isAddressExhausted 判断连接失败是否因为没有可用的本地地址或端口
+func isAddressExhausted(err error) bool {
+	return errors.Is(err, syscall.EADDRNOTAVAIL)
+}
@@ -0,0 +1,219 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errNoHealthyBackend = errors.New("no healthy backend available")
+	errBackendOverload  = errors.New("backend dial queue is full")
+)
+
+// OutlierPolicy 被动异常检测和熔断策略
+type OutlierPolicy struct {
+	ConsecutiveFailures int           // 连续失败多少次后摘除后端，0 表示关闭
+	BaseEjection        time.Duration // 首次摘除时长，之后每次连续摘除翻倍
+	MaxEjection         time.Duration // 摘除时长上限
+	ResetWindow         time.Duration // 连接建立后在此时间内被重置或无响应关闭视为失败，0 表示关闭
+	MaxDials            int           // 单个后端并发拨号上限，0 表示不限
+	MaxPending          int           // 等待拨号的连接上限，0 表示不限
+}
+
+// breakerState 熔断器状态
+type breakerState int32
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// backendState 单个后端的熔断状态和统计
+type backendState struct {
+	backend Backend // 由 mu 保护，地址创建后不再变化
+	policy  OutlierPolicy
+	log     *logrus.Entry
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	ejections int
+	openUntil time.Time
+	trial     bool
+
+	dials   chan struct{}
+	pending atomic.Int64
+
+	ejectionsTotal atomic.Uint64
+	overflowTotal  atomic.Uint64
+	active         atomic.Int64
+}
+
+func newBackendState(backend Backend, policy OutlierPolicy, log *logrus.Entry) *backendState {
+	b := &backendState{
+		backend: backend,
+		policy:  policy,
+		log:     log.WithField(fieldBackend, backend.String()),
+	}
+	if policy.MaxDials > 0 {
+		b.dials = make(chan struct{}, policy.MaxDials)
+	}
+	return b
+}
+
+// backendInfo 返回后端的地址、优先级和权重
+func (b *backendState) backendInfo() Backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.backend
+}
+
+// setBackend 更新服务发现得到的优先级和权重
+func (b *backendState) setBackend(backend Backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.backend = backend
+}
+
+// allow 判断后端能否接收新连接；摘除期满后转为半开状态，只放行一个试探连接
+func (b *backendState) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.openUntil) {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.trial = true
+		b.log.Info("Backend half-open, sending trial connection.")
+		return true
+	case breakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// cancelTrial 试探连接未真正发起时归还试探名额
+func (b *backendState) cancelTrial() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.trial = false
+	}
+}
+
+// acquireDial 获取拨号名额，名额已满时排队等待，排队也满时返回 errBackendOverload
+func (b *backendState) acquireDial(ctx context.Context) (func(), error) {
+	if b.dials == nil {
+		return func() {}, nil
+	}
+	release := func() { <-b.dials }
+	select {
+	case b.dials <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if n := b.pending.Add(1); b.policy.MaxPending > 0 && n > int64(b.policy.MaxPending) {
+		b.pending.Add(-1)
+		b.overflowTotal.Add(1)
+		return nil, errBackendOverload
+	}
+	defer b.pending.Add(-1)
+	select {
+	case b.dials <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// success 记录一次成功，半开状态下恢复为关闭状态
+func (b *backendState) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	if b.state == breakerHalfOpen {
+		b.state = breakerClosed
+		b.trial = false
+		b.ejections = 0
+		b.log.Info("Backend recovered, circuit closed.")
+	}
+}
+
+// failure 记录一次失败，连续失败达到阈值或半开试探失败时摘除后端
+func (b *backendState) failure(reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	threshold := b.policy.ConsecutiveFailures
+	if b.state == breakerClosed && (threshold <= 0 || b.failures < threshold) {
+		return
+	}
+	if b.state == breakerOpen {
+		return
+	}
+
+	b.ejections++
+	ejection := b.policy.BaseEjection << (b.ejections - 1)
+	if ejection <= 0 || ejection > b.policy.MaxEjection {
+		ejection = b.policy.MaxEjection
+	}
+	b.state = breakerOpen
+	b.trial = false
+	b.openUntil = time.Now().Add(ejection)
+	b.ejectionsTotal.Add(1)
+	b.log.WithField("reason", reason).Warnf("Backend ejected for %s after %d consecutive failure(s).", ejection, b.failures)
+}
+
+// watch 在连接建立后的 ResetWindow 内观察连接，返回的函数在连接过早失败时调用；
+// 观察期结束仍未失败则记为成功
+func (b *backendState) watch() func(reason string) {
+	if b.policy.ResetWindow <= 0 {
+		b.success()
+		return func(string) {}
+	}
+
+	var once sync.Once
+	timer := time.AfterFunc(b.policy.ResetWindow, func() {
+		once.Do(b.success)
+	})
+	return func(reason string) {
+		if timer.Stop() {
+			once.Do(func() { b.failure(reason) })
+		}
+	}
+}
+
+// snapshot 返回当前状态和连续失败次数
+func (b *backendState) snapshot() (breakerState, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state, b.failures
+}
@@ -0,0 +1,111 @@
+package forwarder
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestBackendState(policy OutlierPolicy) *backendState {
+	return newBackendState(Backend{Network: "tcp", Address: "127.0.0.1:1"}, policy, logrus.NewEntry(logrus.StandardLogger()))
+}
+
+// TestBackendEjection 测试连续失败摘除、半开试探和摘除时长指数增长
+func TestBackendEjection(t *testing.T) {
+	b := newTestBackendState(OutlierPolicy{
+		ConsecutiveFailures: 2,
+		BaseEjection:        time.Minute,
+		MaxEjection:         3 * time.Minute,
+	})
+	now := time.Now()
+
+	b.failure("dial")
+	if !b.allow(now) {
+		t.Fatal("Backend should stay available below the failure threshold")
+	}
+	b.failure("dial")
+	if b.allow(now) {
+		t.Fatal("Backend should be ejected")
+	}
+
+	// 摘除期满后只放行一个试探连接
+	later := b.openUntil.Add(time.Millisecond)
+	if !b.allow(later) {
+		t.Fatal("Backend should be half-open after the ejection period")
+	}
+	if b.allow(later) {
+		t.Fatal("Only one trial connection is allowed while half-open")
+	}
+
+	// 试探失败后摘除时长翻倍
+	b.failure("dial")
+	if state, _ := b.snapshot(); state != breakerOpen {
+		t.Fatalf("Expected open state, got %v", state)
+	}
+	if d := time.Until(b.openUntil); d < time.Minute+30*time.Second {
+		t.Errorf("Ejection should grow exponentially, got %v", d)
+	}
+
+	// 试探成功后恢复
+	if !b.allow(b.openUntil.Add(time.Millisecond)) {
+		t.Fatal("Backend should be half-open again")
+	}
+	b.success()
+	if state, _ := b.snapshot(); state != breakerClosed || b.ejections != 0 {
+		t.Errorf("Expected closed state after success, got %v", state)
+	}
+	if b.ejectionsTotal.Load() != 2 {
+		t.Errorf("Expected 2 ejections, got %d", b.ejectionsTotal.Load())
+	}
+}
+
+// TestBackendResetWindow 测试连接建立后很快被重置视为失败
+func TestBackendResetWindow(t *testing.T) {
+	b := newTestBackendState(OutlierPolicy{ConsecutiveFailures: 1, BaseEjection: time.Minute, MaxEjection: time.Minute, ResetWindow: time.Second})
+
+	b.watch()("reset")
+	if state, _ := b.snapshot(); state != breakerOpen {
+		t.Errorf("Early reset should eject the backend, got %v", state)
+	}
+
+	b = newTestBackendState(OutlierPolicy{ConsecutiveFailures: 1, BaseEjection: time.Minute, MaxEjection: time.Minute, ResetWindow: 10 * time.Millisecond})
+	fail := b.watch()
+	time.Sleep(50 * time.Millisecond)
+	fail("reset")
+	if state, _ := b.snapshot(); state != breakerClosed {
+		t.Errorf("Reset after the window should not count, got %v", state)
+	}
+}
+
+// TestBackendDialLimit 测试并发拨号和排队上限
+func TestBackendDialLimit(t *testing.T) {
+	b := newTestBackendState(OutlierPolicy{MaxDials: 1, MaxPending: 1})
+
+	release, err := b.acquireDial(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to acquire dial slot: %v", err)
+	}
+
+	waiting := make(chan error, 1)
+	go func() {
+		r, err := b.acquireDial(context.Background())
+		if err == nil {
+			r()
+		}
+		waiting <- err
+	}()
+	for b.pending.Load() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := b.acquireDial(context.Background()); err != errBackendOverload {
+		t.Errorf("Expected overload error, got %v", err)
+	}
+
+	release()
+	if err := <-waiting; err != nil {
+		t.Errorf("Pending dial should get the released slot: %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errNotAllowed = errors.New("destination not allowed")
+
+// proxyHandler 代理模式的规则在转发数据前与客户端握手，由客户端指定要连接的目标
+type proxyHandler interface {
+	// accept 完成握手并连接客户端请求的目标，返回到目标的连接并将目标记入 record.Backend；
+	// 请求已在握手中处理完毕（例如 UDP 转发）时返回 nil 连接和 nil 错误
+	accept(ctx context.Context, client net.Conn, record *AccessRecord, log *logrus.Entry) (net.Conn, error)
+}
+
+// newProxyHandler 根据规则模式创建代理处理器，返回的 cancel 在规则被替换或删除时关闭目标解析器
+func newProxyHandler(rule Rule, out *outbound, log *logrus.Entry) (proxyHandler, context.CancelFunc, error) {
+	timeout := out.timeout
+	allow, err := parseAllowlist(rule.Allow)
+	if err != nil {
+		return nil, nil, err
+	}
+	var creds map[string]string
+	if rule.AuthFile != "" {
+		if creds, err = loadCredentials(rule.AuthFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var handler proxyHandler
+	target := &targetDialer{allow: allow, out: out, timeout: timeout}
+	switch rule.Mode {
+	case ModeSOCKS5:
+		handler = &socks5Handler{creds: creds, target: target, timeout: timeout}
+	case ModeHTTPConnect:
+		handler = &httpConnectHandler{creds: creds, target: target, timeout: timeout}
+	case ModeLinkServer:
+		handler = &linkHandler{target: target}
+	default:
+		return nil, nil, fmt.Errorf("unknown rule mode %q", rule.Mode)
+	}
+	target.resolver = NewResolver(rule.DNSServer, rule.DNSTTL, log.WithField(fieldRule, rule.RuleName()))
+	return handler, target.resolver.Close, nil
+}
+
+// loadCredentials 读取每行一个 user:password 的认证文件，忽略空行和 # 开头的注释
+func loadCredentials(path string) (map[string]string, error) {
+	fin, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	creds := make(map[string]string)
+	scanner := bufio.NewScanner(fin)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, password, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expect user:password", path, n)
+		}
+		creds[user] = password
+	}
+	return creds, scanner.Err()
+}
+
+// checkPassword 以固定时间比较密码
+func checkPassword(creds map[string]string, user, password string) bool {
+	expected, ok := creds[user]
+	return ok && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// allowEntry 允许访问的目标：主机名（*.example.com 匹配子域名）或网段，可限定端口
+type allowEntry struct {
+	host   string
+	prefix netip.Prefix
+	port   int // 0 表示任意端口
+}
+
+// allowlist 代理模式允许访问的目标列表，为空时允许所有目标
+type allowlist []allowEntry
+
+// parseAllowlist 解析 host[:port]、*.domain[:port]、ip、cidr 或 cidr:port 形式的条目，
+// IPv6 地址带端口时写作 [2001:db8::/32]:443
+func parseAllowlist(items []string) (allowlist, error) {
+	var list allowlist
+	for _, item := range items {
+		host, port := item, ""
+		if h, p, err := net.SplitHostPort(item); err == nil {
+			host, port = h, p
+		}
+		var e allowEntry
+		if port != "" {
+			p, err := strconv.Atoi(port)
+			if err != nil || p <= 0 || p > 65535 {
+				return nil, fmt.Errorf("invalid port in allow entry %q", item)
+			}
+			e.port = p
+		}
+		if prefix, err := netip.ParsePrefix(host); err == nil {
+			e.prefix = prefix.Masked()
+		} else if addr, err := netip.ParseAddr(host); err == nil {
+			e.prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		} else if host != "" && !strings.ContainsAny(host, "/[]") {
+			e.host = strings.ToLower(strings.TrimSuffix(host, "."))
+		} else {
+			return nil, fmt.Errorf("invalid allow entry %q", item)
+		}
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+// allowName 判断主机名和端口是否允许访问
+func (a allowlist) allowName(host string, port int) bool {
+	if len(a) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, e := range a {
+		if e.host == "" || (e.port != 0 && e.port != port) {
+			continue
+		}
+		if e.host == host || (strings.HasPrefix(e.host, "*.") && strings.HasSuffix(host, e.host[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowIP 判断地址和端口是否允许访问
+func (a allowlist) allowIP(ip net.IP, port int) bool {
+	if len(a) == 0 {
+		return true
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, e := range a {
+		if e.prefix.IsValid() && (e.port == 0 || e.port == port) && e.prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// targetDialer 连接代理客户端指定的目标。主机名在允许列表中时可以连接其所有地址，
+// 否则只连接解析结果中位于允许网段内的地址，避免借助域名绕过网段限制。
+type targetDialer struct {
+	allow    allowlist
+	resolver *Resolver
+	out      *outbound
+	timeout  time.Duration
+}
+
+// resolve 解析目标并返回允许连接的地址和端口
+func (d *targetDialer) resolve(ctx context.Context, target string) ([]net.IP, int, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, 0, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if !d.allow.allowIP(ip, port) {
+			return nil, 0, errNotAllowed
+		}
+		return []net.IP{ip}, port, nil
+	}
+
+	nameAllowed := d.allow.allowName(host, port)
+	if !nameAllowed && !d.hasPrefixes() {
+		return nil, 0, errNotAllowed
+	}
+	addrs, err := d.resolver.Lookup(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	if nameAllowed {
+		return addrs, port, nil
+	}
+	var allowed []net.IP
+	for _, ip := range addrs {
+		if d.allow.allowIP(ip, port) {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, 0, errNotAllowed
+	}
+	return allowed, port, nil
+}
+
+// hasPrefixes 判断允许列表中是否有网段条目
+func (d *targetDialer) hasPrefixes() bool {
+	for _, e := range d.allow {
+		if e.prefix.IsValid() {
+			return true
+		}
+	}
+	return false
+}
+
+// dial 连接目标
+func (d *targetDialer) dial(ctx context.Context, target string) (net.Conn, error) {
+	addrs, port, err := d.resolve(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return dialHappyEyeballs(ctx, d.out, addrs, strconv.Itoa(port))
+}
+
+// resolveUDP 解析 UDP 目标，返回第一个允许的地址
+func (d *targetDialer) resolveUDP(ctx context.Context, target string) (*net.UDPAddr, error) {
+	addrs, port, err := d.resolve(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: addrs[0], Port: port}, nil
+}
@@ -0,0 +1,328 @@
+package forwarder
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// minDNSTTL 缓存时间下限，避免 TTL 为 0 的记录导致每次连接都查询
+	minDNSTTL = time.Second
+	// happyEyeballsDelay 两次连接尝试之间的间隔（RFC 8305 Connection Attempt Delay）
+	happyEyeballsDelay = 250 * time.Millisecond
+)
+
+// Resolver 带缓存的域名解析器。指定 DNS 服务器时直接查询并遵循记录的 TTL，
+// 否则使用系统解析器并按固定时间缓存。缓存条目到期时若仍在使用则在后台刷新。
+type Resolver struct {
+	server string
+	ttl    time.Duration
+	log    *logrus.Entry
+
+	mu      sync.Mutex
+	cache   map[string]*dnsEntry
+	closed  bool
+	lookups atomic.Uint64
+}
+
+// dnsEntry 一个域名的缓存结果
+type dnsEntry struct {
+	mu      sync.RWMutex
+	addrs   []net.IP
+	expires time.Time
+	err     error
+	ready   chan struct{}
+	once    sync.Once
+
+	used  atomic.Bool
+	next  atomic.Uint32
+	timer *time.Timer // 由 Resolver.mu 保护
+}
+
+// NewResolver 创建解析器，server 为空时使用系统解析器，ttl 为系统解析结果的缓存时间，log 为空时丢弃日志
+func NewResolver(server string, ttl time.Duration, log *logrus.Entry) *Resolver {
+	if ttl < minDNSTTL {
+		ttl = minDNSTTL
+	}
+	if log == nil {
+		log = logrus.NewEntry(discardLogger())
+	}
+	return &Resolver{
+		server: normalizeDNSServer(server),
+		ttl:    ttl,
+		log:    log,
+		cache:  make(map[string]*dnsEntry),
+	}
+}
+
+// normalizeDNSServer 为未指定端口的 DNS 服务器地址补上 53 端口
+func normalizeDNSServer(server string) string {
+	if server == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(strings.Trim(server, "[]"), "53")
+	}
+	return server
+}
+
+// Lookup 返回域名的全部地址，每次调用轮换起始地址以便将连接分散到所有记录上
+func (r *Resolver) Lookup(ctx context.Context, host string) ([]net.IP, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		// 规则已被替换，仍在使用旧运行状态的连接直接解析，不再缓存和刷新
+		addrs, _, err := r.resolve(ctx, host)
+		return addrs, err
+	}
+	entry, ok := r.cache[host]
+	if !ok {
+		entry = &dnsEntry{ready: make(chan struct{})}
+		r.cache[host] = entry
+		r.mu.Unlock()
+		r.refresh(host, entry)
+	} else {
+		r.mu.Unlock()
+	}
+
+	select {
+	case <-entry.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	entry.used.Store(true)
+
+	entry.mu.RLock()
+	addrs, err := entry.addrs, entry.err
+	expired := time.Now().After(entry.expires)
+	entry.mu.RUnlock()
+	if expired && len(addrs) == 0 {
+		// 上次解析失败且已过期，同步重试一次
+		r.refresh(host, entry)
+		entry.mu.RLock()
+		addrs, err = entry.addrs, entry.err
+		entry.mu.RUnlock()
+	}
+	if len(addrs) == 0 {
+		if err == nil {
+			err = errDNSNotFound
+		}
+		return nil, err
+	}
+
+	start := int(entry.next.Add(1)-1) % len(addrs)
+	rotated := make([]net.IP, 0, len(addrs))
+	rotated = append(rotated, addrs[start:]...)
+	return append(rotated, addrs[:start]...), nil
+}
+
+// refresh 解析域名并更新缓存条目，解析失败时保留旧结果；到期时若条目在上个周期被使用过则再次刷新
+func (r *Resolver) refresh(host string, entry *dnsEntry) {
+	r.lookups.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	addrs, ttl, err := r.resolve(ctx, host)
+	cancel()
+
+	entry.mu.Lock()
+	if err == nil {
+		entry.addrs = addrs
+		entry.err = nil
+	} else {
+		entry.err = err
+		if len(entry.addrs) > 0 {
+			r.log.WithError(err).WithField("host", host).Warn("DNS refresh failed, keeping stale addresses.")
+		}
+		ttl = minDNSTTL
+	}
+	entry.expires = time.Now().Add(ttl)
+	entry.mu.Unlock()
+	entry.once.Do(func() { close(entry.ready) })
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if entry.timer != nil {
+		entry.timer.Stop()
+	}
+	entry.timer = time.AfterFunc(ttl, func() {
+		if !entry.used.Swap(false) {
+			// 一个周期内未被使用，移出缓存
+			r.mu.Lock()
+			if r.cache[host] == entry {
+				delete(r.cache, host)
+			}
+			r.mu.Unlock()
+			return
+		}
+		r.refresh(host, entry)
+	})
+}
+
+// resolve 查询 A 和 AAAA 记录，返回地址和缓存时间
+func (r *Resolver) resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if r.server == "" {
+		ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, 0, err
+		}
+		addrs := make([]net.IP, len(ipAddrs))
+		for i, a := range ipAddrs {
+			addrs[i] = a.IP
+		}
+		return addrs, r.ttl, nil
+	}
+
+	type answer struct {
+		records []dnsRecord
+		err     error
+	}
+	answers := make(chan answer, 2)
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		go func(qtype uint16) {
+			records, err := dnsQuery(ctx, r.server, host, qtype)
+			answers <- answer{records, err}
+		}(qtype)
+	}
+
+	var addrs []net.IP
+	var ttl time.Duration
+	var lastErr error
+	for i := 0; i < 2; i++ {
+		a := <-answers
+		if a.err != nil {
+			lastErr = a.err
+			continue
+		}
+		for _, rec := range a.records {
+			if rec.IP == nil {
+				continue
+			}
+			addrs = append(addrs, rec.IP)
+			if ttl == 0 || rec.TTL < ttl {
+				ttl = rec.TTL
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		if lastErr == nil {
+			lastErr = errDNSNotFound
+		}
+		return nil, 0, lastErr
+	}
+	return addrs, max(ttl, minDNSTTL), nil
+}
+
+// Close 停止所有后台刷新并清空缓存，之后的查询不再缓存
+func (r *Resolver) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for _, entry := range r.cache {
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+	}
+	clear(r.cache)
+}
+
+// interleaveFamilies 按 RFC 8305 交替排列 IPv6 和 IPv4 地址，以首个地址的协议族开头
+func interleaveFamilies(addrs []net.IP) []net.IP {
+	if len(addrs) == 0 {
+		return addrs
+	}
+	var first, second []net.IP
+	firstIs4 := addrs[0].To4() != nil
+	for _, ip := range addrs {
+		if (ip.To4() != nil) == firstIs4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	out := make([]net.IP, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// contextDialer 建立出站连接，*net.Dialer 和规则的 outbound 都实现了该接口
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// dialHappyEyeballs 按顺序错开发起连接尝试，前一个尝试失败或超过间隔仍未成功时发起下一个，
+// 返回最先建立的连接
+func dialHappyEyeballs(ctx context.Context, dialer contextDialer, addrs []net.IP, port string) (net.Conn, error) {
+	addrs = interleaveFamilies(addrs)
+	if len(addrs) == 1 {
+		return dialer.DialContext(ctx, "tcp", net.JoinHostPort(addrs[0].String(), port))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	launch := func(ip net.IP) {
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+			results <- result{conn, err}
+		}()
+	}
+
+	launch(addrs[0])
+	launched, pending := 1, 1
+	delay := time.NewTimer(happyEyeballsDelay)
+	defer delay.Stop()
+
+	var lastErr error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// 关闭其余可能晚到的成功连接
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			lastErr = res.err
+			if launched < len(addrs) {
+				launch(addrs[launched])
+				launched++
+				pending++
+				delay.Reset(happyEyeballsDelay)
+			}
+		case <-delay.C:
+			if launched < len(addrs) {
+				launch(addrs[launched])
+				launched++
+				pending++
+				delay.Reset(happyEyeballsDelay)
+			}
+		}
+	}
+	return nil, lastErr
+}
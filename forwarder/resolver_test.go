@@ -0,0 +1,184 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubDNSServer 本地 DNS 桩服务器，按名字和类型返回预设记录
+type stubDNSServer struct {
+	conn    net.PacketConn
+	mu      sync.Mutex
+	records map[string][]dnsRecord
+	queries atomic.Int64
+}
+
+func newStubDNSServer(t *testing.T) *stubDNSServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := &stubDNSServer{conn: conn, records: make(map[string][]dnsRecord)}
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *stubDNSServer) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *stubDNSServer) set(name string, records ...dnsRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[name] = records
+}
+
+func (s *stubDNSServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.queries.Add(1)
+		query := buf[:n]
+		name, off, err := readDNSName(query, 12)
+		if err != nil {
+			continue
+		}
+		qtype := binary.BigEndian.Uint16(query[off:])
+
+		s.mu.Lock()
+		var answers []dnsRecord
+		for _, rec := range s.records[name] {
+			if rec.Type == qtype {
+				answers = append(answers, rec)
+			}
+		}
+		s.mu.Unlock()
+
+		resp := append([]byte(nil), query[:off+4]...)
+		binary.BigEndian.PutUint16(resp[2:], 1<<15|1<<8|1<<7)
+		binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+		for _, rec := range answers {
+			resp = binary.BigEndian.AppendUint16(resp, 0xc00c) // 指向问题中的名字
+			resp = binary.BigEndian.AppendUint16(resp, rec.Type)
+			resp = binary.BigEndian.AppendUint16(resp, dnsClassIN)
+			resp = binary.BigEndian.AppendUint32(resp, uint32(rec.TTL/time.Second))
+			var rdata []byte
+			switch rec.Type {
+			case dnsTypeA:
+				rdata = rec.IP.To4()
+			case dnsTypeAAAA:
+				rdata = rec.IP.To16()
+			case dnsTypeSRV:
+				rdata = binary.BigEndian.AppendUint16(rdata, rec.Priority)
+				rdata = binary.BigEndian.AppendUint16(rdata, rec.Weight)
+				rdata = binary.BigEndian.AppendUint16(rdata, rec.Port)
+				rdata, _ = appendDNSName(rdata, rec.Target)
+			}
+			resp = binary.BigEndian.AppendUint16(resp, uint16(len(rdata)))
+			resp = append(resp, rdata...)
+		}
+		s.conn.WriteTo(resp, addr)
+	}
+}
+
+// TestResolverLookup 测试解析 A/AAAA 记录并在各地址间轮换
+func TestResolverLookup(t *testing.T) {
+	dns := newStubDNSServer(t)
+	dns.set("backend.test",
+		dnsRecord{Type: dnsTypeA, TTL: time.Minute, IP: net.ParseIP("10.0.0.1")},
+		dnsRecord{Type: dnsTypeA, TTL: time.Minute, IP: net.ParseIP("10.0.0.2")},
+		dnsRecord{Type: dnsTypeAAAA, TTL: time.Minute, IP: net.ParseIP("fd00::1")},
+	)
+	r := NewResolver(dns.addr(), 0, nil)
+	defer r.Close()
+
+	firsts := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		addrs, err := r.Lookup(context.Background(), "backend.test")
+		if err != nil {
+			t.Fatalf("Lookup failed: %v", err)
+		}
+		if len(addrs) != 3 {
+			t.Fatalf("Expected 3 addresses, got %v", addrs)
+		}
+		firsts[addrs[0].String()] = true
+	}
+	if len(firsts) != 3 {
+		t.Errorf("Lookups should rotate across all records, got %v", firsts)
+	}
+	if q := dns.queries.Load(); q != 2 {
+		t.Errorf("Expected answers to be cached, got %d queries", q)
+	}
+
+	if _, err := r.Lookup(context.Background(), "missing.test"); err == nil {
+		t.Error("Expected lookup of a missing name to fail")
+	}
+}
+
+// TestResolverRefresh 测试按 TTL 在后台刷新仍在使用的条目
+func TestResolverRefresh(t *testing.T) {
+	dns := newStubDNSServer(t)
+	dns.set("backend.test", dnsRecord{Type: dnsTypeA, TTL: time.Second, IP: net.ParseIP("10.0.0.1")})
+	r := NewResolver(dns.addr(), 0, nil)
+	defer r.Close()
+
+	if _, err := r.Lookup(context.Background(), "backend.test"); err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	dns.set("backend.test", dnsRecord{Type: dnsTypeA, TTL: time.Second, IP: net.ParseIP("10.0.0.9")})
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		addrs, err := r.Lookup(context.Background(), "backend.test")
+		if err == nil && addrs[0].Equal(net.ParseIP("10.0.0.9")) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("Cached entry was not refreshed after its TTL")
+}
+
+// TestInterleaveFamilies 测试交替排列两个协议族的地址
+func TestInterleaveFamilies(t *testing.T) {
+	addrs := []net.IP{
+		net.ParseIP("fd00::1"), net.ParseIP("fd00::2"),
+		net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"),
+	}
+	got := interleaveFamilies(addrs)
+	want := []string{"fd00::1", "10.0.0.1", "fd00::2", "10.0.0.2"}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Fatalf("Expected %v, got %v", want, got)
+		}
+	}
+}
+
+// TestDialHappyEyeballs 测试首个地址不可用时回退到下一个地址
+func TestDialHappyEyeballs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// 127.0.0.2 上没有监听者，连接会被拒绝
+	addrs := []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")}
+	conn, err := dialHappyEyeballs(context.Background(), &net.Dialer{Timeout: time.Second}, addrs, port)
+	if err != nil {
+		t.Fatalf("Happy eyeballs dial failed: %v", err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().(*net.TCPAddr).IP.String() != "127.0.0.1" {
+		t.Errorf("Unexpected remote address %v", conn.RemoteAddr())
+	}
+}
@@ -0,0 +1,594 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 反向隧道协议。代理端主动连接服务端的 reverse-server 规则，双方以文本行通信：
+//
+//	agent  -> server: TFAGENT/1 CONTROL <service>
+//	server -> agent:  CHALLENGE <nonce>
+//	agent  -> server: AUTH <hex(HMAC-SHA256(token, nonce + " " + service))> <agent nonce>
+//	server -> agent:  OK <hex(HMAC-SHA256(token, nonce + " " + agent nonce + " server " + service))> 或 ERR <reason>
+//	server -> agent:  OPEN <id> <client>   有客户端连接公开端口，请求一条数据连接
+//	server -> agent:  PING                 心跳，代理端回复 PONG
+//	agent  -> server: TFAGENT/1 DATA <id> <hex(HMAC-SHA256(token, "data " + id))>
+//	                                       新建的数据连接，之后的字节属于对应的隧道
+//
+// 控制连接不加密，id 可能被旁观者看到，数据连接须以令牌对 id 的 HMAC 证明来自代理端
+const (
+	agentProtocol   = "TFAGENT/1"
+	agentHeartbeat  = 10 * time.Second
+	agentMaxLine    = 512
+	agentBackoffMin = time.Second
+	agentBackoffMax = 30 * time.Second
+)
+
+// closeSpliced 反向隧道的数据连接交给公开端口的隧道使用后结束，详细信息记录在该隧道的访问日志中
+const closeSpliced = "spliced"
+
+var errNoAgent = errors.New("no agent connected")
+
+// agentRegistry 已连接的代理端及等待中的数据连接，同一服务可以有多个代理端，按轮询选择
+type agentRegistry struct {
+	mu       sync.Mutex
+	sessions map[string][]*agentSession
+	pending  map[string]*pendingData
+	next     atomic.Uint64
+}
+
+// pendingData 等待代理端建立的数据连接
+type pendingData struct {
+	service string
+	ch      chan net.Conn
+}
+
+func newAgentRegistry() *agentRegistry {
+	return &agentRegistry{
+		sessions: make(map[string][]*agentSession),
+		pending:  make(map[string]*pendingData),
+	}
+}
+
+func (r *agentRegistry) add(s *agentSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s.service] = append(r.sessions[s.service], s)
+}
+
+func (r *agentRegistry) remove(s *agentSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessions := r.sessions[s.service]
+	for i, other := range sessions {
+		if other == s {
+			sessions = append(sessions[:i:i], sessions[i+1:]...)
+			break
+		}
+	}
+	if len(sessions) == 0 {
+		delete(r.sessions, s.service)
+	} else {
+		r.sessions[s.service] = sessions
+	}
+}
+
+// pick 按轮询选择服务的一个代理端，没有代理端时返回 nil
+func (r *agentRegistry) pick(service string) *agentSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessions := r.sessions[service]
+	if len(sessions) == 0 {
+		return nil
+	}
+	return sessions[r.next.Add(1)%uint64(len(sessions))]
+}
+
+// expect 登记一条等待中的数据连接，返回其标识和接收连接的通道
+func (r *agentRegistry) expect(service string) (string, chan net.Conn) {
+	id := agentNonce()
+	ch := make(chan net.Conn, 1)
+	r.mu.Lock()
+	r.pending[id] = &pendingData{service: service, ch: ch}
+	r.mu.Unlock()
+	return id, ch
+}
+
+// cancel 放弃等待数据连接，连接已送达时返回 false
+func (r *agentRegistry) cancel(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.pending[id]; !ok {
+		return false
+	}
+	delete(r.pending, id)
+	return true
+}
+
+// deliver 将数据连接交给等待者，标识未知或已过期时返回 false
+func (r *agentRegistry) deliver(id string, conn net.Conn) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.pending[id]
+	if !ok {
+		return "", false
+	}
+	delete(r.pending, id)
+	p.ch <- conn
+	return p.service, true
+}
+
+// agentSession 服务端上一个代理端的控制连接
+type agentSession struct {
+	service string
+	remote  string
+	conn    net.Conn
+	timeout time.Duration
+	mu      sync.Mutex // 串行化控制连接上的写入
+}
+
+// send 在控制连接上发送一行消息
+func (s *agentSession) send(line string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	_, err := io.WriteString(s.conn, line+"\n")
+	return err
+}
+
+func (s *agentSession) String() string {
+	return s.service + "@" + s.remote
+}
+
+// newReverseHandler 创建反向隧道规则的处理器：reverse-server 规则接收代理端的控制连接和数据连接，
+// 公开端口规则请求代理端建立数据连接
+func (f *Forwarder) newReverseHandler(rule Rule) (proxyHandler, error) {
+	if rule.Mode == ModeReverse {
+		return &reverseHandler{service: rule.Service, agents: f.agents, timeout: f.opts.Timeout}, nil
+	}
+	token, err := loadToken(rule.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	return &agentServer{token: token, agents: f.agents, timeout: f.opts.Timeout, stopCtx: f.conns.acceptCtx}, nil
+}
+
+// agentServer reverse-server 规则的处理器
+type agentServer struct {
+	token   []byte
+	agents  *agentRegistry
+	timeout time.Duration
+	stopCtx context.Context // 停止接收新连接时断开所有控制连接
+}
+
+func (h *agentServer) accept(ctx context.Context, client net.Conn, record *AccessRecord, log *logrus.Entry) (net.Conn, error) {
+	line, err := readAgentLine(client)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[0] != agentProtocol {
+		return nil, fmt.Errorf("invalid agent greeting %q", line)
+	}
+	switch fields[1] {
+	case "CONTROL":
+		if len(fields) == 3 {
+			return nil, h.control(ctx, client, fields[2], record, log)
+		}
+	case "DATA":
+		if len(fields) == 4 {
+			return nil, h.data(client, fields[2], fields[3], record)
+		}
+	default:
+		return nil, fmt.Errorf("unknown agent command %q", fields[1])
+	}
+	return nil, fmt.Errorf("invalid agent greeting %q", line)
+}
+
+// control 认证代理端并保持控制连接，期间定时发送心跳，代理端断开、心跳超时或停止服务时结束
+func (h *agentServer) control(ctx context.Context, client net.Conn, service string, record *AccessRecord, log *logrus.Entry) error {
+	record.Backend = agentPrefix + service
+	if err := verifyChallenge(client, h.token, service); err != nil {
+		return fmt.Errorf("agent for service %q: %w", service, err)
+	}
+
+	s := &agentSession{service: service, remote: record.Client, conn: client, timeout: h.timeout}
+	h.agents.add(s)
+	defer h.agents.remove(s)
+	log.Infof("Agent for service %s connected.", service)
+
+	// 会话的生命周期由控制连接决定，代理端只会回复 PONG
+	client.SetDeadline(time.Time{})
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			client.SetReadDeadline(time.Now().Add(3 * agentHeartbeat))
+			if _, err := readAgentLine(client); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(agentHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case err := <-readErr:
+			var netErr net.Error
+			switch {
+			case errors.Is(err, io.EOF):
+				record.CloseReason = closeClientEOF
+			case errors.As(err, &netErr) && netErr.Timeout():
+				record.CloseReason = closeIdleTimeout
+			default:
+				record.CloseReason = closeError
+			}
+			return nil
+		case <-heartbeat.C:
+			if err := s.send("PING"); err != nil {
+				client.Close()
+				return err
+			}
+		case <-ctx.Done():
+			record.CloseReason = closeShutdown
+			client.Close()
+			return nil
+		case <-h.stopCtx.Done():
+			record.CloseReason = closeShutdown
+			client.Close()
+			return nil
+		}
+	}
+}
+
+// data 校验数据连接对 id 的证明后将其交给等待它的公开端口隧道，直到该隧道用完并关闭连接
+func (h *agentServer) data(client net.Conn, id, mac string, record *AccessRecord) error {
+	if !hmac.Equal([]byte(mac), []byte(dataMAC(h.token, id))) {
+		return fmt.Errorf("data connection %q failed authentication", id)
+	}
+	conn := &splicedConn{Conn: client, released: make(chan struct{})}
+	service, ok := h.agents.deliver(id, conn)
+	if !ok {
+		return fmt.Errorf("unknown data connection %q", id)
+	}
+	record.Backend = agentPrefix + service
+	<-conn.released
+	record.CloseReason = closeSpliced
+	return nil
+}
+
+// splicedConn 交给公开端口隧道的数据连接，关闭时通知接收它的规则
+type splicedConn struct {
+	net.Conn
+	once     sync.Once
+	released chan struct{}
+}
+
+func (c *splicedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.released) })
+	return err
+}
+
+func (c *splicedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// reverseHandler 公开端口规则的处理器，通过控制连接请求代理端建立数据连接
+type reverseHandler struct {
+	service string
+	agents  *agentRegistry
+	timeout time.Duration
+}
+
+func (h *reverseHandler) accept(ctx context.Context, client net.Conn, record *AccessRecord, log *logrus.Entry) (net.Conn, error) {
+	s := h.agents.pick(h.service)
+	if s == nil {
+		return nil, fmt.Errorf("%w for service %q", errNoAgent, h.service)
+	}
+	record.Backend = s.String()
+
+	id, ch := h.agents.expect(h.service)
+	if err := s.send("OPEN " + id + " " + record.Client); err != nil {
+		h.agents.cancel(id)
+		return nil, err
+	}
+	timer := time.NewTimer(h.timeout)
+	defer timer.Stop()
+	select {
+	case conn := <-ch:
+		return conn, nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	if !h.agents.cancel(id) {
+		// 数据连接恰好在超时时送达
+		return <-ch, nil
+	}
+	return nil, fmt.Errorf("agent %s did not open a data connection in time", s)
+}
+
+// agentListener 代理端规则的监听器：保持到服务端的控制连接，按服务端的请求建立数据连接，
+// 作为新连接交给规则的接收循环，再由规则的后端池连接本地目标
+type agentListener struct {
+	server  string
+	service string
+	token   []byte
+	timeout time.Duration
+	log     *logrus.Entry
+	conns   chan net.Conn
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// listenAgent 创建代理端规则的监听器，在后台连接服务端，断开后按指数退避重连
+func (f *Forwarder) listenAgent(rule Rule) (net.Listener, error) {
+	token, err := loadToken(rule.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &agentListener{
+		server:  rule.ReverseServer,
+		service: rule.Service,
+		token:   token,
+		timeout: f.opts.Timeout,
+		log:     f.log.WithField(fieldRule, rule.RuleName()),
+		conns:   make(chan net.Conn),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	go l.run()
+	return l, nil
+}
+
+func (l *agentListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// Close 断开控制连接并停止重连，已建立的数据连接不受影响
+func (l *agentListener) Close() error {
+	l.cancel()
+	return nil
+}
+
+func (l *agentListener) Addr() net.Addr {
+	return agentAddr(l.server)
+}
+
+// run 保持控制连接，连接成功过的会话断开后从最短的退避时间重新开始
+func (l *agentListener) run() {
+	backoff := agentBackoffMin
+	for {
+		connected, err := l.session()
+		if l.ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = agentBackoffMin
+		}
+		l.log.WithError(err).Warnf("Reverse tunnel to %s lost, reconnecting in %s.", l.server, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-l.ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, agentBackoffMax)
+	}
+}
+
+// session 建立并认证控制连接，之后处理服务端的消息直到连接断开，返回是否认证成功过
+func (l *agentListener) session() (bool, error) {
+	conn, err := l.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(l.ctx, func() { conn.Close() })
+	defer stop()
+
+	conn.SetDeadline(time.Now().Add(l.timeout))
+	if _, err := io.WriteString(conn, agentProtocol+" CONTROL "+l.service+"\n"); err != nil {
+		return false, err
+	}
+	if err := answerChallenge(conn, l.token, l.service); err != nil {
+		return false, err
+	}
+	l.log.Infof("Connected to reverse tunnel server %s.", l.server)
+
+	// 服务端定时发送心跳，长时间收不到消息视为连接已断开
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * agentHeartbeat))
+		line, err := readAgentLine(conn)
+		if err != nil {
+			return true, err
+		}
+		fields := strings.Fields(line)
+		switch {
+		case line == "PING":
+			conn.SetWriteDeadline(time.Now().Add(l.timeout))
+			if _, err := io.WriteString(conn, "PONG\n"); err != nil {
+				return true, err
+			}
+		case len(fields) == 3 && fields[0] == "OPEN":
+			go l.open(fields[1], fields[2])
+		default:
+			return true, fmt.Errorf("unexpected server message %q", line)
+		}
+	}
+}
+
+// open 为服务端的请求建立数据连接，并作为新连接交给接收循环
+func (l *agentListener) open(id, client string) {
+	conn, err := l.dial()
+	if err != nil {
+		l.log.WithError(err).Warn("Failed to open reverse tunnel data connection.")
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(l.timeout))
+	if _, err := io.WriteString(conn, agentProtocol+" DATA "+id+" "+dataMAC(l.token, id)+"\n"); err != nil {
+		l.log.WithError(err).Warn("Failed to open reverse tunnel data connection.")
+		conn.Close()
+		return
+	}
+	conn.SetWriteDeadline(time.Time{})
+	select {
+	case l.conns <- &agentConn{Conn: conn, client: agentAddr(client)}:
+	case <-l.ctx.Done():
+		conn.Close()
+	}
+}
+
+func (l *agentListener) dial() (net.Conn, error) {
+	d := net.Dialer{Timeout: l.timeout}
+	return d.DialContext(l.ctx, "tcp", l.server)
+}
+
+// agentConn 代理端的数据连接，对端地址为连接服务端公开端口的客户端
+type agentConn struct {
+	net.Conn
+	client net.Addr
+}
+
+func (c *agentConn) RemoteAddr() net.Addr {
+	return c.client
+}
+
+func (c *agentConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// agentAddr 以字符串表示的对端地址
+type agentAddr string
+
+func (a agentAddr) Network() string { return "tcp" }
+func (a agentAddr) String() string  { return string(a) }
+
+// closeWrite 关闭连接的写方向
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errHalfCloseUnsupported
+}
+
+// readAgentLine 逐字节读取一行，避免多读属于隧道的数据
+func readAgentLine(r io.Reader) (string, error) {
+	var line []byte
+	var b [1]byte
+	for len(line) < agentMaxLine {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errors.New("agent message too long")
+}
+
+// loadToken 读取共享令牌文件，忽略首尾空白
+func loadToken(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	token := []byte(strings.TrimSpace(string(b)))
+	if len(token) == 0 {
+		return nil, fmt.Errorf("%s: empty token", path)
+	}
+	return token, nil
+}
+
+// verifyChallenge 向对端发送随机挑战并校验其应答，证明对端持有共享令牌而不在网络上传输令牌，
+// 认证通过后以对端挑战的应答证明本端同样持有令牌。subject 标明认证的用途，防止一种用途的应答被重放到另一种用途
+func verifyChallenge(conn net.Conn, token []byte, subject string) error {
+	nonce := agentNonce()
+	if _, err := io.WriteString(conn, "CHALLENGE "+nonce+"\n"); err != nil {
+		return err
+	}
+	line, err := readAgentLine(conn)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "AUTH" || !hmac.Equal([]byte(fields[1]), []byte(agentMAC(token, nonce, subject))) {
+		io.WriteString(conn, "ERR authentication failed\n")
+		return errors.New("authentication failed")
+	}
+	_, err = io.WriteString(conn, "OK "+serverMAC(token, nonce, fields[2], subject)+"\n")
+	return err
+}
+
+// answerChallenge 应答对端的挑战并附上本端的挑战，对端须以应答证明持有令牌，否则不使用该连接
+func answerChallenge(conn net.Conn, token []byte, subject string) error {
+	line, err := readAgentLine(conn)
+	if err != nil {
+		return err
+	}
+	nonce, ok := strings.CutPrefix(line, "CHALLENGE ")
+	if !ok {
+		return fmt.Errorf("unexpected reply %q", line)
+	}
+	own := agentNonce()
+	if _, err := io.WriteString(conn, "AUTH "+agentMAC(token, nonce, subject)+" "+own+"\n"); err != nil {
+		return err
+	}
+	if line, err = readAgentLine(conn); err != nil {
+		return err
+	}
+	proof, ok := strings.CutPrefix(line, "OK ")
+	if !ok && line != "OK" {
+		return fmt.Errorf("rejected by peer: %s", strings.TrimPrefix(line, "ERR "))
+	}
+	if !hmac.Equal([]byte(proof), []byte(serverMAC(token, nonce, own, subject))) {
+		return errors.New("peer failed to prove the shared token")
+	}
+	return nil
+}
+
+// agentMAC 计算对挑战的应答
+func agentMAC(token []byte, nonce, subject string) string {
+	mac := hmac.New(sha256.New, token)
+	io.WriteString(mac, nonce+" "+subject)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// serverMAC 计算服务端对双方挑战的应答，与 agentMAC 使用不同的输入，客户端的应答不能被反射回来充当服务端的证明
+func serverMAC(token []byte, nonce, peerNonce, subject string) string {
+	return agentMAC(token, nonce+" "+peerNonce, "server "+subject)
+}
+
+// dataMAC 计算数据连接对 id 的证明，输入以 "data" 开头，不会与以随机挑战开头的应答相同
+func dataMAC(token []byte, id string) string {
+	return agentMAC(token, "data", id)
+}
+
+// agentNonce 返回 128 位的随机标识
+func agentNonce() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
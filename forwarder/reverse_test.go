@@ -0,0 +1,132 @@
+package forwarder
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReverseTunnel 测试代理端注册服务后，连接服务端公开端口的客户端经反向隧道到达代理端的后端
+func TestReverseTunnel(t *testing.T) {
+	dir := t.TempDir()
+	token := filepath.Join(dir, "agent.token")
+	os.WriteFile(token, []byte("s3cret\n"), 0600)
+	public := filepath.Join(dir, "public.sock")
+
+	server := startForwarder(t,
+		Rule{Name: "agents", Mode: ModeReverseServer, TokenFile: token},
+		Rule{Name: "public", LocalUnix: public, Mode: ModeReverse, Service: "web"},
+	)
+	control := server.Stats().Rules[0].Listen
+	_, port, _ := net.SplitHostPort(control)
+
+	echo := echoServer(t)
+	startForwarder(t, Rule{ReverseServer: net.JoinHostPort("127.0.0.1", port), Service: "web", TokenFile: token, Backends: []Backend{echo}})
+	deadline := time.Now().Add(5 * time.Second)
+	for server.agents.pick("web") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Agent did not connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("unix", public)
+		if err != nil {
+			t.Fatalf("Failed to dial public port: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("Expected echo through reverse tunnel, got %q, %v", buf, err)
+		}
+		conn.Close()
+	}
+
+	// 只知道 id 而不能证明持有令牌的数据连接被拒绝，id 仍然有效
+	id, ch := server.agents.expect("web")
+	for _, mac := range []string{"", agentMAC([]byte("wrong"), "data", id)} {
+		forged, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+		if err != nil {
+			t.Fatalf("Failed to dial control port: %v", err)
+		}
+		forged.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(forged, strings.TrimSpace(agentProtocol+" DATA "+id+" "+mac)+"\n")
+		if _, err := forged.Read(make([]byte, 1)); err == nil {
+			t.Error("Expected forged data connection to be closed")
+		}
+		forged.Close()
+	}
+	select {
+	case conn := <-ch:
+		conn.Close()
+		t.Error("Forged data connection was delivered")
+	default:
+	}
+	if !server.agents.cancel(id) {
+		t.Error("Expected the data connection id to remain pending")
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("Failed to dial control port: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, agentProtocol+" CONTROL web\n")
+	line, err := readAgentLine(conn)
+	if err != nil {
+		t.Fatalf("Failed to read challenge: %v", err)
+	}
+	nonce := line[len("CHALLENGE "):]
+	io.WriteString(conn, "AUTH "+agentMAC([]byte("wrong"), nonce, "web")+" "+agentNonce()+"\n")
+	if line, _ := readAgentLine(conn); line != "ERR authentication failed" {
+		t.Errorf("Expected authentication failure, got %q", line)
+	}
+}
+
+// TestChallengeMutual 测试挑战双向认证：双方持有同一令牌时都通过，服务端不能证明持有令牌时客户端拒绝连接
+func TestChallengeMutual(t *testing.T) {
+	run := func(serve func(conn net.Conn)) error {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			defer server.Close()
+			serve(server)
+		}()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		return answerChallenge(client, []byte("s3cret"), "web")
+	}
+
+	if err := run(func(conn net.Conn) { verifyChallenge(conn, []byte("s3cret"), "web") }); err != nil {
+		t.Errorf("Expected mutual authentication to succeed, got %v", err)
+	}
+
+	// 冒充的服务端不知道令牌，只能原样接受应答后回复伪造的证明
+	err := run(func(conn net.Conn) {
+		io.WriteString(conn, "CHALLENGE "+agentNonce()+"\n")
+		line, _ := readAgentLine(conn)
+		fields := strings.Fields(line)
+		if len(fields) == 3 {
+			io.WriteString(conn, "OK "+agentMAC([]byte("guess"), fields[2], "web")+"\n")
+		}
+	})
+	if err == nil || !strings.Contains(err.Error(), "prove") {
+		t.Errorf("Expected impostor server to be rejected, got %v", err)
+	}
+
+	// 服务端只回复 OK 而不附证明时同样拒绝
+	err = run(func(conn net.Conn) {
+		io.WriteString(conn, "CHALLENGE "+agentNonce()+"\n")
+		readAgentLine(conn)
+		io.WriteString(conn, "OK\n")
+	})
+	if err == nil || !strings.Contains(err.Error(), "prove") {
+		t.Errorf("Expected a server without proof to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,340 @@
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// 加密隧道协议。加密端（encrypt 规则连接后端时）与解密端（decrypt 规则接收客户端时）握手：
+//
+//	client -> server: "TFSEC/1\n" | len(id) | id | 客户端临时公钥(32)
+//	server -> client: 服务端临时公钥(32) | HMAC(server finished, transcript)
+//	client -> server: HMAC(client finished, transcript)
+//
+// 双方以预共享密钥为盐、X25519 共享秘密为输入按 HKDF 派生两个方向的 AES-256-GCM 密钥和确认密钥，
+// transcript 为前两条消息的 SHA-256。只有持有同一预共享密钥的一方能算出确认值，临时密钥提供前向安全，
+// 重放的握手因对端的临时公钥不同而无法完成。
+//
+// 之后每条记录为 LENGTH(2) | AEAD(TYPE(1) | 数据)，nonce 为各方向独立递增的序号，长度头作为附加数据，
+// 因此被重放、重排、丢弃或篡改的记录都无法通过校验。写方向结束时发送 FIN 记录，未收到 FIN 就断开视为截断。
+const (
+	secureMagic     = "TFSEC/1\n"
+	secureKeySize   = 32
+	secureMaxKeyID  = 64
+	secureMaxRecord = 16 << 10
+)
+
+// 记录类型
+const (
+	recordData byte = iota
+	recordFin
+)
+
+var (
+	errSecureAuth   = errors.New("secure tunnel authentication failed")
+	errSecureRecord = errors.New("malformed secure tunnel record")
+)
+
+// keyRing 加密隧道的密钥文件，每行一个 "<id> <base64 编码的 32 字节密钥>"，
+// 第一个密钥是加密端使用的当前密钥，解密端接受文件中的所有密钥，以便轮换时两端先后更新
+type keyRing struct {
+	current string
+	keys    map[string][]byte
+}
+
+// loadKeyRing 读取密钥文件，每次握手时重新读取，轮换密钥无需重新加载配置
+func loadKeyRing(path string) (*keyRing, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ring := &keyRing{keys: make(map[string][]byte)}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 || len(fields[0]) > secureMaxKeyID {
+			return nil, fmt.Errorf("%s:%d: expected \"<id> <base64 key>\"", path, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != secureKeySize {
+			return nil, fmt.Errorf("%s:%d: key must be %d bytes of base64", path, line, secureKeySize)
+		}
+		if _, ok := ring.keys[fields[0]]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate key id %q", path, line, fields[0])
+		}
+		if ring.current == "" {
+			ring.current = fields[0]
+		}
+		ring.keys[fields[0]] = key
+	}
+	if ring.current == "" {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return ring, nil
+}
+
+// secureClient 以密钥文件的当前密钥与对端握手，返回加密后的连接
+func secureClient(conn net.Conn, keyFile string) (net.Conn, error) {
+	ring, err := loadKeyRing(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hello := append([]byte(secureMagic), byte(len(ring.current)))
+	hello = append(hello, ring.current...)
+	hello = append(hello, priv.PublicKey().Bytes()...)
+	if _, err := conn.Write(hello); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, secureKeySize+sha256.Size)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	serverPub := reply[:secureKeySize]
+	keys, err := deriveSecureKeys(ring.keys[ring.current], priv, serverPub, hello, serverPub)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(reply[secureKeySize:], keys.serverMAC) {
+		return nil, errSecureAuth
+	}
+	if _, err := conn.Write(keys.clientMAC); err != nil {
+		return nil, err
+	}
+	return &secureConn{Conn: conn, seal: keys.c2s, open: keys.s2c}, nil
+}
+
+// secureServer 与加密端握手，返回解密后的连接和对端使用的密钥标识
+func secureServer(conn net.Conn, keyFile string) (net.Conn, string, error) {
+	ring, err := loadKeyRing(keyFile)
+	if err != nil {
+		return nil, "", err
+	}
+	hello := make([]byte, len(secureMagic)+1)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return nil, "", err
+	}
+	n := int(hello[len(secureMagic)])
+	if string(hello[:len(secureMagic)]) != secureMagic || n == 0 || n > secureMaxKeyID {
+		return nil, "", errors.New("not a secure tunnel handshake")
+	}
+	hello = slices.Grow(hello, n+secureKeySize)[:len(hello)+n+secureKeySize]
+	if _, err := io.ReadFull(conn, hello[len(secureMagic)+1:]); err != nil {
+		return nil, "", err
+	}
+	id := string(hello[len(secureMagic)+1 : len(secureMagic)+1+n])
+	psk, ok := ring.keys[id]
+	if !ok {
+		return nil, id, fmt.Errorf("unknown key id %q", id)
+	}
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, id, err
+	}
+	serverPub := priv.PublicKey().Bytes()
+	keys, err := deriveSecureKeys(psk, priv, hello[len(hello)-secureKeySize:], hello, serverPub)
+	if err != nil {
+		return nil, id, err
+	}
+	if _, err := conn.Write(append(serverPub, keys.serverMAC...)); err != nil {
+		return nil, id, err
+	}
+	mac := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, mac); err != nil {
+		return nil, id, err
+	}
+	if !hmac.Equal(mac, keys.clientMAC) {
+		return nil, id, errSecureAuth
+	}
+	return &secureConn{Conn: conn, seal: keys.s2c, open: keys.c2s}, id, nil
+}
+
+// secureKeys 握手派生的会话密钥
+type secureKeys struct {
+	c2s, s2c             cipher.AEAD
+	serverMAC, clientMAC []byte
+}
+
+// deriveSecureKeys 由预共享密钥、X25519 共享秘密和握手记录派生会话密钥
+func deriveSecureKeys(psk []byte, priv *ecdh.PrivateKey, peerPub, hello, serverPub []byte) (*secureKeys, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	transcript := sha256.New()
+	transcript.Write(hello)
+	transcript.Write(serverPub)
+	th := transcript.Sum(nil)
+
+	// HKDF-SHA256：extract 以预共享密钥为盐，expand 只需要一个块
+	prk := hmacSum(psk, shared)
+	expand := func(label string) []byte {
+		return hmacSum(prk, []byte(label), th, []byte{1})
+	}
+	keys := &secureKeys{
+		serverMAC: hmacSum(expand("server finished"), th),
+		clientMAC: hmacSum(expand("client finished"), th),
+	}
+	if keys.c2s, err = newGCM(expand("client to server")); err != nil {
+		return nil, err
+	}
+	if keys.s2c, err = newGCM(expand("server to client")); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func hmacSum(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// secureConn 加密隧道连接，读写明文，底层连接上传输加密记录
+type secureConn struct {
+	net.Conn
+	seal, open cipher.AEAD
+
+	wmu    sync.Mutex
+	wseq   uint64
+	wnonce [12]byte
+	wbuf   []byte
+
+	rseq   uint64
+	rnonce [12]byte
+	rrec   []byte
+	rbuf   []byte // 已解密尚未读出的数据
+	rerr   error
+}
+
+func (c *secureConn) Read(b []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		if c.rerr != nil {
+			return 0, c.rerr
+		}
+		c.rerr = c.readRecord()
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// readRecord 读取并校验下一条记录，FIN 记录返回 io.EOF
+func (c *secureConn) readRecord() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+		if err == io.EOF {
+			// 未收到 FIN 记录就断开，数据可能被截断
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n < 1+c.open.Overhead() {
+		return errSecureRecord
+	}
+	c.rrec = slices.Grow(c.rrec[:0], n)[:n]
+	if _, err := io.ReadFull(c.Conn, c.rrec); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	binary.BigEndian.PutUint64(c.rnonce[4:], c.rseq)
+	plain, err := c.open.Open(c.rrec[:0], c.rnonce[:], c.rrec, hdr[:])
+	if err != nil {
+		return errSecureAuth
+	}
+	c.rseq++
+	switch plain[0] {
+	case recordData:
+		c.rbuf = plain[1:]
+		return nil
+	case recordFin:
+		return io.EOF
+	}
+	return errSecureRecord
+}
+
+func (c *secureConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), secureMaxRecord)]
+		if err := c.writeRecord(recordData, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// writeRecord 加密并写出一条记录，调用方持有 wmu
+func (c *secureConn) writeRecord(typ byte, payload []byte) error {
+	n := 1 + len(payload) + c.seal.Overhead()
+	c.wbuf = slices.Grow(c.wbuf[:0], 2+n)[:3+len(payload)]
+	binary.BigEndian.PutUint16(c.wbuf, uint16(n))
+	c.wbuf[2] = typ
+	copy(c.wbuf[3:], payload)
+	binary.BigEndian.PutUint64(c.wnonce[4:], c.wseq)
+	c.wbuf = c.seal.Seal(c.wbuf[:2], c.wnonce[:], c.wbuf[2:], c.wbuf[:2])
+	c.wseq++
+	_, err := c.Conn.Write(c.wbuf)
+	return err
+}
+
+// CloseWrite 发送 FIN 记录并关闭底层连接的写方向
+func (c *secureConn) CloseWrite() error {
+	c.wmu.Lock()
+	err := c.writeRecord(recordFin, nil)
+	c.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+	return closeWrite(c.Conn)
+}
+
+// NetConn 返回被包装的连接
+func (c *secureConn) NetConn() net.Conn {
+	return c.Conn
+}
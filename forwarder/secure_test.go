@@ -0,0 +1,124 @@
+package forwarder
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKeys 写入密钥文件，每个标识对应一个随机密钥，返回密钥文件路径
+func writeKeys(t *testing.T, path string, keys map[string][]byte, ids ...string) string {
+	t.Helper()
+	var b bytes.Buffer
+	for _, id := range ids {
+		if keys[id] == nil {
+			keys[id] = make([]byte, secureKeySize)
+			rand.Read(keys[id])
+		}
+		b.WriteString(id + " " + base64.StdEncoding.EncodeToString(keys[id]) + "\n")
+	}
+	if err := os.WriteFile(path, b.Bytes(), 0600); err != nil {
+		t.Fatalf("Failed to write keys: %v", err)
+	}
+	return path
+}
+
+// TestSecureTunnel 测试加密端与解密端之间的隧道：数据和半关闭正确传递，解密端接受轮换中的旧密钥，
+// 拒绝未知的密钥
+func TestSecureTunnel(t *testing.T) {
+	dir := t.TempDir()
+	keys := make(map[string][]byte)
+	exitKeys := writeKeys(t, filepath.Join(dir, "exit.keys"), keys, "k2", "k1")
+
+	echo := echoServer(t)
+	exit := startForwarder(t, Rule{Backends: []Backend{echo}, Decrypt: exitKeys})
+	backend := Backend{Network: "tcp", Address: exit.Stats().Rules[0].Listen}
+
+	payload := make([]byte, 256<<10)
+	rand.Read(payload)
+	for _, id := range []string{"k1", "k2"} {
+		sock := filepath.Join(dir, id+".sock")
+		startForwarder(t, Rule{LocalUnix: sock, Backends: []Backend{backend}, Encrypt: writeKeys(t, filepath.Join(dir, id+".keys"), keys, id)})
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		go func() {
+			conn.Write(payload)
+			conn.(*net.UnixConn).CloseWrite()
+		}()
+		got, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Errorf("Key %s: expected %d bytes echoed, got %d, %v", id, len(payload), len(got), err)
+		}
+	}
+
+	sock := filepath.Join(dir, "unknown.sock")
+	startForwarder(t, Rule{LocalUnix: sock, Backends: []Backend{backend}, Encrypt: writeKeys(t, filepath.Join(dir, "unknown.keys"), keys, "k3")})
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected unknown key to be rejected, got %d bytes, %v", n, err)
+	}
+}
+
+// TestSecureReplay 测试重放的记录无法通过校验
+func TestSecureReplay(t *testing.T) {
+	keyFile := writeKeys(t, filepath.Join(t.TempDir(), "keys"), make(map[string][]byte), "k1")
+	client, relayClient := net.Pipe()
+	relayServer, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// 中间人照常转发握手，之后把第一条记录发送两次
+	go io.Copy(relayClient, relayServer)
+	go func() {
+		for _, n := range []int{len(secureMagic) + 1 + len("k1") + secureKeySize, sha256.Size} {
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(relayClient, msg); err != nil {
+				return
+			}
+			relayServer.Write(msg)
+		}
+		var hdr [2]byte
+		if _, err := io.ReadFull(relayClient, hdr[:]); err != nil {
+			return
+		}
+		record := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		io.ReadFull(relayClient, record)
+		relayServer.Write(append(hdr[:], record...))
+		relayServer.Write(append(hdr[:], record...))
+	}()
+
+	go func() {
+		sc, err := secureClient(client, keyFile)
+		if err == nil {
+			sc.Write([]byte("hello"))
+		}
+	}()
+	sc, _, err := secureServer(server, keyFile)
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("Expected first record, got %q, %v", buf, err)
+	}
+	if _, err := sc.Read(buf); err != errSecureAuth {
+		t.Errorf("Expected replayed record to fail authentication, got %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SocketOptions 规则的 TCP 套接字选项，作用于监听套接字（接收的连接继承）和连接后端或代理目标的套接字，
+// 零值表示保持默认
+type SocketOptions struct {
+	Nagle             bool          // 启用 Nagle 算法，默认设置 TCP_NODELAY
+	NoKeepAlive       bool          // 关闭 TCP keepalive
+	KeepAliveIdle     time.Duration // 空闲多久后开始探测，0 表示 15s
+	KeepAliveInterval time.Duration // 探测间隔，0 表示 15s
+	KeepAliveCount    int           // 探测失败多少次后断开，0 表示 9
+
+	// 以下选项由内核实现，仅 Linux 支持
+	RecvBuffer   int           // SO_RCVBUF
+	SendBuffer   int           // SO_SNDBUF
+	UserTimeout  time.Duration // TCP_USER_TIMEOUT，已发送数据多久未被确认时断开
+	NotSentLowat int           // TCP_NOTSENT_LOWAT
+	TOS          int           // IP_TOS 和 IPV6_TCLASS
+	FastOpen     bool          // 监听端启用 TCP_FASTOPEN，连接端启用 TCP_FASTOPEN_CONNECT
+	Backlog      int           // 监听队列长度，0 表示使用系统上限
+	ReusePort    int           // 每个监听地址以 SO_REUSEPORT 打开的套接字数，各有独立的接收循环，0 表示一个普通套接字
+	ReusePortCPU bool          // 按处理握手的 CPU 把连接分配给同组的套接字，而非按四元组哈希
+}
+
+// kernel 是否设置了由内核实现的选项
+func (o SocketOptions) kernel() bool {
+	return o.RecvBuffer != 0 || o.SendBuffer != 0 || o.UserTimeout != 0 || o.NotSentLowat != 0 ||
+		o.TOS != 0 || o.FastOpen || o.Backlog != 0 || o.ReusePort != 0
+}
+
+// keepAlive 返回 net.Dialer 和 net.ListenConfig 的 keepalive 设置
+func (o SocketOptions) keepAlive() (time.Duration, net.KeepAliveConfig) {
+	if o.NoKeepAlive {
+		return -1, net.KeepAliveConfig{}
+	}
+	return 0, net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     o.KeepAliveIdle,
+		Interval: o.KeepAliveInterval,
+		Count:    o.KeepAliveCount,
+	}
+}
+
+// control 返回在 bind 之前设置内核选项的 Control 钩子
+func (o SocketOptions) control(listen bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if !strings.HasPrefix(network, "tcp") {
+			return nil
+		}
+		var err error
+		if cerr := c.Control(func(fd uintptr) { err = o.setsockopt(fd, network, listen) }); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+// listen 按选项创建 TCP 监听器
+func (o SocketOptions) listen(network, address string) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	lc.KeepAlive, lc.KeepAliveConfig = o.keepAlive()
+	if o.kernel() {
+		lc.Control = o.control(true)
+	}
+	ln, err := lc.Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	if o.Backlog > 0 {
+		if err := setBacklog(ln, o.Backlog); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	if o.ReusePortCPU {
+		if err := attachCPUSteering(ln, o.ReusePort); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// probeSocket 在规则的监听器和出站连接将使用的每个地址族的临时套接字上设置内核选项，加载配置时即报告内核拒绝的设置
+func (r Rule) probeSocket() error {
+	if !r.Socket.kernel() {
+		return nil
+	}
+	listen, dial := r.socketNetworks()
+	for _, network := range listen {
+		if err := r.Socket.probe(network, true); err != nil {
+			return fmt.Errorf("%s listener: %w", network, err)
+		}
+	}
+	for _, network := range dial {
+		if err := r.Socket.probe(network, false); err != nil {
+			return fmt.Errorf("%s outbound connection: %w", network, err)
+		}
+	}
+	return nil
+}
+
+// socketNetworks 返回规则的 TCP 监听器和出站连接使用的地址族（tcp4 或 tcp6）。绑定网卡名、
+// 默认的双栈监听地址和需要解析的域名两种地址族都可能用到
+func (r Rule) socketNetworks() (listen, dial []string) {
+	both := []string{"tcp4", "tcp6"}
+	family := func(addr netip.Addr) string {
+		if addr.Unmap().Is4() {
+			return "tcp4"
+		}
+		return "tcp6"
+	}
+
+	if r.LocalUnix == "" && r.ReverseServer == "" {
+		switch {
+		case len(r.Bind) == 0 && r.IPv6Only:
+			listen = []string{"tcp6"}
+		case len(r.Bind) == 0:
+			listen = both
+		}
+		for _, b := range r.Bind {
+			if ip, err := netip.ParseAddr(b); err == nil {
+				listen = append(listen, family(ip))
+			} else {
+				listen = append(listen, both...)
+			}
+		}
+	}
+
+	backends := slices.Clone(r.Backends)
+	if r.Backup != nil {
+		backends = append(backends, *r.Backup)
+	}
+	switch {
+	case len(r.Source) > 0:
+		for _, s := range r.Source {
+			if ip, err := netip.ParseAddr(s); err == nil {
+				dial = append(dial, family(ip))
+			}
+		}
+	case r.Mode != ModeForward || r.Discovery.Kind != "":
+		// 代理目标和发现的后端事先未知
+		dial = both
+	default:
+		for _, b := range backends {
+			if b.Network != "tcp" {
+				continue
+			}
+			host, _, _ := net.SplitHostPort(b.Address)
+			if ip, err := netip.ParseAddr(host); err == nil {
+				dial = append(dial, family(ip))
+			} else {
+				dial = append(dial, both...)
+			}
+		}
+	}
+	slices.Sort(listen)
+	slices.Sort(dial)
+	return slices.Compact(listen), slices.Compact(dial)
+}
+
+// tuneConn 设置连接上无法在 Control 钩子中设置的选项，Go 在连接建立后总会设置 TCP_NODELAY
+func (o SocketOptions) tuneConn(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok && o.Nagle {
+		tcp.SetNoDelay(false)
+	}
+}
@@ -0,0 +1,144 @@
+//go:build linux
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// sockoptSupported 当前平台支持内核实现的套接字选项、绑定网卡和防火墙标记
+const sockoptSupported = true
+
+// fastOpenQueueLen 监听套接字等待完成握手的 TCP Fast Open 请求数上限
+const fastOpenQueueLen = 256
+
+// skfAdCPU 经典 BPF 中读取当前 CPU 编号的辅助偏移（SKF_AD_OFF + SKF_AD_CPU）
+const skfAdCPU = 0xfffff000 + 36
+
+// setsockopt 设置内核实现的套接字选项，network 为 tcp4 或 tcp6
+func (o SocketOptions) setsockopt(fd uintptr, network string, listen bool) error {
+	type option struct {
+		name       string
+		level, opt int
+		value      int
+		set        bool
+	}
+	options := []option{
+		{"SO_RCVBUF", unix.SOL_SOCKET, unix.SO_RCVBUF, o.RecvBuffer, o.RecvBuffer != 0},
+		{"SO_SNDBUF", unix.SOL_SOCKET, unix.SO_SNDBUF, o.SendBuffer, o.SendBuffer != 0},
+		{"TCP_USER_TIMEOUT", unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(o.UserTimeout.Milliseconds()), o.UserTimeout != 0},
+		{"TCP_NOTSENT_LOWAT", unix.IPPROTO_TCP, unix.TCP_NOTSENT_LOWAT, o.NotSentLowat, o.NotSentLowat != 0},
+		{"IP_TOS", unix.IPPROTO_IP, unix.IP_TOS, o.TOS, o.TOS != 0},
+		{"IPV6_TCLASS", unix.IPPROTO_IPV6, unix.IPV6_TCLASS, o.TOS, o.TOS != 0 && network == "tcp6"},
+		{"TCP_FASTOPEN", unix.IPPROTO_TCP, unix.TCP_FASTOPEN, fastOpenQueueLen, o.FastOpen && listen},
+		{"TCP_FASTOPEN_CONNECT", unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1, o.FastOpen && !listen},
+		{"SO_REUSEPORT", unix.SOL_SOCKET, unix.SO_REUSEPORT, 1, o.ReusePort > 0 && listen},
+	}
+	for _, opt := range options {
+		if !opt.set {
+			continue
+		}
+		if err := unix.SetsockoptInt(int(fd), opt.level, opt.opt, opt.value); err != nil {
+			return fmt.Errorf("set %s to %d: %w", opt.name, opt.value, err)
+		}
+	}
+	return nil
+}
+
+// probe 在 network（tcp4 或 tcp6）的临时套接字上设置监听端或连接端的选项。
+// 系统未启用该地址族时不会有这种套接字，不做检查
+func (o SocketOptions) probe(network string, listen bool) error {
+	family := unix.AF_INET
+	if network == "tcp6" {
+		family = unix.AF_INET6
+	}
+	fd, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if errors.Is(err, unix.EAFNOSUPPORT) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	return o.setsockopt(uintptr(fd), network, listen)
+}
+
+// attachCPUSteering 为监听套接字所在的 SO_REUSEPORT 组挂载按 CPU 选择套接字的程序，选中组内第 cpu % n 个套接字。
+// 程序须在套接字加入组之后挂载，在 bind 之前挂载会让套接字单独成组
+func attachCPUSteering(ln net.Listener, n int) error {
+	program := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: skfAdCPU},
+		{Code: unix.BPF_ALU | unix.BPF_MOD | unix.BPF_K, K: uint32(n)},
+		{Code: unix.BPF_RET | unix.BPF_A},
+	}
+	prog := unix.SockFprog{Len: uint16(len(program)), Filter: &program[0]}
+	return rawControl(ln, func(fd int) error {
+		if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_REUSEPORT_CBPF, &prog); err != nil {
+			return fmt.Errorf("attach reuseport cpu program: %w", err)
+		}
+		return nil
+	})
+}
+
+// setBacklog 重新调用 listen 设置监听队列长度，Go 总是使用系统上限
+func setBacklog(ln net.Listener, backlog int) error {
+	return rawControl(ln, func(fd int) error {
+		if err := unix.Listen(fd, backlog); err != nil {
+			return fmt.Errorf("set backlog to %d: %w", backlog, err)
+		}
+		return nil
+	})
+}
+
+// rawControl 在监听套接字的文件描述符上执行 fn
+func rawControl(ln net.Listener, fn func(fd int) error) error {
+	tcp, ok := ln.(*net.TCPListener)
+	if !ok {
+		return errors.New("not a tcp listener")
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return err
+	}
+	cerr := raw.Control(func(fd uintptr) { err = fn(int(fd)) })
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// setsockopt 设置出站套接字的绑定网卡和防火墙标记。使用源地址池时推迟本地端口的分配到 connect，
+// 同一源地址的端口可以被不同目标复用
+func (o *outbound) setsockopt(fd uintptr) error {
+	if err := o.bindDevice(fd); err != nil {
+		return err
+	}
+	if len(o.sources) > 0 {
+		// 不支持该选项的内核在 bind 时分配端口，连接仍可建立，只是端口不能被不同目标复用
+		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_BIND_ADDRESS_NO_PORT, 1); err != nil {
+			o.noPort.Do(func() {
+				o.log.WithError(err).Warn("Failed to set IP_BIND_ADDRESS_NO_PORT, local ports are allocated at bind.")
+			})
+		}
+	}
+	return nil
+}
+
+// bindDevice 为出站套接字绑定网卡并设置防火墙标记，TCP 和 UDP 套接字共用
+func (o *outbound) bindDevice(fd uintptr) error {
+	if o.iface != "" {
+		if err := unix.BindToDevice(int(fd), o.iface); err != nil {
+			return fmt.Errorf("bind to device %s: %w", o.iface, err)
+		}
+	}
+	if o.mark != 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(o.mark)); err != nil {
+			return fmt.Errorf("set fwmark: %w", err)
+		}
+	}
+	return nil
+}
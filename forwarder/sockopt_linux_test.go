@@ -0,0 +1,148 @@
+//go:build linux
+
+package forwarder
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// getsockopt 读取连接上的整数套接字选项
+func getsockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	t.Helper()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("Failed to get raw conn: %v", err)
+	}
+	var value int
+	raw.Control(func(fd uintptr) { value, err = unix.GetsockoptInt(int(fd), level, opt) })
+	if err != nil {
+		t.Fatalf("Failed to get socket option %d: %v", opt, err)
+	}
+	return value
+}
+
+// TestSocketOptions 测试监听和出站套接字的选项，以及内核拒绝的选项在启动时报告
+func TestSocketOptions(t *testing.T) {
+	opts := SocketOptions{
+		Nagle:         true,
+		KeepAliveIdle: 42 * time.Second,
+		RecvBuffer:    256 << 10,
+		UserTimeout:   3 * time.Second,
+		NotSentLowat:  16 << 10,
+		TOS:           0xb8,
+		Backlog:       16,
+	}
+	ln, err := opts.listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	out := newOutbound(Rule{Socket: opts}, time.Second, logrus.NewEntry(logrus.New()))
+	dialed, err := out.DialContext(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer dialed.Close()
+	server := <-accepted
+	if server == nil {
+		t.Fatal("Failed to accept")
+	}
+	defer server.Close()
+	opts.tuneConn(server)
+
+	for name, conn := range map[string]net.Conn{"dialed": dialed, "accepted": server} {
+		checks := []struct {
+			name       string
+			level, opt int
+			want       int
+		}{
+			{"TCP_NODELAY", unix.IPPROTO_TCP, unix.TCP_NODELAY, 0},
+			{"TCP_KEEPIDLE", unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, 42},
+			{"TCP_USER_TIMEOUT", unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, 3000},
+			{"TCP_NOTSENT_LOWAT", unix.IPPROTO_TCP, unix.TCP_NOTSENT_LOWAT, 16 << 10},
+			{"IP_TOS", unix.IPPROTO_IP, unix.IP_TOS, 0xb8},
+		}
+		for _, c := range checks {
+			if got := getsockopt(t, conn, c.level, c.opt); got != c.want {
+				t.Errorf("Expected %s of %s conn to be %d, got %d", c.name, name, c.want, got)
+			}
+		}
+		// 内核把设置的缓冲区大小加倍以容纳簿记开销
+		if got := getsockopt(t, conn, unix.SOL_SOCKET, unix.SO_RCVBUF); got < opts.RecvBuffer {
+			t.Errorf("Expected SO_RCVBUF of %s conn to be at least %d, got %d", name, opts.RecvBuffer, got)
+		}
+	}
+
+	// 内核拒绝的设置在加载配置时即被报告
+	rejected := Rule{LocalPort: 18080, Backends: []Backend{{Network: "tcp", Address: "[::1]:80"}}, Socket: SocketOptions{UserTimeout: -time.Millisecond}}
+	if _, err := New(DefaultOptions(), []Rule{rejected}); err == nil || !strings.Contains(err.Error(), "TCP_USER_TIMEOUT") {
+		t.Errorf("Expected New to report the rejected TCP_USER_TIMEOUT, got %v", err)
+	}
+}
+
+// TestSocketNetworks 测试探测套接字选项时使用监听器和出站连接实际使用的地址族
+func TestSocketNetworks(t *testing.T) {
+	v4 := Backend{Network: "tcp", Address: "10.0.0.5:80"}
+	v6 := Backend{Network: "tcp", Address: "[fd00::5]:80"}
+	name := Backend{Network: "tcp", Address: "db.internal:5432"}
+	for _, tc := range []struct {
+		rule         Rule
+		listen, dial string
+	}{
+		{Rule{Backends: []Backend{v4}}, "tcp4,tcp6", "tcp4"},
+		{Rule{Backends: []Backend{v6}, IPv6Only: true}, "tcp6", "tcp6"},
+		{Rule{Backends: []Backend{v6}, Bind: []string{"127.0.0.1"}}, "tcp4", "tcp6"},
+		{Rule{Backends: []Backend{v4}, Bind: []string{"eth0"}}, "tcp4,tcp6", "tcp4"},
+		{Rule{Backends: []Backend{name}, Bind: []string{"::1"}}, "tcp6", "tcp4,tcp6"},
+		{Rule{Backends: []Backend{v6}, Source: []string{"10.0.0.1"}}, "tcp4,tcp6", "tcp4"},
+		{Rule{LocalUnix: "/run/a.sock", Backends: []Backend{{Network: "unix", Address: "/run/b.sock"}}}, "", ""},
+		{Rule{Mode: ModeSOCKS5, Bind: []string{"10.0.0.1"}}, "tcp4", "tcp4,tcp6"},
+	} {
+		listen, dial := tc.rule.socketNetworks()
+		if got := strings.Join(listen, ","); got != tc.listen {
+			t.Errorf("Rule %s: expected listener networks %q, got %q", tc.rule, tc.listen, got)
+		}
+		if got := strings.Join(dial, ","); got != tc.dial {
+			t.Errorf("Rule %s: expected outbound networks %q, got %q", tc.rule, tc.dial, got)
+		}
+	}
+}
+
+// TestReusePort 测试 SO_REUSEPORT 分片的监听器接收连接，以及重新加载时按新的分片数重新监听
+func TestReusePort(t *testing.T) {
+	one := bannerServer(t, "one")
+	rule := Rule{Name: "sharded", Backends: []Backend{one}, Socket: SocketOptions{ReusePort: 4, ReusePortCPU: true}}
+	fwd := startForwarder(t, rule)
+	addr := fwd.Stats().Rules[0].Listen
+	if m, ok := fwd.listeners[rule.listenKey()].ln.(*multiListener); !ok || len(m.listeners) != 4 {
+		t.Fatalf("Expected 4 listening sockets on %s", addr)
+	}
+	for range 20 {
+		if got := readBanner(t, addr); got != "one" {
+			t.Fatalf("Expected banner through %s, got %q", addr, got)
+		}
+	}
+
+	rule.Socket = SocketOptions{ReusePort: 2}
+	rule.LocalPort, _ = strconv.Atoi(portOf(addr))
+	if err := fwd.Reload([]Rule{rule}); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if got := readBanner(t, addr); got != "one" {
+		t.Errorf("Expected banner after reload, got %q", got)
+	}
+}
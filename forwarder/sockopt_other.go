@@ -0,0 +1,38 @@
+//go:build !linux
+
+package forwarder
+
+import "net"
+
+// sockoptSupported 当前平台支持内核实现的套接字选项、绑定网卡和防火墙标记
+const sockoptSupported = false
+
+// setsockopt 设置内核实现的套接字选项，其他平台上这些选项在解析配置时即被拒绝
+func (o SocketOptions) setsockopt(fd uintptr, network string, listen bool) error {
+	return nil
+}
+
+// probe 在 network 的临时套接字上设置选项，其他平台上内核选项在解析配置时即被拒绝
+func (o SocketOptions) probe(network string, listen bool) error {
+	return nil
+}
+
+// attachCPUSteering 为监听套接字所在的 SO_REUSEPORT 组挂载按 CPU 选择套接字的程序
+func attachCPUSteering(ln net.Listener, n int) error {
+	return nil
+}
+
+// setBacklog 重新调用 listen 设置监听队列长度
+func setBacklog(ln net.Listener, backlog int) error {
+	return nil
+}
+
+// setsockopt 设置出站套接字的绑定网卡和防火墙标记，其他平台上这些选项在解析配置时即被拒绝
+func (o *outbound) setsockopt(fd uintptr) error {
+	return nil
+}
+
+// bindDevice 其他平台上绑定网卡和防火墙标记在解析配置时即被拒绝
+func (o *outbound) bindDevice(fd uintptr) error {
+	return nil
+}
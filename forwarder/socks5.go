@@ -0,0 +1,401 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SOCKS5 协议常量（RFC 1928、RFC 1929）
+const (
+	socksVersion     = 5
+	socksAuthVersion = 1
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+
+	socksCmdConnect = 1
+	socksCmdUDP     = 3
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksSucceeded          = 0x00
+	socksGeneralFailure     = 0x01
+	socksNotAllowed         = 0x02
+	socksNetworkUnreachable = 0x03
+	socksHostUnreachable    = 0x04
+	socksConnectionRefused  = 0x05
+	socksTTLExpired         = 0x06
+	socksCmdNotSupported    = 0x07
+	socksAtypNotSupported   = 0x08
+)
+
+// socksError 握手失败时的错误及回复给客户端的状态码
+type socksError struct {
+	code byte
+	err  error
+}
+
+func (e *socksError) Error() string { return e.err.Error() }
+func (e *socksError) Unwrap() error { return e.err }
+
+// socks5Handler SOCKS5 代理，支持 CONNECT 和 UDP ASSOCIATE，可选用户名密码认证
+type socks5Handler struct {
+	creds   map[string]string
+	target  *targetDialer
+	timeout time.Duration
+}
+
+func (h *socks5Handler) accept(ctx context.Context, client net.Conn, record *AccessRecord, log *logrus.Entry) (net.Conn, error) {
+	if err := h.negotiate(client); err != nil {
+		return nil, err
+	}
+
+	cmd, target, err := readSOCKSRequest(client)
+	if err != nil {
+		var serr *socksError
+		if errors.As(err, &serr) {
+			writeSOCKSReply(client, serr.code, nil)
+		}
+		return nil, err
+	}
+	record.Backend = target
+
+	switch cmd {
+	case socksCmdConnect:
+		conn, err := h.target.dial(ctx, target)
+		if err != nil {
+			writeSOCKSReply(client, socksReplyCode(err), nil)
+			return nil, err
+		}
+		if err := writeSOCKSReply(client, socksSucceeded, conn.LocalAddr()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	case socksCmdUDP:
+		return nil, h.associate(ctx, client, record, log)
+	default:
+		writeSOCKSReply(client, socksCmdNotSupported, nil)
+		return nil, fmt.Errorf("unsupported SOCKS command %d", cmd)
+	}
+}
+
+// negotiate 协商认证方式，配置了认证文件时要求用户名密码认证
+func (h *socks5Handler) negotiate(client net.Conn) error {
+	var header [2]byte
+	if _, err := io.ReadFull(client, header[:]); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(client, methods); err != nil {
+		return err
+	}
+
+	want := byte(socksAuthNone)
+	if h.creds != nil {
+		want = socksAuthPassword
+	}
+	if !bytes.Contains(methods, []byte{want}) {
+		client.Write([]byte{socksVersion, socksAuthNoAcceptable})
+		return errors.New("no acceptable SOCKS authentication method")
+	}
+	if _, err := client.Write([]byte{socksVersion, want}); err != nil {
+		return err
+	}
+	if want == socksAuthNone {
+		return nil
+	}
+
+	// RFC 1929: VER ULEN UNAME PLEN PASSWD
+	var b [1]byte
+	if _, err := io.ReadFull(client, b[:]); err != nil {
+		return err
+	}
+	if b[0] != socksAuthVersion {
+		return fmt.Errorf("unsupported SOCKS auth version %d", b[0])
+	}
+	user, err := readSOCKSString(client)
+	if err != nil {
+		return err
+	}
+	password, err := readSOCKSString(client)
+	if err != nil {
+		return err
+	}
+	if !checkPassword(h.creds, user, password) {
+		client.Write([]byte{socksAuthVersion, 1})
+		return fmt.Errorf("SOCKS authentication failed for user %q", user)
+	}
+	_, err = client.Write([]byte{socksAuthVersion, 0})
+	return err
+}
+
+// readSOCKSString 读取一个字节长度前缀的字符串
+func readSOCKSString(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, n[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readSOCKSRequest 读取请求：VER CMD RSV ATYP DST.ADDR DST.PORT
+func readSOCKSRequest(r io.Reader) (byte, string, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, "", err
+	}
+	if header[0] != socksVersion {
+		return 0, "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	target, err := readSOCKSAddr(r)
+	return header[1], target, err
+}
+
+// readSOCKSAddr 读取 ATYP ADDR PORT，返回 host:port
+func readSOCKSAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		name, err := readSOCKSString(r)
+		if err != nil {
+			return "", err
+		}
+		host = name
+	default:
+		return "", &socksError{socksAtypNotSupported, fmt.Errorf("unsupported address type %d", atyp[0])}
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// appendSOCKSAddr 以 ATYP ADDR PORT 的形式追加地址，非 IP 地址写为 0.0.0.0:0
+func appendSOCKSAddr(b []byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil || ip == nil {
+		if ip4 == nil {
+			ip4 = net.IPv4zero.To4()
+		}
+		b = append(append(b, socksAtypIPv4), ip4...)
+	} else {
+		b = append(append(b, socksAtypIPv6), ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// writeSOCKSReply 回复请求结果：VER REP RSV ATYP BND.ADDR BND.PORT
+func writeSOCKSReply(w io.Writer, code byte, bound net.Addr) error {
+	_, err := w.Write(appendSOCKSAddr([]byte{socksVersion, code, 0}, bound))
+	return err
+}
+
+// socksReplyCode 根据连接目标的错误选择回复状态码
+func socksReplyCode(err error) byte {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errNotAllowed):
+		return socksNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, errDNSNotFound):
+		return socksHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socksTTLExpired
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
+
+// associate 处理 UDP ASSOCIATE：在接收控制连接的地址上为客户端开放一个 UDP 端口，
+// 转发客户端发往允许目标的数据报及其回复，控制连接关闭或空闲超时后结束
+func (h *socks5Handler) associate(ctx context.Context, client net.Conn, record *AccessRecord, log *logrus.Entry) error {
+	local, ok := client.LocalAddr().(*net.TCPAddr)
+	remote, _ := client.RemoteAddr().(*net.TCPAddr)
+	if !ok || remote == nil {
+		writeSOCKSReply(client, socksCmdNotSupported, nil)
+		return errors.New("UDP ASSOCIATE requires a TCP listener")
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		writeSOCKSReply(client, socksGeneralFailure, nil)
+		return err
+	}
+	defer relay.Close()
+	out, err := h.target.out.listenUDP(ctx)
+	if err != nil {
+		writeSOCKSReply(client, socksGeneralFailure, nil)
+		return err
+	}
+	defer out.Close()
+	if err := writeSOCKSReply(client, socksSucceeded, relay.LocalAddr()); err != nil {
+		return err
+	}
+	log.WithField("relay", relay.LocalAddr().String()).Info("UDP association established.")
+
+	// 关联的生命周期由控制连接决定
+	client.SetDeadline(time.Time{})
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var controlClosed, idle atomic.Bool
+	go func() {
+		io.Copy(io.Discard, client)
+		controlClosed.Store(true)
+		cancel()
+	}()
+	stop := context.AfterFunc(ctx, func() {
+		client.Close()
+		relay.Close()
+		out.Close()
+	})
+	defer stop()
+	idleTimer := time.AfterFunc(h.timeout, func() {
+		idle.Store(true)
+		cancel()
+	})
+	defer idleTimer.Stop()
+
+	var (
+		clientAddr atomic.Pointer[net.UDPAddr]
+		mu         sync.Mutex
+		targets    = make(map[string]bool) // 只转发来自客户端发送过数据的目标的回复
+		up, down   atomic.Int64
+		wg         sync.WaitGroup
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 64*1024)
+		for {
+			n, from, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				cancel()
+				return
+			}
+			if !from.IP.Equal(remote.IP) {
+				continue
+			}
+			if addr := clientAddr.Load(); addr == nil {
+				clientAddr.Store(from)
+			} else if addr.Port != from.Port {
+				continue
+			}
+			target, payload, err := parseSOCKSUDP(buf[:n])
+			if err != nil {
+				log.WithError(err).Debug("Dropped invalid UDP datagram.")
+				continue
+			}
+			dst, err := h.target.resolveUDP(ctx, target)
+			if err != nil {
+				log.WithError(err).WithField("target", target).Debug("Dropped UDP datagram.")
+				continue
+			}
+			mu.Lock()
+			targets[dst.String()] = true
+			mu.Unlock()
+			if _, err := out.WriteToUDP(payload, dst); err == nil {
+				up.Add(int64(len(payload)))
+				idleTimer.Reset(h.timeout)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 64*1024)
+		for {
+			n, from, err := out.ReadFromUDP(buf)
+			if err != nil {
+				cancel()
+				return
+			}
+			mu.Lock()
+			known := targets[from.String()]
+			mu.Unlock()
+			addr := clientAddr.Load()
+			if !known || addr == nil {
+				continue
+			}
+			packet := append(appendSOCKSAddr([]byte{0, 0, 0}, from), buf[:n]...)
+			if _, err := relay.WriteToUDP(packet, addr); err == nil {
+				down.Add(int64(n))
+				idleTimer.Reset(h.timeout)
+			}
+		}
+	}()
+	wg.Wait()
+
+	record.BytesUp, record.BytesDown = up.Load(), down.Load()
+	switch {
+	case controlClosed.Load():
+		record.CloseReason = closeClientEOF
+	case idle.Load():
+		record.CloseReason = closeIdleTimeout
+	default:
+		record.CloseReason = closeShutdown
+	}
+	return nil
+}
+
+// parseSOCKSUDP 解析 UDP 请求头：RSV FRAG ATYP DST.ADDR DST.PORT DATA，不支持分片
+func parseSOCKSUDP(packet []byte) (string, []byte, error) {
+	if len(packet) < 4 {
+		return "", nil, errors.New("short UDP datagram")
+	}
+	if packet[2] != 0 {
+		return "", nil, errors.New("fragmented UDP datagram")
+	}
+	r := bytes.NewReader(packet[3:])
+	target, err := readSOCKSAddr(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return target, packet[len(packet)-r.Len():], nil
+}
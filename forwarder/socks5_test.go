@@ -0,0 +1,288 @@
+package forwarder
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// socksDial 连接 SOCKS5 代理并完成认证，user 为空时不认证
+func socksDial(t *testing.T, proxy, user, password string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	method := byte(socksAuthNone)
+	if user != "" {
+		method = socksAuthPassword
+	}
+	conn.Write([]byte{socksVersion, 1, method})
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatalf("Failed to read method: %v", err)
+	}
+	if resp[1] != method {
+		t.Fatalf("Expected method %d, got %d", method, resp[1])
+	}
+	if user != "" {
+		req := append([]byte{socksAuthVersion, byte(len(user))}, user...)
+		req = append(append(req, byte(len(password))), password...)
+		conn.Write(req)
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatalf("Failed to read auth status: %v", err)
+		}
+		if resp[1] != 0 {
+			return nil
+		}
+	}
+	return conn
+}
+
+// socksRequest 发送请求并返回回复状态码和绑定地址
+func socksRequest(t *testing.T, conn net.Conn, cmd byte, target string) (byte, string) {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(target)
+	p, _ := strconv.Atoi(port)
+	req := []byte{socksVersion, cmd, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		req = appendSOCKSAddr(req, &net.TCPAddr{IP: ip, Port: p})
+	} else {
+		req = append(append(req, socksAtypDomain, byte(len(host))), host...)
+		req = append(req, byte(p>>8), byte(p))
+	}
+	conn.Write(req)
+	var header [3]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	bound, err := readSOCKSAddr(conn)
+	if err != nil {
+		t.Fatalf("Failed to read bound address: %v", err)
+	}
+	return header[1], bound
+}
+
+// TestSOCKS5Connect 测试 CONNECT、用户名密码认证和允许列表
+func TestSOCKS5Connect(t *testing.T) {
+	echo := echoServer(t)
+	creds := filepath.Join(t.TempDir(), "socks.passwd")
+	os.WriteFile(creds, []byte("# users\nalice:secret\n"), 0600)
+
+	rule := Rule{Mode: ModeSOCKS5, AuthFile: creds, Allow: []string{"127.0.0.0/8:" + portOf(echo.Address), "localhost"}}
+	fwd := startForwarder(t, rule)
+	proxy := fwd.Stats().Rules[0].Listen
+
+	if socksDial(t, proxy, "alice", "wrong") != nil {
+		t.Error("Expected wrong password to be rejected")
+	}
+
+	conn := socksDial(t, proxy, "alice", "secret")
+	if code, _ := socksRequest(t, conn, socksCmdConnect, echo.Address); code != socksSucceeded {
+		t.Fatalf("Expected CONNECT to succeed, got %d", code)
+	}
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Expected echo through proxy, got %q, %v", buf, err)
+	}
+
+	conn = socksDial(t, proxy, "alice", "secret")
+	if code, _ := socksRequest(t, conn, socksCmdConnect, "127.0.0.1:1"); code != socksNotAllowed {
+		t.Errorf("Expected port outside allowlist to be rejected, got %d", code)
+	}
+	conn = socksDial(t, proxy, "alice", "secret")
+	if code, _ := socksRequest(t, conn, socksCmdConnect, "10.1.2.3:80"); code != socksNotAllowed {
+		t.Errorf("Expected address outside allowlist to be rejected, got %d", code)
+	}
+}
+
+// TestSOCKS5UDPAssociate 测试 UDP ASSOCIATE 转发数据报及其回复
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := target.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			target.WriteToUDP(bytes.ToUpper(buf[:n]), from)
+		}
+	}()
+
+	fwd := startForwarder(t, Rule{Mode: ModeSOCKS5})
+	_, port, _ := net.SplitHostPort(fwd.Stats().Rules[0].Listen)
+	conn := socksDial(t, net.JoinHostPort("127.0.0.1", port), "", "")
+	code, bound := socksRequest(t, conn, socksCmdUDP, "0.0.0.0:0")
+	if code != socksSucceeded {
+		t.Fatalf("Expected UDP ASSOCIATE to succeed, got %d", code)
+	}
+
+	relay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		t.Fatalf("Invalid bound address %q: %v", bound, err)
+	}
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatalf("Failed to dial relay: %v", err)
+	}
+	defer client.Close()
+	packet := appendSOCKSAddr([]byte{0, 0, 0}, target.LocalAddr())
+	client.Write(append(packet, "ping"...))
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	from, payload, err := parseSOCKSUDP(buf[:n])
+	if err != nil {
+		t.Fatalf("Invalid reply: %v", err)
+	}
+	if from != target.LocalAddr().String() || string(payload) != "PING" {
+		t.Errorf("Unexpected reply from %s: %q", from, payload)
+	}
+}
+
+// TestAllowlist 测试允许列表对主机名、通配子域名、网段和端口的匹配
+func TestAllowlist(t *testing.T) {
+	list, err := parseAllowlist([]string{"db.internal:5432", "*.example.com", "10.0.0.0/8:443", "[2001:db8::/32]:22", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("Failed to parse allowlist: %v", err)
+	}
+	names := []struct {
+		host string
+		port int
+		want bool
+	}{
+		{"db.internal", 5432, true},
+		{"DB.internal.", 5432, true},
+		{"db.internal", 22, false},
+		{"api.example.com", 80, true},
+		{"example.com", 80, false},
+	}
+	for _, c := range names {
+		if got := list.allowName(c.host, c.port); got != c.want {
+			t.Errorf("allowName(%s, %d) = %v, want %v", c.host, c.port, got, c.want)
+		}
+	}
+	ips := []struct {
+		ip   string
+		port int
+		want bool
+	}{
+		{"10.2.3.4", 443, true},
+		{"10.2.3.4", 80, false},
+		{"::ffff:10.2.3.4", 443, true},
+		{"2001:db8::1", 22, true},
+		{"192.168.1.1", 8080, true},
+		{"192.168.1.2", 8080, false},
+	}
+	for _, c := range ips {
+		if got := list.allowIP(net.ParseIP(c.ip), c.port); got != c.want {
+			t.Errorf("allowIP(%s, %d) = %v, want %v", c.ip, c.port, got, c.want)
+		}
+	}
+
+	for _, bad := range []string{"10.0.0.0/8:0", "[::1", "10.0.0.0/33"} {
+		if _, err := parseAllowlist([]string{bad}); err == nil {
+			t.Errorf("Expected %q to be invalid", bad)
+		}
+	}
+}
+
+func portOf(addr string) string {
+	_, port, _ := net.SplitHostPort(addr)
+	return port
+}
+
+// TestProxyReloadClosesResolver 测试代理规则被替换或删除时关闭目标解析器
+func TestProxyReloadClosesResolver(t *testing.T) {
+	rule := Rule{Name: "socks", Mode: ModeSOCKS5}
+	fwd := startForwarder(t, rule)
+	resolver := func() *Resolver {
+		fwd.mu.Lock()
+		defer fwd.mu.Unlock()
+		return fwd.listeners[rule.listenKey()].rt.Load().proxy.(*socks5Handler).target.resolver
+	}
+	closed := func(r *Resolver) bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.closed
+	}
+
+	old := resolver()
+	rule.Allow = []string{"10.0.0.0/8"}
+	if err := fwd.Reload([]Rule{rule}); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	replaced := resolver()
+	if !closed(old) || closed(replaced) {
+		t.Error("Expected replaced proxy rule to close only the old resolver")
+	}
+
+	if err := fwd.Reload(nil); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if !closed(replaced) {
+		t.Error("Expected removed proxy rule to close its resolver")
+	}
+}
+
+// TestSOCKS5UDPAssociateSource 测试 UDP ASSOCIATE 的出站数据报使用规则的源地址
+func TestSOCKS5UDPAssociateSource(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer target.Close()
+	senders := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		n, from, err := target.ReadFromUDP(buf)
+		if err == nil {
+			senders <- from.IP.String()
+			target.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	fwd := startForwarder(t, Rule{Mode: ModeSOCKS5, Source: []string{"127.0.0.2"}})
+	conn := socksDial(t, "127.0.0.1:"+portOf(fwd.Stats().Rules[0].Listen), "", "")
+	code, bound := socksRequest(t, conn, socksCmdUDP, "0.0.0.0:0")
+	if code != socksSucceeded {
+		t.Fatalf("Expected UDP ASSOCIATE to succeed, got %d", code)
+	}
+	relay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		t.Fatalf("Invalid bound address %q: %v", bound, err)
+	}
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatalf("Failed to dial relay: %v", err)
+	}
+	defer client.Close()
+	client.Write(append(appendSOCKSAddr([]byte{0, 0, 0}, target.LocalAddr()), "ping"...))
+
+	select {
+	case from := <-senders:
+		if from != "127.0.0.2" {
+			t.Errorf("Expected datagram from source 127.0.0.2, got %s", from)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Datagram did not reach the target")
+	}
+}
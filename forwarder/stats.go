@@ -0,0 +1,89 @@
+package forwarder
+
+import "sort"
+
+// Stats 转发器运行状态的快照
+type Stats struct {
+	Rules []RuleStats // 按规则名称排序
+}
+
+// RuleStats 单条规则的运行状态
+type RuleStats struct {
+	Name     string
+	Listen   string // 实际监听的地址
+	Tunnels  int    // 进行中的隧道数
+	Backends []BackendStats
+
+	// 启用压缩的规则累计的压缩前字节数和链路上实际传输的字节数，两个方向合计
+	UncompressedBytes int64
+	CompressedBytes   int64
+	CompressionRatio  float64 // UncompressedBytes / CompressedBytes，尚未传输数据时为 0
+
+	SourceExhaustions uint64 // 因本地源地址或端口耗尽而失败的出站连接数
+}
+
+// BackendStats 单个后端的运行状态
+type BackendStats struct {
+	Backend             string
+	Backup              bool   // 是否为备用后端
+	State               string // 熔断器状态：closed、open 或 half-open
+	ConsecutiveFailures int
+	Ejections           uint64 // 累计被摘除的次数
+	Tunnels             int64  // 使用该后端的进行中的隧道数
+	Dials               int    // 进行中的拨号数
+	PendingDials        int64  // 等待拨号名额的连接数
+	Overflows           uint64 // 因拨号名额已满被拒绝的连接数
+}
+
+// Stats 返回当前所有规则及其后端的运行状态
+func (f *Forwarder) Stats() Stats {
+	remaining := f.conns.Remaining()
+
+	f.mu.Lock()
+	listeners := make([]*listener, 0, len(f.listeners))
+	for _, l := range f.listeners {
+		listeners = append(listeners, l)
+	}
+	f.mu.Unlock()
+
+	stats := Stats{Rules: make([]RuleStats, 0, len(listeners))}
+	for _, l := range listeners {
+		rt := l.rt.Load()
+		rs := RuleStats{
+			Name:    rt.rule.RuleName(),
+			Listen:  l.address,
+			Tunnels: remaining[rt.rule.RuleName()],
+		}
+		if c, ok := f.compression.Load(rs.Name); ok {
+			c := c.(*compressionStats)
+			rs.UncompressedBytes, rs.CompressedBytes = c.raw.Load(), c.wire.Load()
+			if rs.CompressedBytes > 0 {
+				rs.CompressionRatio = float64(rs.UncompressedBytes) / float64(rs.CompressedBytes)
+			}
+		}
+		if rt.out != nil {
+			rs.SourceExhaustions = rt.out.exhausted.Load()
+		}
+		if rt.pool == nil {
+			stats.Rules = append(stats.Rules, rs)
+			continue
+		}
+		for _, b := range rt.pool.states() {
+			state, failures := b.snapshot()
+			rs.Backends = append(rs.Backends, BackendStats{
+				Backend:             b.backendInfo().String(),
+				Backup:              b == rt.pool.backup,
+				State:               state.String(),
+				ConsecutiveFailures: failures,
+				Ejections:           b.ejectionsTotal.Load(),
+				Tunnels:             b.active.Load(),
+				Dials:               len(b.dials),
+				PendingDials:        b.pending.Load(),
+				Overflows:           b.overflowTotal.Load(),
+			})
+		}
+		stats.Rules = append(stats.Rules, rs)
+	}
+	sort.Slice(stats.Rules, func(i, j int) bool { return stats.Rules[i].Name < stats.Rules[j].Name })
+	return stats
+}
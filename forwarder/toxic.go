@@ -0,0 +1,470 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 故障类型
+const (
+	ToxicLatency   = "latency"   // 每次写出前增加延迟
+	ToxicBandwidth = "bandwidth" // 限制传输速率
+	ToxicSlicer    = "slicer"    // 将数据切成小块分别写出
+	ToxicTimeout   = "timeout"   // 停止转发数据但不关闭连接，作用于隧道后超时关闭
+	ToxicReset     = "reset"     // 作用于隧道后超时以 RST 重置连接
+	ToxicDrop      = "drop"      // 直接关闭新接入的连接
+)
+
+// closeToxic 隧道因注入的故障而关闭
+const closeToxic = "toxic"
+
+var errToxic = errors.New("closed by toxic")
+
+// Toxic 注入到规则隧道中的故障，用于测试客户端的容错能力，可以在运行时增删。
+// 除 drop 外的故障同时作用于新建和已建立的隧道。
+type Toxic struct {
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Stream   string  `json:"stream,omitempty"` // up 或 down，为空时作用于两个方向
+	Toxicity float64 `json:"toxicity"`         // 每条隧道受影响的概率，0 表示不生效，JSON 中省略时为 1
+
+	Latency    time.Duration `json:"-"`                    // latency：增加的延迟
+	Jitter     time.Duration `json:"-"`                    // latency：延迟的随机浮动范围
+	Rate       int64         `json:"rate,omitempty"`       // bandwidth：速率上限，单位 KB/s
+	SliceSize  int           `json:"slice_size,omitempty"` // slicer：每块的字节数
+	SliceDelay time.Duration `json:"-"`                    // slicer：两块之间的间隔
+	Timeout    time.Duration `json:"-"`                    // timeout：作用于隧道多久后关闭连接，0 表示不关闭；reset：作用于隧道多久后重置
+}
+
+// toxicJSON Toxic 的 JSON 形式，时长以毫秒表示
+type toxicJSON struct {
+	*toxicPlain
+	LatencyMs    float64 `json:"latency_ms,omitempty"`
+	JitterMs     float64 `json:"jitter_ms,omitempty"`
+	SliceDelayMs float64 `json:"slice_delay_ms,omitempty"`
+	TimeoutMs    float64 `json:"timeout_ms,omitempty"`
+}
+
+type toxicPlain Toxic
+
+// MarshalJSON 以毫秒输出时长字段
+func (t Toxic) MarshalJSON() ([]byte, error) {
+	return json.Marshal(toxicJSON{
+		toxicPlain:   (*toxicPlain)(&t),
+		LatencyMs:    toMs(t.Latency),
+		JitterMs:     toMs(t.Jitter),
+		SliceDelayMs: toMs(t.SliceDelay),
+		TimeoutMs:    toMs(t.Timeout),
+	})
+}
+
+// UnmarshalJSON 读取以毫秒表示的时长字段，省略 toxicity 时故障总是生效
+func (t *Toxic) UnmarshalJSON(data []byte) error {
+	t.Toxicity = 1
+	v := toxicJSON{toxicPlain: (*toxicPlain)(t)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	t.Latency = fromMs(v.LatencyMs)
+	t.Jitter = fromMs(v.JitterMs)
+	t.SliceDelay = fromMs(v.SliceDelayMs)
+	t.Timeout = fromMs(v.TimeoutMs)
+	return nil
+}
+
+func toMs(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+func fromMs(ms float64) time.Duration { return time.Duration(ms * float64(time.Millisecond)) }
+
+// validate 检查故障设置是否有效
+func (t Toxic) validate() error {
+	if t.Name == "" {
+		return errors.New("empty toxic name")
+	}
+	if t.Stream != "" && t.Stream != "up" && t.Stream != "down" {
+		return fmt.Errorf("invalid stream %q", t.Stream)
+	}
+	if t.Toxicity < 0 || t.Toxicity > 1 {
+		return errors.New("toxicity must be between 0 and 1")
+	}
+	if t.Latency < 0 || t.Jitter < 0 || t.SliceDelay < 0 || t.Timeout < 0 {
+		return errors.New("negative duration")
+	}
+	switch t.Type {
+	case ToxicLatency, ToxicTimeout, ToxicReset, ToxicDrop:
+	case ToxicBandwidth:
+		if t.Rate <= 0 {
+			return errors.New("bandwidth toxic requires a positive rate")
+		}
+	case ToxicSlicer:
+		if t.SliceSize <= 0 {
+			return errors.New("slicer toxic requires a positive slice size")
+		}
+	default:
+		return fmt.Errorf("unknown toxic type %q", t.Type)
+	}
+	return nil
+}
+
+// appliesTo 判断故障是否作用于该方向
+func (t *Toxic) appliesTo(dir Direction) bool {
+	return t.Stream == "" || t.Stream == dir.String()
+}
+
+// hit 按 toxicity 随机决定故障是否生效
+func (t *Toxic) hit() bool {
+	return rand.Float64() < t.Toxicity
+}
+
+// toxicRegistry 按规则名称保存故障，读取时无锁
+type toxicRegistry struct {
+	mu    sync.Mutex
+	rules atomic.Pointer[map[string][]*Toxic]
+	conns map[string]map[*toxicConn]struct{} // 各规则当前隧道的连接，故障变化时同步其定时器
+}
+
+// get 返回规则当前的故障列表
+func (r *toxicRegistry) get(rule string) []*Toxic {
+	if m := r.rules.Load(); m != nil {
+		return (*m)[rule]
+	}
+	return nil
+}
+
+// update 以写时复制的方式修改规则的故障列表
+func (r *toxicRegistry) update(rule string, fn func([]*Toxic) ([]*Toxic, error)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m := make(map[string][]*Toxic)
+	if old := r.rules.Load(); old != nil {
+		for k, v := range *old {
+			m[k] = v
+		}
+	}
+	toxics, err := fn(slices.Clone(m[rule]))
+	if err != nil {
+		return err
+	}
+	if len(toxics) == 0 {
+		delete(m, rule)
+	} else {
+		m[rule] = toxics
+	}
+	r.rules.Store(&m)
+	for c := range r.conns[rule] {
+		c.sync(toxics)
+	}
+	return nil
+}
+
+// all 返回所有规则的故障
+func (r *toxicRegistry) all() map[string][]Toxic {
+	result := make(map[string][]Toxic)
+	if m := r.rules.Load(); m != nil {
+		for rule, toxics := range *m {
+			for _, t := range toxics {
+				result[rule] = append(result[rule], *t)
+			}
+		}
+	}
+	return result
+}
+
+// drop 判断规则的新连接是否应被丢弃
+func (r *toxicRegistry) drop(rule string) bool {
+	for _, t := range r.get(rule) {
+		if t.Type == ToxicDrop && t.hit() {
+			return true
+		}
+	}
+	return false
+}
+
+// AddToxic 为规则添加故障，同名故障会被替换
+func (f *Forwarder) AddToxic(rule string, toxic Toxic) error {
+	if err := toxic.validate(); err != nil {
+		return err
+	}
+	if !f.hasRule(rule) {
+		return fmt.Errorf("unknown rule %q", rule)
+	}
+	err := f.toxics.update(rule, func(toxics []*Toxic) ([]*Toxic, error) {
+		toxics = slices.DeleteFunc(toxics, func(t *Toxic) bool { return t.Name == toxic.Name })
+		return append(toxics, &toxic), nil
+	})
+	if err == nil {
+		f.log.WithField(fieldRule, rule).Warnf("Toxic %s (%s) added.", toxic.Name, toxic.Type)
+	}
+	return err
+}
+
+// RemoveToxic 删除规则的故障，name 为空时删除该规则的全部故障
+func (f *Forwarder) RemoveToxic(rule, name string) error {
+	// 已删除的规则仍可清除其遗留的故障
+	if !f.hasRule(rule) && len(f.toxics.get(rule)) == 0 {
+		return fmt.Errorf("unknown rule %q", rule)
+	}
+	err := f.toxics.update(rule, func(toxics []*Toxic) ([]*Toxic, error) {
+		if name == "" {
+			return nil, nil
+		}
+		n := len(toxics)
+		toxics = slices.DeleteFunc(toxics, func(t *Toxic) bool { return t.Name == name })
+		if len(toxics) == n {
+			return nil, fmt.Errorf("unknown toxic %q", name)
+		}
+		return toxics, nil
+	})
+	if err == nil {
+		f.log.WithField(fieldRule, rule).Infof("Toxic %s removed.", name)
+	}
+	return err
+}
+
+// Toxics 返回所有规则当前的故障，键为规则名称
+func (f *Forwarder) Toxics() map[string][]Toxic {
+	return f.toxics.all()
+}
+
+// hasRule 判断是否存在指定名称的规则
+func (f *Forwarder) hasRule(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.ContainsFunc(f.rules, func(r Rule) bool { return r.RuleName() == name })
+}
+
+// toxicConn 按规则当前的故障列表写出数据，故障在运行时增删后立即对已建立的隧道生效
+type toxicConn struct {
+	net.Conn
+	ctx     context.Context
+	toxics  *toxicRegistry
+	rule    string
+	dir     Direction
+	timeout time.Duration
+	reset   func()
+
+	mu       sync.Mutex
+	decision map[*Toxic]bool        // 每个故障对本隧道是否生效，只在首次遇到时决定
+	timers   map[*Toxic]*time.Timer // 生效的 timeout 和 reset 故障到期时关闭连接
+	expired  chan struct{}          // timeout 或 reset 故障到期后关闭
+	err      error
+}
+
+// newToxicConn 包装隧道一个方向的目标连接，reset 使整条隧道关闭时以 RST 结束。
+// 隧道结束即 ctx 取消前，连接登记在 r 中，规则已有的和之后添加的 timeout 和 reset 故障都会为它计时
+func (r *toxicRegistry) newToxicConn(ctx context.Context, conn net.Conn, rule string, dir Direction, timeout time.Duration, reset func()) *toxicConn {
+	c := &toxicConn{
+		Conn:     conn,
+		ctx:      ctx,
+		toxics:   r,
+		rule:     rule,
+		dir:      dir,
+		timeout:  timeout,
+		reset:    reset,
+		decision: make(map[*Toxic]bool),
+		timers:   make(map[*Toxic]*time.Timer),
+		expired:  make(chan struct{}),
+	}
+
+	r.mu.Lock()
+	if r.conns == nil {
+		r.conns = make(map[string]map[*toxicConn]struct{})
+	}
+	if r.conns[rule] == nil {
+		r.conns[rule] = make(map[*toxicConn]struct{})
+	}
+	r.conns[rule][c] = struct{}{}
+	c.sync(r.get(rule))
+	r.mu.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		r.mu.Lock()
+		delete(r.conns[rule], c)
+		if len(r.conns[rule]) == 0 {
+			delete(r.conns, rule)
+		}
+		r.mu.Unlock()
+		c.sync(nil)
+	})
+	return c
+}
+
+// decide 返回故障对本方向是否生效，调用方持有 c.mu
+func (c *toxicConn) decide(t *Toxic) bool {
+	if t.Type == ToxicDrop || !t.appliesTo(c.dir) {
+		return false
+	}
+	hit, ok := c.decision[t]
+	if !ok {
+		hit = t.hit()
+		c.decision[t] = hit
+	}
+	return hit
+}
+
+// active 返回当前对本方向生效的故障
+func (c *toxicConn) active() []*Toxic {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var active []*Toxic
+	for _, t := range c.toxics.get(c.rule) {
+		if c.decide(t) {
+			active = append(active, t)
+		}
+	}
+	return active
+}
+
+// sync 按规则当前的故障列表调整定时器：停止已删除故障的定时器，为新生效的 timeout 和 reset 故障开始计时，
+// 即从故障添加到已有隧道或新隧道建立时起计时。超时为 0 的 reset 故障立即重置，不等待下一次写出
+func (c *toxicConn) sync(toxics []*Toxic) {
+	var due []*Toxic
+	c.mu.Lock()
+	for t, timer := range c.timers {
+		if !slices.Contains(toxics, t) {
+			timer.Stop()
+			delete(c.timers, t)
+		}
+	}
+	for _, t := range toxics {
+		timed := t.Type == ToxicReset || (t.Type == ToxicTimeout && t.Timeout > 0)
+		if c.ctx.Err() != nil || !timed || c.timers[t] != nil || !c.decide(t) {
+			continue
+		}
+		if t.Type == ToxicReset && t.Timeout == 0 {
+			due = append(due, t)
+			continue
+		}
+		c.timers[t] = time.AfterFunc(t.Timeout, func() { c.expire(t) })
+	}
+	c.mu.Unlock()
+
+	for _, t := range due {
+		c.expire(t)
+	}
+}
+
+// expire 在 timeout 或 reset 故障到期且仍未删除时关闭连接，唤醒阻塞的读写，reset 故障使隧道以 RST 结束
+func (c *toxicConn) expire(t *Toxic) {
+	if c.ctx.Err() != nil || !slices.Contains(c.toxics.get(c.rule), t) {
+		return
+	}
+	if t.Type == ToxicReset {
+		c.reset()
+	}
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = fmt.Errorf("%w %s", errToxic, t.Name)
+		close(c.expired)
+	}
+	c.mu.Unlock()
+	c.Conn.Close()
+}
+
+// cause 在 timeout 故障到期关闭连接后返回故障错误，否则返回 err
+func (c *toxicConn) cause(err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return err
+}
+
+func (c *toxicConn) Write(b []byte) (int, error) {
+	toxics := c.active()
+	if len(toxics) == 0 {
+		return c.Conn.Write(b)
+	}
+	return c.write(toxics, b)
+}
+
+// write 依次应用 toxics 后写出数据，返回实际写出的字节数
+func (c *toxicConn) write(toxics []*Toxic, b []byte) (int, error) {
+	if len(toxics) == 0 {
+		// 故障造成的等待可能已超过调用方设置的写超时
+		c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+		return c.Conn.Write(b)
+	}
+
+	t, rest := toxics[0], toxics[1:]
+	switch t.Type {
+	case ToxicLatency:
+		delay := t.Latency
+		if t.Jitter > 0 {
+			delay += time.Duration(rand.Int64N(int64(2*t.Jitter))) - t.Jitter
+		}
+		if err := sleepContext(c.ctx, delay); err != nil {
+			return 0, err
+		}
+	case ToxicBandwidth:
+		// 每次最多写出 100ms 的数据量，写完后按速率等待
+		chunk := max(int(t.Rate*1024/10), 1)
+		written := 0
+		for written < len(b) {
+			end := min(written+chunk, len(b))
+			n, err := c.write(rest, b[written:end])
+			written += n
+			if err != nil {
+				return written, err
+			}
+			if err := sleepContext(c.ctx, time.Duration(n)*time.Second/time.Duration(t.Rate*1024)); err != nil {
+				return written, err
+			}
+		}
+		return written, nil
+	case ToxicSlicer:
+		written := 0
+		for written < len(b) {
+			if written > 0 {
+				if err := sleepContext(c.ctx, t.SliceDelay); err != nil {
+					return written, err
+				}
+			}
+			end := min(written+t.SliceSize, len(b))
+			n, err := c.write(rest, b[written:end])
+			written += n
+			if err != nil {
+				return written, err
+			}
+		}
+		return written, nil
+	case ToxicTimeout:
+		return c.stall(t, rest, b)
+	}
+	return c.write(rest, b)
+}
+
+// stall 在 timeout 故障生效期间阻塞写出，故障被删除后继续转发，到期后随连接关闭返回
+func (c *toxicConn) stall(t *Toxic, rest []*Toxic, b []byte) (int, error) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return 0, c.ctx.Err()
+		case <-c.expired:
+			return 0, c.cause(nil)
+		case <-ticker.C:
+			if !slices.Contains(c.toxics.get(c.rule), t) {
+				return c.write(rest, b)
+			}
+		}
+	}
+}
+
+// resetOnClose 使 TCP 连接关闭时发送 RST 而不是 FIN
+func resetOnClose(conn net.Conn) {
+	if tcp, ok := netConn(conn).(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+}
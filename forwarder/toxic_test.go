@@ -0,0 +1,219 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestToxicJSON 测试故障的 JSON 形式以毫秒表示时长
+func TestToxicJSON(t *testing.T) {
+	var toxic Toxic
+	data := `{"name":"slow","type":"latency","stream":"down","latency_ms":150,"jitter_ms":20.5}`
+	if err := json.Unmarshal([]byte(data), &toxic); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	want := Toxic{Name: "slow", Type: ToxicLatency, Stream: "down", Toxicity: 1, Latency: 150 * time.Millisecond, Jitter: 20500 * time.Microsecond}
+	if toxic != want {
+		t.Errorf("Expected %+v, got %+v", want, toxic)
+	}
+
+	out, err := json.Marshal(toxic)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+	var back Toxic
+	if err := json.Unmarshal(out, &back); err != nil || back != toxic {
+		t.Errorf("Round trip mismatch: %s", out)
+	}
+
+	// 显式的 0 表示故障不生效，且在往返后保持不变
+	var off Toxic
+	if err := json.Unmarshal([]byte(`{"name":"off","type":"drop","toxicity":0}`), &off); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if off.Toxicity != 0 || off.hit() {
+		t.Errorf("Expected explicit zero toxicity to disable the toxic, got %v", off.Toxicity)
+	}
+	out, _ = json.Marshal(off)
+	back = Toxic{}
+	if err := json.Unmarshal(out, &back); err != nil || back != off {
+		t.Errorf("Round trip mismatch: %s", out)
+	}
+
+	for _, bad := range []Toxic{
+		{Name: "x", Type: "melt"},
+		{Type: ToxicLatency},
+		{Name: "x", Type: ToxicBandwidth},
+		{Name: "x", Type: ToxicSlicer},
+		{Name: "x", Type: ToxicLatency, Stream: "sideways"},
+		{Name: "x", Type: ToxicDrop, Toxicity: 1.5},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", bad)
+		}
+	}
+}
+
+// TestToxicBandwidth 测试带宽限制按速率写出数据
+func TestToxicBandwidth(t *testing.T) {
+	var r toxicRegistry
+	r.update("r", func([]*Toxic) ([]*Toxic, error) {
+		return []*Toxic{{Name: "bw", Type: ToxicBandwidth, Toxicity: 1, Rate: 10}}, nil
+	})
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+
+	conn := r.newToxicConn(context.Background(), client, "r", Upstream, time.Second, func() {})
+	start := time.Now()
+	n, err := conn.Write(make([]byte, 3*1024))
+	if err != nil || n != 3*1024 {
+		t.Fatalf("Write returned %d, %v", n, err)
+	}
+	// 10 KB/s 写出 3 KB 至少需要 300ms
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("Bandwidth limit not applied, took %v", elapsed)
+	}
+}
+
+// TestForwarderToxics 测试运行时增删的故障作用于规则的隧道
+func TestForwarderToxics(t *testing.T) {
+	fwd := startForwarder(t, Rule{Name: "echo", Backends: []Backend{echoServer(t)}})
+	addr := fwd.Stats().Rules[0].Listen
+
+	if err := fwd.AddToxic("missing", Toxic{Name: "x", Type: ToxicDrop}); err == nil {
+		t.Error("Expected toxic for unknown rule to be rejected")
+	}
+	if err := fwd.RemoveToxic("missing", ""); err == nil {
+		t.Error("Expected removing toxics of an unknown rule to fail")
+	}
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	roundTrip := func() time.Duration {
+		start := time.Now()
+		client.Write([]byte("ping"))
+		if _, err := io.ReadFull(client, make([]byte, 4)); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		return time.Since(start)
+	}
+
+	// 延迟对已建立的隧道立即生效
+	if err := fwd.AddToxic("echo", Toxic{Name: "slow", Type: ToxicLatency, Stream: "down", Toxicity: 1, Latency: 200 * time.Millisecond}); err != nil {
+		t.Fatalf("Failed to add toxic: %v", err)
+	}
+	if d := roundTrip(); d < 200*time.Millisecond {
+		t.Errorf("Expected added latency, round trip took %v", d)
+	}
+	if err := fwd.RemoveToxic("echo", "slow"); err != nil {
+		t.Fatalf("Failed to remove toxic: %v", err)
+	}
+
+	// 超时故障阻塞数据但不关闭连接，删除后恢复转发
+	fwd.AddToxic("echo", Toxic{Name: "stall", Type: ToxicTimeout, Stream: "up", Toxicity: 1})
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		fwd.RemoveToxic("echo", "stall")
+	}()
+	if d := roundTrip(); d < 300*time.Millisecond {
+		t.Errorf("Expected stalled data, round trip took %v", d)
+	}
+	if toxics := fwd.Toxics(); len(toxics) != 0 {
+		t.Errorf("Expected no toxics left, got %+v", toxics)
+	}
+
+	// 重置故障以 RST 关闭隧道，不等待数据写出
+	fwd.AddToxic("echo", Toxic{Name: "reset", Type: ToxicReset, Toxicity: 1})
+	if _, err := client.Read(make([]byte, 4)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Expected connection reset, got %v", err)
+	}
+
+	// 丢弃新连接
+	fwd.RemoveToxic("echo", "")
+	fwd.AddToxic("echo", Toxic{Name: "drop", Type: ToxicDrop, Toxicity: 1})
+	dropped, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer dropped.Close()
+	dropped.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := dropped.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected dropped connection, got %v", err)
+	}
+}
+
+// TestToxicTimeoutIdle 测试 timeout 故障从添加时起计时，没有数据写出的隧道也会到期关闭
+func TestToxicTimeoutIdle(t *testing.T) {
+	fwd := startForwarder(t, Rule{Name: "echo", Backends: []Backend{echoServer(t)}})
+	addr := fwd.Stats().Rules[0].Listen
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("ping"))
+	if _, err := io.ReadFull(client, make([]byte, 4)); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+
+	// toxicity 为 0 的故障不生效
+	if err := fwd.AddToxic("echo", Toxic{Name: "off", Type: ToxicTimeout, Timeout: 100 * time.Millisecond}); err != nil {
+		t.Fatalf("Failed to add toxic: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	client.Write([]byte("ping"))
+	if _, err := io.ReadFull(client, make([]byte, 4)); err != nil {
+		t.Fatalf("Expected tunnel to survive a toxic with zero toxicity, got %v", err)
+	}
+
+	start := time.Now()
+	if err := fwd.AddToxic("echo", Toxic{Name: "idle", Type: ToxicTimeout, Toxicity: 1, Timeout: 300 * time.Millisecond}); err != nil {
+		t.Fatalf("Failed to add toxic: %v", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected tunnel to be closed by the timeout toxic")
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Tunnel closed after %v, want about 300ms", elapsed)
+	}
+}
+
+// TestToxicResetIdle 测试 reset 故障从添加时起计时，没有数据写出的隧道也会被重置
+func TestToxicResetIdle(t *testing.T) {
+	fwd := startForwarder(t, Rule{Name: "echo", Backends: []Backend{echoServer(t)}})
+	client, err := net.Dial("tcp", fwd.Stats().Rules[0].Listen)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("ping"))
+	if _, err := io.ReadFull(client, make([]byte, 4)); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+
+	start := time.Now()
+	if err := fwd.AddToxic("echo", Toxic{Name: "reset", Type: ToxicReset, Toxicity: 1, Timeout: 300 * time.Millisecond}); err != nil {
+		t.Fatalf("Failed to add toxic: %v", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Expected connection reset, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Tunnel reset after %v, want about 300ms", elapsed)
+	}
+}
@@ -0,0 +1,116 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var errHalfCloseUnsupported = errors.New("half-close not supported")
+
+// propagateEOF 在源端正常结束时关闭目标的写方向，目标不支持半关闭时返回错误以关闭整条隧道
+func propagateEOF(dst io.Writer, err error) error {
+	if err != nil {
+		return err
+	}
+	cw, ok := dst.(interface{ CloseWrite() error })
+	if !ok {
+		return errHalfCloseUnsupported
+	}
+	return cw.CloseWrite()
+}
+
+type idleTimeoutKey struct{}
+
+// withIdleTimeout 将传输的读写超时附加到上下文
+func withIdleTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, idleTimeoutKey{}, timeout)
+}
+
+// idleTimeoutFrom 取出上下文中的读写超时，不存在时使用默认连接超时
+func idleTimeoutFrom(ctx context.Context) time.Duration {
+	if timeout, ok := ctx.Value(idleTimeoutKey{}).(time.Duration); ok {
+		return timeout
+	}
+	return DefaultTimeout
+}
+
+type bufferPoolKey struct{}
+
+// withBufferPool 将传输使用的缓冲池附加到上下文
+func withBufferPool(ctx context.Context, pool *bufferPool) context.Context {
+	return context.WithValue(ctx, bufferPoolKey{}, pool)
+}
+
+// defaultBufferPool 上下文中没有缓冲池时使用的缓冲池，供直接调用 TransferWithContext 的使用方共享
+var defaultBufferPool = newBufferPool()
+
+// bufferPoolFrom 取出上下文中的缓冲池，不存在时返回 defaultBufferPool
+func bufferPoolFrom(ctx context.Context) *bufferPool {
+	if pool, ok := ctx.Value(bufferPoolKey{}).(*bufferPool); ok {
+		return pool
+	}
+	return defaultBufferPool
+}
+
+// TransferWithContext 带上下文的传输函数，数据依次经过 filters 处理后写到目标端，返回写入的字节数；
+// 源端正常结束时返回 nil。缓冲区取自转发器共享的缓冲池，直接调用时取自包内默认的缓冲池，
+// 并按吞吐量调整大小，读写超时粗粒度地延长
+func TransferWithContext(ctx context.Context, dst io.Writer, src io.Reader, filters ...Filter) (int64, error) {
+	buffer := newAdaptiveBuffer(bufferPoolFrom(ctx))
+	defer buffer.release()
+	timeout := idleTimeoutFrom(ctx)
+
+	var readDeadline, writeDeadline coarseDeadline
+	if conn, ok := src.(net.Conn); ok {
+		readDeadline = coarseDeadline{set: conn.SetReadDeadline, timeout: timeout}
+	}
+	if conn, ok := dst.(net.Conn); ok {
+		writeDeadline = coarseDeadline{set: conn.SetWriteDeadline, timeout: timeout}
+	}
+
+	var written int64
+	write := func(data []byte) error {
+		writeDeadline.extend(time.Now())
+		nw, err := dst.Write(data)
+		written += int64(nw)
+		if err != nil {
+			loggerFrom(ctx).WithError(err).Debug("Write error during transfer.")
+		}
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return written, ctx.Err()
+		default:
+			readDeadline.extend(time.Now())
+			buf := buffer.bytes()
+			n, err := src.Read(buf)
+			if n > 0 {
+				data, filterErr := runFilters(ctx, filters, buf[:n])
+				if filterErr != nil {
+					loggerFrom(ctx).WithError(filterErr).Debug("Filter closed the tunnel.")
+					return written, filterErr
+				}
+				if len(data) > 0 {
+					if writeErr := write(data); writeErr != nil {
+						return written, writeErr
+					}
+				}
+				buffer.observe(n)
+			}
+
+			if err != nil {
+				if err != io.EOF {
+					loggerFrom(ctx).WithError(err).Debug("Read error during transfer.")
+					return written, err
+				}
+				return written, flushFilters(ctx, filters, write)
+			}
+		}
+	}
+}
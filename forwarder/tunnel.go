@@ -0,0 +1,251 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// transferResult 单个方向的传输结果
+type transferResult struct {
+	up      bool
+	written int64
+	err     error
+}
+
+// handle 处理单个客户端连接：连接后端并双向转发数据，结束时记录访问日志
+func (f *Forwarder) handle(upstream net.Conn, rt *ruleRuntime, log *logrus.Entry, record *AccessRecord) {
+	defer f.conns.RemoveConnection(upstream)
+
+	client := f.conns.Track(upstream)
+	defer func() {
+		record.Duration = time.Since(record.Start)
+		log.WithFields(logrus.Fields{
+			fieldBackend:   record.Backend,
+			fieldBytesUp:   record.BytesUp,
+			fieldBytesDown: record.BytesDown,
+			fieldDuration:  record.Duration.String(),
+		}).Infof("Tunnel closed, %s.", record.CloseReason)
+		if f.opts.AccessLog != nil {
+			if err := f.opts.AccessLog.Log(record); err != nil {
+				log.WithError(err).Warn("Failed to write access log.")
+			}
+		}
+	}()
+
+	// 设置连接超时
+	upstream.SetDeadline(time.Now().Add(f.opts.Timeout))
+
+	// 对端转发器的连接依次经过 WebSocket 和加密或压缩，握手完成后客户端方向的数据都经最内层读写
+	if rt.rule.WebSocketAccept != "" {
+		conn, err := wsServer(client, rt.rule)
+		if err != nil {
+			record.CloseReason = closeError
+			log.WithError(err).Warn("WebSocket upgrade failed.")
+			return
+		}
+		client = conn
+		defer conn.Close()
+	}
+	if rt.rule.Decrypt != "" {
+		conn, keyID, err := secureServer(client, rt.rule.Decrypt)
+		if err != nil {
+			record.CloseReason = closeError
+			log.WithError(err).Warn("Secure handshake failed.")
+			return
+		}
+		client = conn
+		log.WithField(fieldKeyID, keyID).Debug("Secure tunnel established.")
+	}
+	if rt.rule.Decompress != "" {
+		conn, err := compressServer(client, rt.rule.Decompress, f.compressionStats(record.Rule))
+		if err != nil {
+			record.CloseReason = closeError
+			log.WithError(err).Warn("Compression handshake failed.")
+			return
+		}
+		client = conn
+	}
+	// 排空时经最内层的连接半关闭，对端转发器才能收到加密或 WebSocket 的结束标记
+	f.conns.setInner(upstream, client)
+
+	// 代理模式先与客户端握手并连接客户端指定的目标；转发模式连接后端池，
+	// 失败时按规则的重试策略重试或切换后端
+	var downstream net.Conn
+	var backend *backendState
+	var err error
+	dialStart := time.Now()
+	if rt.proxy != nil {
+		downstream, err = rt.proxy.accept(f.conns.ctx, client, record, log)
+		if err == nil && downstream == nil {
+			// 请求已在握手中处理完毕
+			return
+		}
+	} else if downstream, backend, err = rt.pool.dial(f.conns.ctx, log); err == nil {
+		record.Backend = backend.backendInfo().String()
+	}
+	record.DialTime = time.Since(dialStart)
+	if err != nil {
+		record.CloseReason = closeError
+		if rt.proxy != nil {
+			log.WithError(err).Warn("Proxy request failed.")
+		} else {
+			log.WithError(err).Error("Failed to connect to backend.")
+		}
+		return
+	}
+	defer downstream.Close()
+	log = log.WithField(fieldBackend, record.Backend)
+
+	// 被动异常检测：连接建立后很快被后端重置或无数据关闭视为后端失败
+	var backendErr error
+	if backend != nil {
+		backend.active.Add(1)
+		defer backend.active.Add(-1)
+		earlyFailure := backend.watch()
+		defer func() {
+			if backendErr != nil {
+				earlyFailure("reset")
+			} else if record.CloseReason == closeBackendEOF && record.BytesDown == 0 {
+				earlyFailure("closed")
+			}
+		}()
+	}
+
+	// 设置下游连接超时
+	downstream.SetDeadline(time.Now().Add(f.opts.Timeout))
+
+	// 压缩规则与后端转发器协商压缩，压缩规则不会同时加密
+	if rt.rule.Compress != "" {
+		conn, err := compressClient(downstream, rt.rule.Compress, f.compressionStats(record.Rule))
+		if err != nil {
+			record.CloseReason = closeError
+			log.WithError(err).Error("Compression handshake failed.")
+			return
+		}
+		downstream = conn
+	}
+
+	// 添加到连接管理器 - 修复：只有在连接成功后才添加
+	f.conns.AddConnection(downstream)
+	defer f.conns.RemoveConnection(downstream)
+
+	// 按规则配置为两个方向分别创建过滤器链
+	info := StreamInfo{ConnID: record.ConnID, Rule: record.Rule, Client: record.Client, Backend: record.Backend}
+	upFilters, downFilters, err := f.newFilters(rt.rule.Filters, info)
+	if err != nil {
+		record.CloseReason = closeError
+		log.WithError(err).Error("Failed to create filters.")
+		return
+	}
+
+	log.Info("Forwarding traffic.")
+
+	// 创建上下文用于控制传输，取消时关闭两端连接以唤醒阻塞的读写
+	ctx, cancel := context.WithCancel(withBufferPool(withIdleTimeout(withLogger(f.conns.ctx, log), f.opts.Timeout), f.buffers))
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		upstream.Close()
+		downstream.Close()
+	})
+	defer stop()
+
+	// 注入的故障在写出时生效，运行时增删故障会立即作用于本隧道
+	reset := func() {
+		resetOnClose(upstream)
+		resetOnClose(downstream)
+	}
+	upDst := f.toxics.newToxicConn(ctx, downstream, record.Rule, Upstream, f.opts.Timeout, reset)
+	downDst := f.toxics.newToxicConn(ctx, client, record.Rule, Downstream, f.opts.Timeout, reset)
+
+	// 任一方向读到 EOF 时只关闭对端的写方向，另一方向继续传输
+	results := make(chan transferResult, 2)
+	go func() {
+		n, err := TransferWithContext(ctx, upDst, client, upFilters...)
+		results <- transferResult{up: true, written: n, err: propagateEOF(downstream, err)}
+	}()
+	go func() {
+		n, err := TransferWithContext(ctx, downDst, downstream, downFilters...)
+		results <- transferResult{up: false, written: n, err: propagateEOF(client, err)}
+	}()
+
+	// 等待两个方向都结束；出错、超过生命周期或半关闭后逗留超时则关闭整条隧道，
+	// 以最先发生的事件作为关闭原因
+	lifetime := time.NewTimer(f.opts.Timeout)
+	defer lifetime.Stop()
+	var linger <-chan time.Time
+	setReason := func(reason string) {
+		if record.CloseReason == "" {
+			record.CloseReason = reason
+		}
+	}
+	for pending := 2; pending > 0; {
+		select {
+		case res := <-results:
+			pending--
+			if res.up {
+				record.BytesUp += res.written
+			} else {
+				record.BytesDown += res.written
+				if record.CloseReason == "" {
+					// 只有后端方向最先出错时才归咎于后端
+					backendErr = res.err
+				}
+			}
+			if res.err != nil {
+				// timeout 故障到期关闭连接时另一方向也会读写失败，以故障作为关闭原因
+				setReason(f.closeReason(upDst.cause(downDst.cause(res.err))))
+				cancel()
+			} else {
+				if res.up {
+					setReason(closeClientEOF)
+				} else {
+					setReason(closeBackendEOF)
+				}
+				if pending == 1 {
+					linger = time.After(f.opts.HalfCloseLinger)
+				}
+			}
+		case <-linger:
+			cancel()
+		case <-lifetime.C:
+			// 超时保护，避免goroutine泄漏
+			setReason(closeLifetime)
+			cancel()
+		}
+	}
+}
+
+// newFilters 为隧道的上行和下行方向创建过滤器链
+func (f *Forwarder) newFilters(names []string, info StreamInfo) (up, down []Filter, err error) {
+	if len(names) == 0 {
+		return nil, nil, nil
+	}
+	info.Direction = Upstream
+	if up, err = newFilterChain(f.opts.Filters, names, info); err != nil {
+		return nil, nil, err
+	}
+	info.Direction = Downstream
+	if down, err = newFilterChain(f.opts.Filters, names, info); err != nil {
+		return nil, nil, err
+	}
+	return up, down, nil
+}
+
+// closeReason 根据传输错误判断隧道关闭原因
+func (f *Forwarder) closeReason(err error) string {
+	if f.conns.ctx.Err() != nil {
+		return closeShutdown
+	}
+	if errors.Is(err, errToxic) {
+		return closeToxic
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return closeIdleTimeout
+	}
+	return closeError
+}
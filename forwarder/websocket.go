@@ -0,0 +1,485 @@
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WebSocket 传输（RFC 6455）。入口转发器（websocket 规则连接后端时）以 HTTP 升级请求携带 Bearer 令牌
+// 连接出口转发器（websocket-accept 规则），之后隧道数据以二进制帧传输。入口可以经 HTTP 代理的 CONNECT
+// 隧道和 TLS（wss）连接出口，未启用 TLS 时令牌以明文传输，须同时启用 encrypt。
+//
+// WebSocket 没有半关闭：一端的写方向结束时发送关闭帧，对端读到关闭帧视为 EOF，并在自己的写方向结束时
+// 回复关闭帧，双方都发送过关闭帧后隧道结束。底层 TCP 连接不做半关闭，因为 HTTP 代理通常会把它当作断开。
+const (
+	wsGUID         = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxFrame     = 32 << 10
+	wsPingInterval = 30 * time.Second
+)
+
+// 帧类型
+const (
+	wsContinuation byte = 0x0
+	wsText         byte = 0x1
+	wsBinary       byte = 0x2
+	wsClose        byte = 0x8
+	wsPing         byte = 0x9
+	wsPong         byte = 0xa
+)
+
+// 关闭状态码
+const (
+	wsCloseNormal      = 1000
+	wsCloseProtocol    = 1002
+	wsCloseUnsupported = 1003
+)
+
+var errWSProtocol = errors.New("websocket protocol error")
+
+// wsClient 在到后端或 HTTP 代理的连接上依次完成代理的 CONNECT、TLS 握手和 WebSocket 升级，address 为后端地址
+func wsClient(ctx context.Context, conn net.Conn, address string, rule Rule) (net.Conn, error) {
+	if rule.WebSocketProxy != "" {
+		proxy, err := parseProxyURL(rule.WebSocketProxy)
+		if err != nil {
+			return nil, err
+		}
+		if err := proxyConnect(conn, proxy, address); err != nil {
+			return nil, fmt.Errorf("proxy %s: %w", proxy.Host, err)
+		}
+	}
+	if rule.WebSocketTLS {
+		config, err := wsClientTLS(address, rule.WebSocketCA)
+		if err != nil {
+			return nil, err
+		}
+		tc := tls.Client(conn, config)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return nil, fmt.Errorf("tls handshake: %w", err)
+		}
+		conn = tc
+	}
+	return dialWebSocket(conn, address, rule.WebSocket, rule.TokenFile)
+}
+
+// wsServer 在 websocket-accept 规则的客户端连接上依次完成可选的 TLS 握手和 WebSocket 升级
+func wsServer(conn net.Conn, rule Rule) (net.Conn, error) {
+	if rule.WebSocketCert != "" {
+		cert, err := tls.LoadX509KeyPair(rule.WebSocketCert, rule.WebSocketKey)
+		if err != nil {
+			return nil, err
+		}
+		tc := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+		if err := tc.Handshake(); err != nil {
+			return nil, fmt.Errorf("tls handshake: %w", err)
+		}
+		conn = tc
+	}
+	return acceptWebSocket(conn, rule.WebSocketAccept, rule.TokenFile)
+}
+
+// wsClientTLS 返回连接 address 的 TLS 设置，caFile 为空时使用系统根证书校验后端证书
+func wsClientTLS(address, caFile string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+	return config, nil
+}
+
+// parseProxyURL 解析 HTTPS_PROXY 形式的代理地址，只支持 http://[user:password@]host:port
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" || u.Hostname() == "" || u.Port() == "" {
+		return nil, errors.New("proxy must be http://host:port")
+	}
+	return u, nil
+}
+
+// proxyConnect 请求 HTTP 代理建立到 address 的 CONNECT 隧道，代理地址带用户名时使用基本认证
+func proxyConnect(conn net.Conn, proxy *url.URL, address string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		b.WriteString("Proxy-Authorization: Basic " + credentials + "\r\n")
+	}
+	b.WriteString("\r\n")
+	if _, err := io.WriteString(conn, b.String()); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT rejected: %s", resp.Status)
+	}
+	// 隧道建立后先由本端发送数据，代理不应多发任何字节
+	if br.Buffered() > 0 {
+		return errors.New("unexpected data after CONNECT response")
+	}
+	return nil
+}
+
+// dialWebSocket 在已建立的连接上发送升级请求，返回 WebSocket 连接
+func dialWebSocket(conn net.Conn, host, path, tokenFile string) (net.Conn, error) {
+	token, err := loadToken(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\nAuthorization: Bearer %s\r\n\r\n", path, host, key, token)
+	if _, err := io.WriteString(conn, req); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("upgrade rejected: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, errors.New("invalid Sec-WebSocket-Accept")
+	}
+	return newWSConn(conn, br, true), nil
+}
+
+// acceptWebSocket 读取客户端的升级请求，校验路径和 Bearer 令牌后返回 WebSocket 连接，
+// 不符合要求的请求收到对应的 HTTP 错误
+func acceptWebSocket(conn net.Conn, path, tokenFile string) (net.Conn, error) {
+	token, err := loadToken(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	req, br, err := readHTTPRequest(conn)
+	if err != nil {
+		if errors.Is(err, errHeaderTooLarge) {
+			writeHTTPStatus(conn, http.StatusRequestHeaderFieldsTooLarge, nil)
+		}
+		return nil, err
+	}
+	req.Body.Close()
+
+	bearer, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	key := req.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case req.URL.Path != path:
+		writeHTTPStatus(conn, http.StatusNotFound, nil)
+		return nil, fmt.Errorf("unknown path %q", req.URL.Path)
+	case subtle.ConstantTimeCompare([]byte(bearer), token) != 1:
+		writeHTTPStatus(conn, http.StatusUnauthorized, http.Header{"Www-Authenticate": {`Bearer realm="traffic-forwarder"`}})
+		return nil, errors.New("invalid bearer token")
+	case req.Method != http.MethodGet || !headerContains(req.Header, "Connection", "upgrade") ||
+		!headerContains(req.Header, "Upgrade", "websocket") || key == "":
+		writeHTTPStatus(conn, http.StatusBadRequest, nil)
+		return nil, errors.New("not a websocket upgrade request")
+	case req.Header.Get("Sec-WebSocket-Version") != "13":
+		writeHTTPStatus(conn, http.StatusUpgradeRequired, http.Header{"Sec-Websocket-Version": {"13"}})
+		return nil, fmt.Errorf("unsupported websocket version %q", req.Header.Get("Sec-WebSocket-Version"))
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n"
+	if _, err := io.WriteString(conn, resp); err != nil {
+		return nil, err
+	}
+	return newWSConn(conn, br, false), nil
+}
+
+// wsAccept 计算握手应答中的 Sec-WebSocket-Accept
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains 判断以逗号分隔的头部字段是否包含某个值，不区分大小写
+func headerContains(h http.Header, name, value string) bool {
+	for _, v := range h.Values(name) {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn WebSocket 连接，读写隧道数据，底层连接上传输二进制帧。
+// 读取时自动回复 ping，空闲时定期发送 ping 保持中间代理的连接。
+type wsConn struct {
+	net.Conn
+	br     *bufio.Reader
+	client bool // 客户端发送的帧需要掩码
+	ping   *time.Timer
+	closed atomic.Bool
+
+	wmu       sync.Mutex
+	wbuf      []byte
+	closeSent bool
+
+	remaining  uint64 // 当前数据帧尚未读出的载荷
+	fragmented bool   // 已收到分片消息的首帧，尚未收到结束帧
+	masked     bool
+	mask       [4]byte
+	maskPos    int
+	rerr       error
+}
+
+func newWSConn(conn net.Conn, br *bufio.Reader, client bool) *wsConn {
+	c := &wsConn{Conn: conn, br: br, client: client}
+	c.ping = time.AfterFunc(wsPingInterval, c.keepalive)
+	return c
+}
+
+// keepalive 定期发送 ping，写出失败或连接关闭后停止
+func (c *wsConn) keepalive() {
+	if c.closed.Load() {
+		return
+	}
+	c.wmu.Lock()
+	err := c.writeFrame(wsPing, nil)
+	c.wmu.Unlock()
+	if err == nil {
+		c.ping.Reset(wsPingInterval)
+	}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 && c.rerr == nil {
+		c.rerr = c.nextFrame()
+	}
+	if c.rerr != nil {
+		return 0, c.rerr
+	}
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.br.Read(b)
+	if c.masked {
+		for i := range b[:n] {
+			b[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remaining -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	c.rerr = err
+	return n, err
+}
+
+// nextFrame 读取下一个帧头，数据帧的载荷留给 Read 读取，控制帧在此处理。
+// 收到关闭帧时返回 io.EOF
+func (c *wsConn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	fin, opcode := hdr[0]&0x80 != 0, hdr[0]&0x0f
+	masked, length := hdr[1]&0x80 != 0, uint64(hdr[1]&0x7f)
+	if hdr[0]&0x70 != 0 || masked == c.client {
+		// 未协商扩展时保留位必须为 0；客户端的帧必须掩码，服务端的帧不能掩码
+		return c.fail(wsCloseProtocol)
+	}
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	c.masked, c.maskPos = masked, 0
+	if masked {
+		if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case wsContinuation:
+		// 延续帧只能出现在分片消息中，分片消息结束前不能开始新的数据消息
+		if !c.fragmented {
+			return c.fail(wsCloseProtocol)
+		}
+		c.fragmented, c.remaining = !fin, length
+		return nil
+	case wsBinary, wsText:
+		if c.fragmented {
+			return c.fail(wsCloseProtocol)
+		}
+		if opcode == wsText {
+			return c.fail(wsCloseUnsupported)
+		}
+		c.fragmented, c.remaining = !fin, length
+		return nil
+	case wsClose, wsPing, wsPong:
+	default:
+		return c.fail(wsCloseProtocol)
+	}
+	if !fin || length > 125 {
+		return c.fail(wsCloseProtocol)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= c.mask[i&3]
+		}
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	switch opcode {
+	case wsPing:
+		if !c.closeSent {
+			return c.writeFrame(wsPong, payload)
+		}
+	case wsClose:
+		return io.EOF
+	}
+	return nil
+}
+
+// fail 发送带状态码的关闭帧并返回协议错误
+func (c *wsConn) fail(code uint16) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.sendClose(code)
+	return errWSProtocol
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return 0, net.ErrClosed
+	}
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), wsMaxFrame)]
+		if err := c.writeFrame(wsBinary, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// writeFrame 写出一个完整的帧，调用方持有 wmu
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.wbuf = append(c.wbuf[:0], 0x80|opcode)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		c.wbuf = append(c.wbuf, maskBit|byte(n))
+	case n <= 0xffff:
+		c.wbuf = append(c.wbuf, maskBit|126)
+		c.wbuf = binary.BigEndian.AppendUint16(c.wbuf, uint16(n))
+	default:
+		c.wbuf = append(c.wbuf, maskBit|127)
+		c.wbuf = binary.BigEndian.AppendUint64(c.wbuf, uint64(n))
+	}
+	start := len(c.wbuf)
+	if c.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		c.wbuf = append(c.wbuf, mask[:]...)
+		start += 4
+		c.wbuf = append(c.wbuf, payload...)
+		for i := range payload {
+			c.wbuf[start+i] ^= mask[i&3]
+		}
+	} else {
+		c.wbuf = append(c.wbuf, payload...)
+	}
+	_, err := c.Conn.Write(c.wbuf)
+	return err
+}
+
+// sendClose 发送关闭帧，之后不再发送数据帧，调用方持有 wmu
+func (c *wsConn) sendClose(code uint16) error {
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+	c.ping.Stop()
+	return c.writeFrame(wsClose, binary.BigEndian.AppendUint16(nil, code))
+}
+
+// CloseWrite 发送关闭帧表示写方向结束
+func (c *wsConn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.sendClose(wsCloseNormal)
+}
+
+// Close 关闭连接，不等待进行中的写入，以便唤醒阻塞的写
+func (c *wsConn) Close() error {
+	c.closed.Store(true)
+	c.ping.Stop()
+	return c.Conn.Close()
+}
+
+// NetConn 返回被包装的连接
+func (c *wsConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,257 @@
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert 在 dir 中生成 127.0.0.1 的自签名证书和私钥，证书同时用作客户端信任的 CA
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "traffic-forwarder test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	certFile, keyFile = filepath.Join(dir, "ws.pem"), filepath.Join(dir, "ws.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+// testTLSConfig 返回信任 writeTestCert 证书的客户端 TLS 设置
+func testTLSConfig(t *testing.T, certFile string) *tls.Config {
+	t.Helper()
+	config, err := wsClientTLS("127.0.0.1:443", certFile)
+	if err != nil {
+		t.Fatalf("Failed to load CA: %v", err)
+	}
+	return config
+}
+
+// echoThrough 经 Unix 套接字上的入口发送随机数据，检查回显的数据与发送的一致
+func echoThrough(t *testing.T, sock string) {
+	t.Helper()
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	payload := make([]byte, 256<<10)
+	rand.Read(payload)
+	go func() {
+		conn.Write(payload)
+		conn.(*net.UnixConn).CloseWrite()
+	}()
+	got, err := io.ReadAll(conn)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Errorf("Expected %d bytes echoed through websocket, got %d, %v", len(payload), len(got), err)
+	}
+}
+
+// TestWebSocketTunnel 测试经 wss 传输的隧道，以及出口对路径、令牌、ping 和关闭帧的处理
+func TestWebSocketTunnel(t *testing.T) {
+	dir := t.TempDir()
+	token := filepath.Join(dir, "ws.token")
+	os.WriteFile(token, []byte("s3cret"), 0600)
+	cert, key := writeTestCert(t, dir)
+
+	echo := echoServer(t)
+	exit := startForwarder(t, Rule{Backends: []Backend{echo}, WebSocketAccept: "/tunnel", TokenFile: token, WebSocketCert: cert, WebSocketKey: key})
+	addr := "127.0.0.1:" + portOf(exit.Stats().Rules[0].Listen)
+	sock := filepath.Join(dir, "entry.sock")
+	startForwarder(t, Rule{LocalUnix: sock, Backends: []Backend{{Network: "tcp", Address: addr}}, WebSocket: "/tunnel",
+		TokenFile: token, WebSocketTLS: true, WebSocketCA: cert})
+	echoThrough(t, sock)
+
+	// 路径或令牌错误的升级请求收到 HTTP 错误
+	config := testTLSConfig(t, cert)
+	for _, tc := range []struct{ path, token, status string }{
+		{"/other", "s3cret", "404"},
+		{"/tunnel", "wrong", "401"},
+	} {
+		raw, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			t.Fatalf("Failed to dial exit: %v", err)
+		}
+		raw.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(raw, "GET "+tc.path+" HTTP/1.1\r\nHost: exit\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nAuthorization: Bearer "+tc.token+"\r\n\r\n")
+		line, _ := readAgentLine(raw)
+		raw.Close()
+		if !strings.HasPrefix(line, "HTTP/1.1 "+tc.status) {
+			t.Errorf("Expected %s for path %s and token %s, got %q", tc.status, tc.path, tc.token, line)
+		}
+	}
+
+	// 出口回复 ping，写方向结束后以关闭帧回应关闭帧
+	raw, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatalf("Failed to dial exit: %v", err)
+	}
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	c, err := dialWebSocket(raw, addr, "/tunnel", token)
+	if err != nil {
+		t.Fatalf("Failed to upgrade: %v", err)
+	}
+	ws := c.(*wsConn)
+	ws.wmu.Lock()
+	ws.writeFrame(wsPing, []byte("hi"))
+	ws.wmu.Unlock()
+	frame := make([]byte, 4)
+	if _, err := io.ReadFull(ws.br, frame); err != nil || !bytes.Equal(frame, []byte{0x80 | wsPong, 2, 'h', 'i'}) {
+		t.Errorf("Expected pong frame, got %x, %v", frame, err)
+	}
+	ws.CloseWrite()
+	if _, err := io.ReadFull(ws.br, frame); err != nil || !bytes.Equal(frame, []byte{0x80 | wsClose, 2, 0x03, 0xe8}) {
+		t.Errorf("Expected close frame, got %x, %v", frame, err)
+	}
+	ws.Close()
+
+	// 不带 TLS 的客户端无法完成升级
+	plain, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial exit: %v", err)
+	}
+	defer plain.Close()
+	plain.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := dialWebSocket(plain, addr, "/tunnel", token); err == nil {
+		t.Error("Expected plain websocket upgrade to fail against a TLS exit")
+	}
+}
+
+// TestWebSocketProxy 测试入口经需要认证的 HTTP 代理以 CONNECT 连接出口
+func TestWebSocketProxy(t *testing.T) {
+	dir := t.TempDir()
+	token := filepath.Join(dir, "ws.token")
+	os.WriteFile(token, []byte("s3cret"), 0600)
+	cert, key := writeTestCert(t, dir)
+	creds := filepath.Join(dir, "proxy.passwd")
+	os.WriteFile(creds, []byte("alice:secret\n"), 0600)
+
+	echo := echoServer(t)
+	exit := startForwarder(t, Rule{Backends: []Backend{echo}, WebSocketAccept: "/tunnel", TokenFile: token, WebSocketCert: cert, WebSocketKey: key})
+	addr := "127.0.0.1:" + portOf(exit.Stats().Rules[0].Listen)
+	proxy := startForwarder(t, Rule{Mode: ModeHTTPConnect, AuthFile: creds, Allow: []string{"127.0.0.0/8:" + portOf(addr)}})
+	proxyAddr := proxy.Stats().Rules[0].Listen
+
+	sock := filepath.Join(dir, "entry.sock")
+	startForwarder(t, Rule{LocalUnix: sock, Backends: []Backend{{Network: "tcp", Address: addr}}, WebSocket: "/tunnel",
+		TokenFile: token, WebSocketTLS: true, WebSocketCA: cert, WebSocketProxy: "http://alice:secret@" + proxyAddr})
+	echoThrough(t, sock)
+
+	// 代理拒绝错误的凭据
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	wrong, _ := parseProxyURL("http://alice:wrong@" + proxyAddr)
+	if err := proxyConnect(conn, wrong, addr); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("Expected CONNECT with wrong credentials to be rejected with 407, got %v", err)
+	}
+}
+
+// TestWebSocketPlainToken 测试未启用 TLS 或加密的 websocket 规则被拒绝，避免令牌以明文传输
+func TestWebSocketPlainToken(t *testing.T) {
+	rule := Rule{LocalPort: 18080, Backends: []Backend{{Network: "tcp", Address: "127.0.0.1:80"}}, WebSocket: "/tunnel", TokenFile: "ws.token"}
+	if _, err := New(DefaultOptions(), []Rule{rule}); err == nil {
+		t.Error("Expected a websocket rule without websocket-tls or encrypt to be rejected")
+	}
+	rule.Encrypt = "tunnel.keys"
+	if _, err := New(DefaultOptions(), []Rule{rule}); err != nil {
+		t.Errorf("Expected an encrypted websocket rule to be accepted, got %v", err)
+	}
+}
+
+// TestWebSocketFragmentation 测试分片消息的重组，以及没有进行中的分片消息时的延续帧和
+// 分片消息未结束时的新数据帧被视为协议错误
+func TestWebSocketFragmentation(t *testing.T) {
+	// frame 构造客户端发出的帧，掩码为全零，载荷不变
+	frame := func(fin bool, opcode byte, payload string) []byte {
+		b := []byte{opcode, 0x80 | byte(len(payload)), 0, 0, 0, 0}
+		if fin {
+			b[0] |= 0x80
+		}
+		return append(b, payload...)
+	}
+	read := func(frames ...[]byte) (string, error) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			for _, f := range frames {
+				client.Write(f)
+			}
+			// 读出服务端回复的关闭帧，避免阻塞
+			io.Copy(io.Discard, client)
+		}()
+		ws := newWSConn(server, bufio.NewReader(server), false)
+		defer ws.Close()
+		var got []byte
+		buf := make([]byte, 16)
+		for {
+			n, err := ws.Read(buf)
+			got = append(got, buf[:n]...)
+			if err != nil {
+				return string(got), err
+			}
+		}
+	}
+
+	got, err := read(frame(false, wsBinary, "ab"), frame(false, wsContinuation, "cd"), frame(true, wsContinuation, "ef"),
+		frame(true, wsBinary, "gh"), frame(true, wsClose, ""))
+	if got != "abcdefgh" || err != io.EOF {
+		t.Errorf("Expected fragmented message reassembled, got %q, %v", got, err)
+	}
+	if _, err := read(frame(true, wsContinuation, "ab")); !errors.Is(err, errWSProtocol) {
+		t.Errorf("Expected protocol error for a continuation frame without a message, got %v", err)
+	}
+	if _, err := read(frame(true, wsBinary, "ab"), frame(true, wsContinuation, "cd")); !errors.Is(err, errWSProtocol) {
+		t.Errorf("Expected protocol error for a continuation frame after a final frame, got %v", err)
+	}
+	if _, err := read(frame(false, wsBinary, "ab"), frame(true, wsBinary, "cd")); !errors.Is(err, errWSProtocol) {
+		t.Errorf("Expected protocol error for a data frame inside a fragmented message, got %v", err)
+	}
+	// 控制帧可以夹在分片之间
+	got, err = read(frame(false, wsBinary, "ab"), frame(true, wsPong, ""), frame(true, wsContinuation, "cd"), frame(true, wsClose, ""))
+	if got != "abcd" || err != io.EOF {
+		t.Errorf("Expected control frame between fragments to be allowed, got %q, %v", got, err)
+	}
+}